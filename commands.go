@@ -0,0 +1,404 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/chris-wood/ohttp-go"
+	"github.com/cloudflare/app-gateway-go/gateway"
+)
+
+// command is a subcommand of the gateway binary, selected by the first argument. Commands
+// write their output to stdout and report failures by returning an error.
+type command struct {
+	run func(args []string, stdout io.Writer) error
+}
+
+var commands = map[string]command{
+	"serve": {run: func(args []string, stdout io.Writer) error {
+		serve(args)
+		return nil
+	}},
+	"keygen":      {run: keygenCommand},
+	"show-keys":   {run: showKeysCommand},
+	"encapsulate": {run: encapsulateCommand},
+	"decapsulate": {run: decapsulateCommand},
+	"replay":      {run: replayCommand},
+}
+
+const commandList = "Commands: serve (default), keygen, show-keys, encapsulate, decapsulate, replay. Run a command with -h for its flags."
+
+// Response headers that differ between otherwise identical responses
+const defaultReplayIgnoredHeaders = "Date,Age,Expires"
+
+// Largest line of a capture that replay reads
+const maxCaptureLineLength = 64 << 20
+
+func usage(flags *flag.FlagSet, synopsis, description string) func() {
+	return func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s\n\n%s\n\n", filepath.Base(os.Args[0]), synopsis, description)
+		flags.PrintDefaults()
+	}
+}
+
+// parseCommandFlags parses the flags of a command, treating a request for help as success.
+func parseCommandFlags(flags *flag.FlagSet, args []string) (bool, error) {
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return false, nil
+		}
+		return false, err
+	}
+	if flags.NArg() > 0 {
+		return false, fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+	return true, nil
+}
+
+func readInput(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
+
+func writeOutput(path string, stdout io.Writer, data []byte) error {
+	if path == "-" {
+		_, err := stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// keygenCommand generates a new secret key seed, either as the hex string expected in
+// SEED_SECRET_KEY or as a "keys" configuration file section.
+func keygenCommand(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	kem := flags.String("kem", defaultKeyConfigKEM, "KEM of the primary key configuration: "+strings.Join(keyConfigKEMNames(), ", "))
+	configID := flags.Uint("config-id", 0, "key ID of the primary key configuration")
+	format := flags.String("format", "hex", "output format: hex (for "+secretSeedEnvironmentVariable+") or json (a configuration file for -config)")
+	out := flags.String("out", "-", "file to write the key to; it must not exist yet")
+	flags.Usage = usage(flags, "keygen [flags]", "Generate a new secret key seed from which the gateway derives its key configurations.")
+	if ok, err := parseCommandFlags(flags, args); !ok {
+		return err
+	}
+
+	kemID, ok := keyConfigKEMs[*kem]
+	if !ok {
+		return fmt.Errorf("unknown KEM %q", *kem)
+	}
+	if *configID > 255 {
+		return fmt.Errorf("invalid key ID %d", *configID)
+	}
+
+	seed := make([]byte, defaultSeedLength)
+	if _, err := rand.Read(seed); err != nil {
+		return err
+	}
+	config, _, err := deriveKeyConfigs(uint8(*configID), kemID, seed)
+	if err != nil {
+		return err
+	}
+
+	var output []byte
+	switch *format {
+	case "hex":
+		output = []byte(hex.EncodeToString(seed) + "\n")
+	case "json":
+		keys := struct {
+			Keys keysConfig `json:"keys"`
+		}{
+			Keys: keysConfig{
+				ConfigID: uint64(*configID),
+				Seed:     hex.EncodeToString(seed),
+				KEM:      *kem,
+			},
+		}
+		output, err = json.MarshalIndent(keys, "", "  ")
+		if err != nil {
+			return err
+		}
+		output = append(output, '\n')
+	default:
+		return fmt.Errorf("unknown output format %q", *format)
+	}
+
+	if *out == "-" {
+		_, err = stdout.Write(output)
+	} else {
+		// Never overwrite an existing key, and keep the new one private to its owner
+		var file *os.File
+		file, err = os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err = file.Write(output); err == nil {
+			err = file.Close()
+		} else {
+			file.Close()
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Generated key %d (%s) with fingerprint %s\n", *configID, *kem, keyConfigFingerprint(config.Config()))
+	return nil
+}
+
+// showKeysCommand prints the public key configurations the gateway derives from its
+// configuration, as served on the configuration endpoints.
+func showKeysCommand(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("show-keys", flag.ContinueOnError)
+	configFile := flags.String("config", "", "path to a JSON configuration file; environment variables override its values")
+	flags.Usage = usage(flags, "show-keys [flags]", "Print the public key configurations of the gateway.")
+	if ok, err := parseCommandFlags(flags, args); !ok {
+		return err
+	}
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	config, legacyConfig, err := cfg.Keys.keyConfigs()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range []struct {
+		name   string
+		config ohttp.PublicConfig
+	}{
+		{"primary", config.Config()},
+		{"legacy", legacyConfig.Config()},
+	} {
+		fmt.Fprintf(stdout, "Key ID %d (%s)\n", key.config.ID, key.name)
+		fmt.Fprintf(stdout, "   KEM:         %s (0x%04x)\n", gateway.KEMName(key.config.KEMID), uint16(key.config.KEMID))
+		for _, suite := range key.config.Suites {
+			fmt.Fprintf(stdout, "   KDF, AEAD:   0x%04x, 0x%04x\n", uint16(suite.KDFID), uint16(suite.AEADID))
+		}
+		fmt.Fprintf(stdout, "   Public key:  %x\n", key.config.PublicKeyBytes)
+		fmt.Fprintf(stdout, "   Config:      %x\n", key.config.Marshal())
+		fmt.Fprintf(stdout, "   Fingerprint: %s\n", keyConfigFingerprint(key.config))
+	}
+	fmt.Fprintf(stdout, "Key configurations (%s): %x\n", cfg.Endpoints.Config, cfg.newGateway(config, legacyConfig).MarshalConfigs())
+	return nil
+}
+
+// encapsulateCommand encrypts a request to a gateway key configuration, producing the body of
+// a message/ohttp-req request.
+func encapsulateCommand(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("encapsulate", flag.ContinueOnError)
+	configFile := flags.String("config", "", "path to a JSON configuration file; environment variables override its values")
+	keyConfigFile := flags.String("key-config", "", "file holding the key configuration(s) to encrypt to, as served on the configuration endpoints; defaults to the gateway's own keys")
+	keyID := flags.Int("key-id", -1, "key ID of the key configuration to use; defaults to the first one")
+	in := flags.String("in", "-", "file holding the request")
+	out := flags.String("out", "-", "file to write the encapsulated request to")
+	raw := flags.Bool("raw", false, "encapsulate the input as-is instead of encoding an HTTP/1.1 request as binary HTTP")
+	flags.Usage = usage(flags, "encapsulate [flags]", "Encapsulate a request for the gateway. The input is an HTTP/1.1 request such as\n\n  GET /path HTTP/1.1\n  Host: example.com\n\nwhich is sent over https unless it has an absolute URL. With -raw the input is a payload of\nthe configured custom request content type.")
+	if ok, err := parseCommandFlags(flags, args); !ok {
+		return err
+	}
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+
+	var keyConfigs []ohttp.PublicConfig
+	if *keyConfigFile != "" {
+		data, err := os.ReadFile(*keyConfigFile)
+		if err != nil {
+			return err
+		}
+		if keyConfigs, err = unmarshalKeyConfigs(data); err != nil {
+			return err
+		}
+	} else {
+		config, legacyConfig, err := cfg.Keys.keyConfigs()
+		if err != nil {
+			return err
+		}
+		keyConfigs = []ohttp.PublicConfig{config.Config(), legacyConfig.Config()}
+	}
+
+	keyConfig := keyConfigs[0]
+	if *keyID >= 0 {
+		found := false
+		for _, config := range keyConfigs {
+			if int(config.ID) == *keyID {
+				keyConfig, found = config, true
+			}
+		}
+		if !found {
+			return fmt.Errorf("no key configuration with key ID %d", *keyID)
+		}
+	}
+
+	payload, err := readInput(*in)
+	if err != nil {
+		return err
+	}
+	if !*raw {
+		if payload, err = encodeBinaryRequest(payload); err != nil {
+			return err
+		}
+	}
+
+	client := ohttp.NewDefaultClient(keyConfig)
+	if cfg.customContent() {
+		client = ohttp.NewCustomClient(keyConfig, cfg.Content.RequestType, cfg.Content.ResponseType)
+	}
+	encapsulatedReq, _, err := client.EncapsulateRequest(payload)
+	if err != nil {
+		return err
+	}
+	return writeOutput(*out, stdout, encapsulatedReq.Marshal())
+}
+
+// decapsulateCommand decrypts a message/ohttp-req request body with the gateway's keys.
+func decapsulateCommand(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("decapsulate", flag.ContinueOnError)
+	configFile := flags.String("config", "", "path to a JSON configuration file; environment variables override its values")
+	in := flags.String("in", "-", "file holding the encapsulated request")
+	out := flags.String("out", "-", "file to write the request to")
+	raw := flags.Bool("raw", false, "write the decapsulated payload as-is instead of decoding binary HTTP as an HTTP/1.1 request")
+	flags.Usage = usage(flags, "decapsulate [flags]", "Decapsulate a request encapsulated for the gateway using its configured keys.")
+	if ok, err := parseCommandFlags(flags, args); !ok {
+		return err
+	}
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	config, legacyConfig, err := cfg.Keys.keyConfigs()
+	if err != nil {
+		return err
+	}
+
+	data, err := readInput(*in)
+	if err != nil {
+		return err
+	}
+	encapsulatedReq, err := ohttp.UnmarshalEncapsulatedRequest(data)
+	if err != nil {
+		return err
+	}
+	payload, _, err := cfg.newGateway(config, legacyConfig).DecapsulateRequest(encapsulatedReq)
+	if err != nil {
+		return err
+	}
+
+	if !*raw && !cfg.customContent() {
+		req, err := ohttp.UnmarshalBinaryRequest(payload)
+		if err != nil {
+			return err
+		}
+		if payload, err = httputil.DumpRequest(req, true); err != nil {
+			return err
+		}
+	}
+	return writeOutput(*out, stdout, payload)
+}
+
+// replayCommand sends the requests of a capture again to their targets, subject to the allowed
+// target origins of the gateway, and reports the responses that differ from the captured ones.
+func replayCommand(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	configFile := flags.String("config", "", "path to a JSON configuration file; environment variables override its values")
+	in := flags.String("in", "-", "capture file written by a gateway with a capture file set")
+	ignoreHeaders := flags.String("ignore-headers", defaultReplayIgnoredHeaders, "comma-separated response headers not compared")
+	flags.Usage = usage(flags, "replay [flags]", "Replay the captured requests of a gateway and compare the responses with the captured ones.")
+	if ok, err := parseCommandFlags(flags, args); !ok {
+		return err
+	}
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	handler := gateway.NewFilteredHttpRequestHandler(&http.Client{
+		Timeout: milliseconds(cfg.Upstream.TimeoutMs),
+	}, cfg.Policy.AllowedTargetOrigins, nil)
+	var ignoredHeaders []string
+	if *ignoreHeaders != "" {
+		ignoredHeaders = strings.Split(*ignoreHeaders, ",")
+	}
+
+	input := os.Stdin
+	if *in != "-" {
+		if input, err = os.Open(*in); err != nil {
+			return err
+		}
+		defer input.Close()
+	}
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(nil, maxCaptureLineLength)
+
+	line, replayed, differing := 0, 0, 0
+	for scanner.Scan() {
+		line++
+		var record gateway.CaptureRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if record.Request == nil || record.Response == nil {
+			fmt.Fprintf(stdout, "line %d: skipped, no decoded request and response\n", line)
+			continue
+		}
+
+		replayed++
+		response, err := record.Replay(handler)
+		if err != nil {
+			differing++
+			fmt.Fprintf(stdout, "line %d: %s %s: %s\n", line, record.Request.Method, record.Request.URL, err)
+			continue
+		}
+		diffs := gateway.DiffCapturedResponses(record.Response, response, ignoredHeaders)
+		if len(diffs) == 0 {
+			fmt.Fprintf(stdout, "line %d: %s %s: same response\n", line, record.Request.Method, record.Request.URL)
+			continue
+		}
+		differing++
+		fmt.Fprintf(stdout, "line %d: %s %s: different response\n", line, record.Request.Method, record.Request.URL)
+		for _, diff := range diffs {
+			fmt.Fprintf(stdout, "   %s\n", diff)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if differing > 0 {
+		return fmt.Errorf("%d of %d replayed responses differ", differing, replayed)
+	}
+	return nil
+}
+
+// encodeBinaryRequest encodes an HTTP/1.1 request as a binary HTTP request.
+func encodeBinaryRequest(data []byte) ([]byte, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse HTTP request: %w", err)
+	}
+	if req.URL.Scheme == "" {
+		req.URL.Scheme = "https"
+	}
+	binaryRequest := ohttp.BinaryRequest(*req)
+	return binaryRequest.Marshal()
+}
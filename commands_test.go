@@ -0,0 +1,135 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chris-wood/ohttp-go"
+	"github.com/cloudflare/app-gateway-go/gateway"
+)
+
+func runCommand(t *testing.T, name string, args ...string) string {
+	t.Helper()
+	var stdout bytes.Buffer
+	if err := commands[name].run(args, &stdout); err != nil {
+		t.Fatalf("%s %s: %s", name, strings.Join(args, " "), err)
+	}
+	return stdout.String()
+}
+
+func TestKeygenAndShowKeys(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "keys.json")
+	runCommand(t, "keygen", "-format", "json", "-kem", "x25519", "-config-id", "9", "-out", keyFile)
+
+	if err := commands["keygen"].run([]string{"-out", keyFile}, &bytes.Buffer{}); err == nil {
+		t.Fatal("Expected keygen to refuse to overwrite an existing key")
+	}
+
+	output := runCommand(t, "show-keys", "-config", keyFile)
+	for _, expected := range []string{"Key ID 9 (primary)", "x25519 (0x0020)", "Key ID 137 (legacy)", "Fingerprint: "} {
+		if !strings.Contains(output, expected) {
+			t.Fatalf("Expected %q in show-keys output:\n%s", expected, output)
+		}
+	}
+
+	cfg, err := loadConfig(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, legacyConfig, err := cfg.Keys.keyConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	marshalledConfigs := cfg.newGateway(config, legacyConfig).MarshalConfigs()
+	if !strings.Contains(output, hex.EncodeToString(marshalledConfigs)) {
+		t.Fatalf("Expected the encoded key configurations in show-keys output:\n%s", output)
+	}
+
+	keyConfigs, err := unmarshalKeyConfigs(marshalledConfigs)
+	if err != nil || len(keyConfigs) != 2 || !keyConfigs[0].IsEqual(config.Config()) {
+		t.Fatalf("Failed to decode key configuration list: %v", err)
+	}
+	keyConfigs, err = unmarshalKeyConfigs(legacyConfig.Config().Marshal())
+	if err != nil || len(keyConfigs) != 1 || !keyConfigs[0].IsEqual(legacyConfig.Config()) {
+		t.Fatalf("Failed to decode single key configuration: %v", err)
+	}
+}
+
+func TestEncapsulateDecapsulate(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "keys.json")
+	runCommand(t, "keygen", "-format", "json", "-out", keyFile)
+
+	requestFile := filepath.Join(dir, "request.txt")
+	request := "POST /submit HTTP/1.1\r\nHost: allowed.example\r\nContent-Length: 5\r\n\r\nhello"
+	if err := os.WriteFile(requestFile, []byte(request), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	encapsulatedFile := filepath.Join(dir, "request.ohttp")
+	runCommand(t, "encapsulate", "-config", keyFile, "-in", requestFile, "-out", encapsulatedFile)
+
+	encapsulated, err := os.ReadFile(encapsulatedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encapsulatedReq, err := ohttp.UnmarshalEncapsulatedRequest(encapsulated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encapsulatedReq.KeyID != 0 {
+		t.Fatalf("Expected the request to be encapsulated to key 0, got %d", encapsulatedReq.KeyID)
+	}
+
+	output := runCommand(t, "decapsulate", "-config", keyFile, "-in", encapsulatedFile)
+	for _, expected := range []string{"POST /submit HTTP/1.1", "Host: allowed.example", "hello"} {
+		if !strings.Contains(output, expected) {
+			t.Fatalf("Expected %q in decapsulated request:\n%s", expected, output)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+	}))
+	defer target.Close()
+
+	dir := t.TempDir()
+	captureFile := filepath.Join(dir, "capture.jsonl")
+	var capture bytes.Buffer
+	encoder := json.NewEncoder(&capture)
+	for _, path := range []string{"/same", "/changed"} {
+		encoder.Encode(gateway.CaptureRecord{
+			ContentType: "message/bhttp request",
+			Request:     &gateway.CapturedRequest{Method: http.MethodGet, URL: target.URL + path},
+			Response:    &gateway.CapturedResponse{StatusCode: http.StatusOK, Body: []byte("GET /same")},
+		})
+	}
+	encoder.Encode(gateway.CaptureRecord{ContentType: "message/custom", RawRequest: []byte("opaque")})
+	if err := os.WriteFile(captureFile, capture.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout bytes.Buffer
+	err := commands["replay"].run([]string{"-in", captureFile, "-ignore-headers", "Date,Content-Type"}, &stdout)
+	if err == nil || err.Error() != "1 of 2 replayed responses differ" {
+		t.Fatalf("Expected one differing response, got %v", err)
+	}
+	for _, expected := range []string{"line 1: GET " + target.URL + "/same: same response", "line 2: GET " + target.URL + "/changed: different response", "line 3: skipped"} {
+		if !strings.Contains(stdout.String(), expected) {
+			t.Fatalf("Expected %q in replay output:\n%s", expected, stdout.String())
+		}
+	}
+}
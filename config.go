@@ -0,0 +1,781 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/chris-wood/ohttp-go"
+	"github.com/cloudflare/app-gateway-go/gateway"
+)
+
+// Placeholder printed in place of secret configuration values.
+const redactedValue = "REDACTED"
+
+// gatewayConfig is the complete configuration of the gateway. It is read from an optional
+// JSON file, overridden by environment variables, and then validated as a whole.
+type gatewayConfig struct {
+	Port      string          `json:"port"`
+	Endpoints endpointsConfig `json:"endpoints"`
+	Keys      keysConfig      `json:"keys"`
+	Policy    policyConfig    `json:"policy"`
+	Content   contentConfig   `json:"content"`
+	Upstream  upstreamConfig  `json:"upstream"`
+	Metrics   metricsConfig   `json:"metrics"`
+	TLS       tlsConfig       `json:"tls"`
+	Server    serverConfig    `json:"server"`
+	Relay     relayConfig     `json:"relay"`
+	Log       logConfig       `json:"log"`
+	Debug     debugConfig     `json:"debug"`
+}
+
+type endpointsConfig struct {
+	Gateway      string `json:"gateway"`
+	Config       string `json:"config"`
+	LegacyConfig string `json:"legacy_config"`
+	Echo         string `json:"echo"`
+	Metadata     string `json:"metadata"`
+	Health       string `json:"health"`
+	Circuits     string `json:"circuits"`
+	Ready        string `json:"ready"`
+	Metrics      string `json:"metrics"`
+}
+
+type keysConfig struct {
+	// ConfigID is the key ID of the primary key configuration. The legacy key ID is derived from it.
+	ConfigID uint64 `json:"config_id"`
+	// Seed is the hex-encoded secret seed from which keys are derived. Keys are random if unset.
+	Seed string `json:"seed"`
+	// KEM is the name of the KEM of the primary key configuration.
+	KEM string `json:"kem"`
+}
+
+type policyConfig struct {
+	AllowedTargetOrigins []string `json:"allowed_target_origins"`
+}
+
+type contentConfig struct {
+	RequestType              string `json:"request_type"`
+	ResponseType             string `json:"response_type"`
+	OpaqueForwardURL         string `json:"opaque_forward_url"`
+	OpaqueForwardContentType string `json:"opaque_forward_content_type"`
+}
+
+type upstreamConfig struct {
+	TimeoutMs      uint64               `json:"timeout_ms"`
+	Retry          retryConfig          `json:"retry"`
+	CircuitBreaker circuitBreakerConfig `json:"circuit_breaker"`
+	Proxy          proxyConfig          `json:"proxy"`
+	Cache          cacheConfig          `json:"cache"`
+}
+
+type retryConfig struct {
+	MaxAttempts   uint64 `json:"max_attempts"`
+	BaseDelayMs   uint64 `json:"base_delay_ms"`
+	MaxDelayMs    uint64 `json:"max_delay_ms"`
+	BudgetPercent uint64 `json:"budget_percent"`
+}
+
+type circuitBreakerConfig struct {
+	FailureRatePercent uint64 `json:"failure_rate_percent"`
+	Window             uint64 `json:"window"`
+	MinRequests        uint64 `json:"min_requests"`
+	CoolDownMs         uint64 `json:"cool_down_ms"`
+	HalfOpenProbes     uint64 `json:"half_open_probes"`
+}
+
+type proxyConfig struct {
+	URL      string   `json:"url"`
+	Bypass   []string `json:"bypass"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+}
+
+type cacheConfig struct {
+	MaxBytes      uint64 `json:"max_bytes"`
+	MaxEntryBytes uint64 `json:"max_entry_bytes"`
+}
+
+type metricsConfig struct {
+	// Backends are where metrics are reported: sent to statsd, served for Prometheus to scrape on
+	// the metrics endpoint of the ops listener, or logged. Every event is reported to each of them.
+	Backends        []string `json:"backends"`
+	ServiceName     string   `json:"service_name"`
+	StatsDHost      string   `json:"statsd_host"`
+	StatsDPort      string   `json:"statsd_port"`
+	StatsDTimeoutMs uint64   `json:"statsd_timeout_ms"`
+}
+
+type tlsConfig struct {
+	// TLS is served if KeyFile is set or additional certificates are configured.
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// Certificates are additional certificates, selected by the server name the client requests.
+	Certificates []CertificatePair `json:"certificates"`
+	MinVersion   string            `json:"min_version"`
+	CipherSuites []string          `json:"cipher_suites"`
+	// ReloadIntervalMs is how often certificate files are checked for changes. Zero disables
+	// polling, leaving SIGHUP as the only way to reload certificates.
+	ReloadIntervalMs uint64 `json:"reload_interval_ms"`
+}
+
+// certificatePairs returns all configured certificate pairs, the primary one first.
+func (c tlsConfig) certificatePairs() []CertificatePair {
+	var pairs []CertificatePair
+	if c.KeyFile != "" {
+		pairs = append(pairs, CertificatePair{CertFile: c.CertFile, KeyFile: c.KeyFile})
+	}
+	return append(pairs, c.Certificates...)
+}
+
+type serverConfig struct {
+	ReadHeaderTimeoutMs uint64 `json:"read_header_timeout_ms"`
+	ReadTimeoutMs       uint64 `json:"read_timeout_ms"`
+	WriteTimeoutMs      uint64 `json:"write_timeout_ms"`
+	IdleTimeoutMs       uint64 `json:"idle_timeout_ms"`
+	DrainPeriodMs       uint64 `json:"drain_period_ms"`
+	ShutdownTimeoutMs   uint64 `json:"shutdown_timeout_ms"`
+	// OpsAddress is the address of the listener for health, admin and debugging endpoints.
+	OpsAddress string `json:"ops_address"`
+	// PublicIndex serves the index page describing the configuration on the public listener too.
+	PublicIndex bool `json:"public_index"`
+	// SelfTestIntervalMs is how often the self-test reported by the readiness endpoint runs.
+	SelfTestIntervalMs uint64 `json:"self_test_interval_ms"`
+	// SelfTestProbeOrigins are target origins that must be reachable for the gateway to be ready.
+	SelfTestProbeOrigins []string `json:"self_test_probe_origins"`
+}
+
+type relayConfig struct {
+	// CAFiles enables mutual TLS: requests to the gateway endpoints are only accepted with a
+	// client certificate issued by one of these CAs.
+	CAFiles []string `json:"ca_files"`
+	// AllowedIdentities restricts the accepted client certificates to these SANs or subjects.
+	AllowedIdentities []string `json:"allowed_identities"`
+	// HMACKeys are hex-encoded secrets shared with relays that authenticate requests with an
+	// HMAC, by key ID.
+	HMACKeys map[string]string `json:"hmac_keys"`
+	// HMACMaxSkewMs is how far the time a request was signed may be from the current time.
+	HMACMaxSkewMs uint64 `json:"hmac_max_skew_ms"`
+}
+
+// relayAuthenticator returns the authenticator for the configured relay authentication
+// schemes, or nil if relays are not authenticated.
+func (c relayConfig) relayAuthenticator() gateway.RelayAuthenticator {
+	var authenticators gateway.AnyRelayAuthenticator
+	if len(c.CAFiles) > 0 {
+		authenticators = append(authenticators, gateway.NewClientCertificateRelayAuthenticator(c.AllowedIdentities))
+	}
+	if len(c.HMACKeys) > 0 {
+		keys := make(map[string][]byte)
+		for keyID, secret := range c.HMACKeys {
+			keys[keyID], _ = hex.DecodeString(secret)
+		}
+		authenticators = append(authenticators, gateway.NewHMACRelayAuthenticator(keys, milliseconds(c.HMACMaxSkewMs)))
+	}
+
+	switch len(authenticators) {
+	case 0:
+		return nil
+	case 1:
+		return authenticators[0]
+	default:
+		return authenticators
+	}
+}
+
+type logConfig struct {
+	// Level is the minimum level of logged entries: debug, info, warn or error.
+	Level string `json:"level"`
+	// Format is the format of log entries: text or json.
+	Format string `json:"format"`
+}
+
+type debugConfig struct {
+	// DebugResponses includes error details in gateway error responses.
+	DebugResponses bool `json:"debug_responses"`
+	// Verbose logs every request, as the debug log level does.
+	Verbose bool `json:"verbose"`
+	// UnredactedLogs logs secrets and private data of clients, such as their addresses and the
+	// URLs they request. It must never be enabled in production.
+	UnredactedLogs bool `json:"unredacted_logs"`
+	// DevMode allows features that expose private data of clients, such as captures.
+	DevMode bool `json:"dev_mode"`
+	// CaptureFile is the file to which decapsulated requests and their responses are appended as
+	// JSON lines, for replay. It requires DevMode.
+	CaptureFile string `json:"capture_file"`
+	// CaptureRedact lists the header names, and the pseudo-fields body and query, whose values
+	// are left out of captures, in addition to defaultCaptureRedact.
+	CaptureRedact []string `json:"capture_redact"`
+}
+
+func defaultGatewayConfig() gatewayConfig {
+	return gatewayConfig{
+		Port: defaultPort,
+		Endpoints: endpointsConfig{
+			Gateway:      defaultGatewayEndpoint,
+			Config:       defaultConfigEndpoint,
+			LegacyConfig: defaultLegacyConfigEndpoint,
+			Echo:         defaultEchoEndpoint,
+			Metadata:     defaultMetadataEndpoint,
+			Health:       defaultHealthEndpoint,
+			Circuits:     defaultCircuitsEndpoint,
+			Ready:        defaultReadyEndpoint,
+			Metrics:      defaultMetricsEndpoint,
+		},
+		Keys: keysConfig{
+			KEM: defaultKeyConfigKEM,
+		},
+		Content: contentConfig{
+			OpaqueForwardContentType: defaultOpaqueForwardContentType,
+		},
+		Upstream: upstreamConfig{
+			TimeoutMs: defaultUpstreamTimeoutMs,
+			Retry: retryConfig{
+				MaxAttempts:   defaultUpstreamRetryMaxAttempts,
+				BaseDelayMs:   defaultUpstreamRetryBaseDelayMs,
+				MaxDelayMs:    defaultUpstreamRetryMaxDelayMs,
+				BudgetPercent: defaultUpstreamRetryBudgetPercent,
+			},
+			CircuitBreaker: circuitBreakerConfig{
+				FailureRatePercent: defaultCircuitBreakerFailureRatePercent,
+				Window:             defaultCircuitBreakerWindow,
+				MinRequests:        defaultCircuitBreakerMinRequests,
+				CoolDownMs:         defaultCircuitBreakerCoolDownMs,
+				HalfOpenProbes:     defaultCircuitBreakerHalfOpenProbes,
+			},
+			Cache: cacheConfig{
+				MaxBytes:      defaultResponseCacheMaxBytes,
+				MaxEntryBytes: defaultResponseCacheMaxEntryBytes,
+			},
+		},
+		Metrics: metricsConfig{
+			Backends:        []string{defaultMetricsBackend},
+			ServiceName:     defaultMonitoringServiceName,
+			StatsDTimeoutMs: defaultStatsDTimeoutMs,
+		},
+		TLS: tlsConfig{
+			CertFile:         defaultCertFile,
+			MinVersion:       defaultTLSMinVersion,
+			ReloadIntervalMs: defaultTLSReloadIntervalMs,
+		},
+		Relay: relayConfig{
+			HMACMaxSkewMs: defaultRelayHMACMaxSkewMs,
+		},
+		Log: logConfig{
+			Level:  defaultLogLevel,
+			Format: defaultLogFormat,
+		},
+		Server: serverConfig{
+			ReadHeaderTimeoutMs: defaultServerReadHeaderTimeoutMs,
+			ReadTimeoutMs:       defaultServerReadTimeoutMs,
+			WriteTimeoutMs:      defaultServerWriteTimeoutMs,
+			IdleTimeoutMs:       defaultServerIdleTimeoutMs,
+			DrainPeriodMs:       defaultShutdownDrainPeriodMs,
+			ShutdownTimeoutMs:   defaultShutdownTimeoutMs,
+			OpsAddress:          defaultOpsAddress,
+			SelfTestIntervalMs:  defaultSelfTestIntervalMs,
+		},
+	}
+}
+
+// configErrors collects every problem found with a configuration, so that all of them can be
+// reported at once rather than one per attempt.
+type configErrors []error
+
+func (e configErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("%d configuration error(s):\n  %s", len(e), strings.Join(messages, "\n  "))
+}
+
+func (e *configErrors) add(format string, args ...interface{}) {
+	*e = append(*e, fmt.Errorf(format, args...))
+}
+
+func (e configErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// readConfigFile decodes the JSON configuration file at path on top of cfg. Unknown fields are
+// rejected, so that misspelt settings do not silently fall back to their defaults.
+func readConfigFile(path string, cfg *gatewayConfig) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if decoder.More() {
+		return fmt.Errorf("%s: unexpected data after the configuration object", path)
+	}
+	return nil
+}
+
+// envOverrides applies the environment variables that are set on top of cfg. Unlike the file,
+// values that fail to parse are reported rather than ignored.
+func envOverrides(cfg *gatewayConfig, errs *configErrors) {
+	setString := func(name string, field *string) {
+		if value, ok := os.LookupEnv(name); ok && value != "" {
+			*field = value
+		}
+	}
+	setUint := func(name string, field *uint64) {
+		value, ok := os.LookupEnv(name)
+		if !ok || value == "" {
+			return
+		}
+		parsed, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			errs.add("%s: %q is not a non-negative integer", name, value)
+			return
+		}
+		*field = parsed
+	}
+	setBool := func(name string, field *bool) {
+		value, ok := os.LookupEnv(name)
+		if !ok || value == "" {
+			return
+		}
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			errs.add("%s: %q is not a boolean", name, value)
+			return
+		}
+		*field = parsed
+	}
+	setList := func(name string, field *[]string) {
+		if value, ok := os.LookupEnv(name); ok && value != "" {
+			*field = strings.Split(value, ",")
+		}
+	}
+
+	setString(portEnvVariable, &cfg.Port)
+
+	setString(gatewayEndpointEnvVariable, &cfg.Endpoints.Gateway)
+	setString(configEndpointEnvVariable, &cfg.Endpoints.Config)
+	setString(legacyConfigEndpointEnvVariable, &cfg.Endpoints.LegacyConfig)
+	setString(echoEndpointEnvVariable, &cfg.Endpoints.Echo)
+	setString(metadataEndpointEnvVariable, &cfg.Endpoints.Metadata)
+	setString(healthEndpointEnvVariable, &cfg.Endpoints.Health)
+	setString(circuitsEndpointEnvVariable, &cfg.Endpoints.Circuits)
+	setString(readyEndpointEnvVariable, &cfg.Endpoints.Ready)
+	setString(metricsEndpointEnvVariable, &cfg.Endpoints.Metrics)
+
+	setUint(configurationIdEnvironmentVariable, &cfg.Keys.ConfigID)
+	setString(secretSeedEnvironmentVariable, &cfg.Keys.Seed)
+	setString(keyConfigKEMEnvVariable, &cfg.Keys.KEM)
+
+	setList(targetOriginAllowList, &cfg.Policy.AllowedTargetOrigins)
+
+	setString(customRequestEncodingType, &cfg.Content.RequestType)
+	setString(customResponseEncodingType, &cfg.Content.ResponseType)
+	setString(opaqueForwardURLEnvVariable, &cfg.Content.OpaqueForwardURL)
+	setString(opaqueForwardContentTypeEnvVariable, &cfg.Content.OpaqueForwardContentType)
+
+	setUint(upstreamTimeoutEnvVariable, &cfg.Upstream.TimeoutMs)
+	setUint(upstreamRetryMaxAttemptsEnvVariable, &cfg.Upstream.Retry.MaxAttempts)
+	setUint(upstreamRetryBaseDelayEnvVariable, &cfg.Upstream.Retry.BaseDelayMs)
+	setUint(upstreamRetryMaxDelayEnvVariable, &cfg.Upstream.Retry.MaxDelayMs)
+	setUint(upstreamRetryBudgetEnvVariable, &cfg.Upstream.Retry.BudgetPercent)
+	setUint(circuitBreakerFailureRateEnvVariable, &cfg.Upstream.CircuitBreaker.FailureRatePercent)
+	setUint(circuitBreakerWindowEnvVariable, &cfg.Upstream.CircuitBreaker.Window)
+	setUint(circuitBreakerMinRequestsEnvVariable, &cfg.Upstream.CircuitBreaker.MinRequests)
+	setUint(circuitBreakerCoolDownEnvVariable, &cfg.Upstream.CircuitBreaker.CoolDownMs)
+	setUint(circuitBreakerHalfOpenProbesEnvVariable, &cfg.Upstream.CircuitBreaker.HalfOpenProbes)
+	setString(egressProxyEnvVariable, &cfg.Upstream.Proxy.URL)
+	setList(egressProxyBypassEnvVariable, &cfg.Upstream.Proxy.Bypass)
+	setString(egressProxyUsernameEnvVariable, &cfg.Upstream.Proxy.Username)
+	setString(egressProxyPasswordEnvVariable, &cfg.Upstream.Proxy.Password)
+	setUint(responseCacheMaxBytesEnvVariable, &cfg.Upstream.Cache.MaxBytes)
+	setUint(responseCacheMaxEntryBytesEnvVariable, &cfg.Upstream.Cache.MaxEntryBytes)
+
+	setList(metricsBackendEnvVariable, &cfg.Metrics.Backends)
+	setString(monitoringServiceNameEnvironmentVariable, &cfg.Metrics.ServiceName)
+	setString(statsdHostVariable, &cfg.Metrics.StatsDHost)
+	setString(statsdPortVariable, &cfg.Metrics.StatsDPort)
+	setUint(statsdTimeoutVariable, &cfg.Metrics.StatsDTimeoutMs)
+
+	setString(certificateEnvironmentVariable, &cfg.TLS.CertFile)
+	setString(keyEnvironmentVariable, &cfg.TLS.KeyFile)
+	if value := os.Getenv(tlsCertificatesEnvVariable); value != "" {
+		cfg.TLS.Certificates = nil
+		for _, entry := range strings.Split(value, ",") {
+			files := strings.Split(entry, ":")
+			if len(files) != 2 || files[0] == "" || files[1] == "" {
+				errs.add("%s: %q is not a cert-file:key-file pair", tlsCertificatesEnvVariable, entry)
+				continue
+			}
+			cfg.TLS.Certificates = append(cfg.TLS.Certificates, CertificatePair{CertFile: files[0], KeyFile: files[1]})
+		}
+	}
+	setString(tlsMinVersionEnvVariable, &cfg.TLS.MinVersion)
+	setList(tlsCipherSuitesEnvVariable, &cfg.TLS.CipherSuites)
+	setUint(tlsReloadIntervalEnvVariable, &cfg.TLS.ReloadIntervalMs)
+
+	setUint(serverReadHeaderTimeoutEnvVariable, &cfg.Server.ReadHeaderTimeoutMs)
+	setUint(serverReadTimeoutEnvVariable, &cfg.Server.ReadTimeoutMs)
+	setUint(serverWriteTimeoutEnvVariable, &cfg.Server.WriteTimeoutMs)
+	setUint(serverIdleTimeoutEnvVariable, &cfg.Server.IdleTimeoutMs)
+	setUint(shutdownDrainPeriodEnvVariable, &cfg.Server.DrainPeriodMs)
+	setUint(shutdownTimeoutEnvVariable, &cfg.Server.ShutdownTimeoutMs)
+	setString(opsAddressEnvVariable, &cfg.Server.OpsAddress)
+	setBool(publicIndexEnvVariable, &cfg.Server.PublicIndex)
+	setUint(selfTestIntervalEnvVariable, &cfg.Server.SelfTestIntervalMs)
+	setList(selfTestProbeOriginsEnvVariable, &cfg.Server.SelfTestProbeOrigins)
+
+	setList(relayCAFilesEnvVariable, &cfg.Relay.CAFiles)
+	setList(relayAllowedIdentitiesEnvVariable, &cfg.Relay.AllowedIdentities)
+	if value := os.Getenv(relayHMACKeysEnvVariable); value != "" {
+		cfg.Relay.HMACKeys = make(map[string]string)
+		for _, entry := range strings.Split(value, ",") {
+			keyID, secret, ok := strings.Cut(entry, ":")
+			if !ok || keyID == "" {
+				errs.add("%s: entries must be key-id:hex-secret pairs", relayHMACKeysEnvVariable)
+				continue
+			}
+			cfg.Relay.HMACKeys[keyID] = secret
+		}
+	}
+	setUint(relayHMACMaxSkewEnvVariable, &cfg.Relay.HMACMaxSkewMs)
+
+	setString(logLevelEnvVariable, &cfg.Log.Level)
+	setString(logFormatEnvVariable, &cfg.Log.Format)
+
+	setBool(gatewayDebugEnvironmentVariable, &cfg.Debug.DebugResponses)
+	setBool(gatewayVerboseEnvironmentVariable, &cfg.Debug.Verbose)
+	setBool(unredactedLogsEnvVariable, &cfg.Debug.UnredactedLogs)
+	var logSecrets bool
+	setBool(logSecretsEnvironmentVariable, &logSecrets)
+	if logSecrets {
+		// Refuse to start rather than silently stop logging the seed, or log more than before.
+		// Disabling it is what the gateway does anyway, so that is still accepted.
+		errs.add("%s: no longer supported, set %s to log secrets and other private data", logSecretsEnvironmentVariable, unredactedLogsEnvVariable)
+	}
+	setBool(devModeEnvVariable, &cfg.Debug.DevMode)
+	setString(captureFileEnvVariable, &cfg.Debug.CaptureFile)
+	setList(captureRedactEnvVariable, &cfg.Debug.CaptureRedact)
+}
+
+func validatePort(name, port string, errs *configErrors) {
+	if value, err := strconv.ParseUint(port, 10, 16); err != nil || value == 0 {
+		errs.add("%s: %q is not a valid port", name, port)
+	}
+}
+
+func validateHTTPURL(name, rawURL string, errs *configErrors) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		errs.add("%s: %q is not an http or https URL", name, rawURL)
+	}
+}
+
+func validateFile(name, path string, errs *configErrors) {
+	if info, err := os.Stat(path); err != nil {
+		errs.add("%s: %s", name, err)
+	} else if info.IsDir() {
+		errs.add("%s: %s is a directory", name, path)
+	}
+}
+
+// validate checks the configuration as a whole and returns every problem found.
+func (c gatewayConfig) validate() error {
+	var errs configErrors
+
+	validatePort("port", c.Port, &errs)
+
+	endpoints := map[string]string{
+		"endpoints.gateway":       c.Endpoints.Gateway,
+		"endpoints.config":        c.Endpoints.Config,
+		"endpoints.legacy_config": c.Endpoints.LegacyConfig,
+		"endpoints.echo":          c.Endpoints.Echo,
+		"endpoints.metadata":      c.Endpoints.Metadata,
+		"endpoints.health":        c.Endpoints.Health,
+		"endpoints.circuits":      c.Endpoints.Circuits,
+		"endpoints.ready":         c.Endpoints.Ready,
+		"endpoints.metrics":       c.Endpoints.Metrics,
+	}
+	seenEndpoints := map[string]string{}
+	for _, name := range sortedKeys(endpoints) {
+		path := endpoints[name]
+		if !strings.HasPrefix(path, "/") || path == "/" {
+			errs.add("%s: %q must be a path starting with / other than /", name, path)
+			continue
+		}
+		if other, ok := seenEndpoints[path]; ok {
+			errs.add("%s: %q is also used by %s", name, path, other)
+		}
+		seenEndpoints[path] = name
+	}
+
+	if c.Keys.ConfigID > 255 {
+		errs.add("keys.config_id: %d is not a valid key ID (0-255)", c.Keys.ConfigID)
+	}
+	if c.Keys.Seed != "" {
+		if seed, err := hex.DecodeString(c.Keys.Seed); err != nil {
+			errs.add("keys.seed: not a hex string")
+		} else if len(seed) != defaultSeedLength {
+			errs.add("keys.seed: must be %d bytes, got %d", defaultSeedLength, len(seed))
+		}
+	}
+
+	if _, ok := keyConfigKEMs[c.Keys.KEM]; !ok {
+		errs.add("keys.kem: %q is not one of %s", c.Keys.KEM, strings.Join(keyConfigKEMNames(), ", "))
+	}
+
+	for _, origin := range c.Policy.AllowedTargetOrigins {
+		if origin == "" || strings.ContainsAny(origin, "/ ") {
+			errs.add("policy.allowed_target_origins: %q is not a host", origin)
+		}
+	}
+
+	if (c.Content.RequestType == "") != (c.Content.ResponseType == "") {
+		errs.add("content: request_type and response_type must be set together")
+	} else if c.Content.RequestType != "" && c.Content.RequestType == c.Content.ResponseType {
+		errs.add("content: request_type and response_type must differ")
+	} else if c.customContent() && !c.protoHTTPContent() {
+		if c.Content.OpaqueForwardURL == "" {
+			errs.add("content: custom type %q requires opaque_forward_url", c.Content.RequestType)
+		} else {
+			validateHTTPURL("content.opaque_forward_url", c.Content.OpaqueForwardURL, &errs)
+		}
+	} else if c.Content.OpaqueForwardURL != "" {
+		errs.add("content.opaque_forward_url: only used with custom content types other than protohttp")
+	}
+
+	retry := c.Upstream.Retry
+	if retry.MaxAttempts < 1 {
+		errs.add("upstream.retry.max_attempts: must be at least 1")
+	}
+	if retry.MaxDelayMs < retry.BaseDelayMs {
+		errs.add("upstream.retry.max_delay_ms: must not be less than base_delay_ms")
+	}
+	if retry.BudgetPercent > 100 {
+		errs.add("upstream.retry.budget_percent: must be at most 100")
+	}
+
+	breaker := c.Upstream.CircuitBreaker
+	if breaker.FailureRatePercent > 100 {
+		errs.add("upstream.circuit_breaker.failure_rate_percent: must be at most 100")
+	}
+	if breaker.FailureRatePercent > 0 {
+		if breaker.Window < 1 {
+			errs.add("upstream.circuit_breaker.window: must be at least 1")
+		}
+		if breaker.MinRequests > breaker.Window {
+			errs.add("upstream.circuit_breaker.min_requests: must not exceed window")
+		}
+		if breaker.HalfOpenProbes < 1 {
+			errs.add("upstream.circuit_breaker.half_open_probes: must be at least 1")
+		}
+	}
+
+	if c.Upstream.Proxy.URL != "" {
+		if _, err := gateway.NewEgressProxy(c.Upstream.Proxy.URL, c.Upstream.Proxy.Bypass); err != nil {
+			errs.add("upstream.proxy.url: %s", err)
+		}
+	} else if c.Upstream.Proxy.Username != "" || len(c.Upstream.Proxy.Bypass) > 0 {
+		errs.add("upstream.proxy: username and bypass require url")
+	}
+
+	if c.Upstream.Cache.MaxBytes > 0 && c.Upstream.Cache.MaxEntryBytes > c.Upstream.Cache.MaxBytes {
+		errs.add("upstream.cache.max_entry_bytes: must not exceed max_bytes")
+	}
+
+	if len(c.Metrics.Backends) == 0 {
+		errs.add("metrics.backends: must not be empty")
+	}
+	seenBackends := map[string]bool{}
+	for _, backend := range c.Metrics.Backends {
+		switch {
+		case backend != metricsBackendStatsD && backend != metricsBackendPrometheus && backend != metricsBackendLog:
+			errs.add("metrics.backends: %q is not one of %s, %s, %s", backend, metricsBackendLog, metricsBackendPrometheus, metricsBackendStatsD)
+		case seenBackends[backend]:
+			errs.add("metrics.backends: %q is listed twice", backend)
+		}
+		seenBackends[backend] = true
+	}
+	if c.Metrics.ServiceName == "" {
+		errs.add("metrics.service_name: must not be empty")
+	}
+	if (c.Metrics.StatsDHost == "") != (c.Metrics.StatsDPort == "") {
+		errs.add("metrics: statsd_host and statsd_port must be set together")
+	} else if c.Metrics.StatsDPort != "" {
+		validatePort("metrics.statsd_port", c.Metrics.StatsDPort, &errs)
+	}
+
+	if c.TLS.KeyFile != "" {
+		validateFile("tls.cert_file", c.TLS.CertFile, &errs)
+		validateFile("tls.key_file", c.TLS.KeyFile, &errs)
+	}
+	for i, pair := range c.TLS.Certificates {
+		validateFile(fmt.Sprintf("tls.certificates[%d].cert_file", i), pair.CertFile, &errs)
+		validateFile(fmt.Sprintf("tls.certificates[%d].key_file", i), pair.KeyFile, &errs)
+	}
+	if _, ok := tlsVersions[c.TLS.MinVersion]; !ok {
+		errs.add("tls.min_version: %q is not one of %s", c.TLS.MinVersion, strings.Join(tlsVersionNames(), ", "))
+	}
+	for _, name := range c.TLS.CipherSuites {
+		if _, ok := tlsCipherSuite(name); !ok {
+			errs.add("tls.cipher_suites: %q is not a supported cipher suite", name)
+		}
+	}
+
+	for i, file := range c.Relay.CAFiles {
+		validateFile(fmt.Sprintf("relay.ca_files[%d]", i), file, &errs)
+	}
+	if len(c.Relay.CAFiles) > 0 && len(c.TLS.certificatePairs()) == 0 {
+		errs.add("relay.ca_files: mutual TLS requires a TLS certificate")
+	}
+	if len(c.Relay.AllowedIdentities) > 0 && len(c.Relay.CAFiles) == 0 {
+		errs.add("relay.allowed_identities: requires ca_files")
+	}
+	for _, keyID := range sortedKeys(c.Relay.HMACKeys) {
+		if secret, err := hex.DecodeString(c.Relay.HMACKeys[keyID]); err != nil {
+			errs.add("relay.hmac_keys.%s: not a hex string", keyID)
+		} else if len(secret) < minRelayHMACKeyLength {
+			errs.add("relay.hmac_keys.%s: must be at least %d bytes, got %d", keyID, minRelayHMACKeyLength, len(secret))
+		}
+	}
+	if len(c.Relay.HMACKeys) > 0 && c.Relay.HMACMaxSkewMs == 0 {
+		errs.add("relay.hmac_max_skew_ms: must be positive")
+	}
+
+	if c.Server.ReadHeaderTimeoutMs == 0 {
+		errs.add("server.read_header_timeout_ms: must be positive")
+	}
+	if c.Server.SelfTestIntervalMs == 0 {
+		errs.add("server.self_test_interval_ms: must be positive")
+	}
+	for _, origin := range c.Server.SelfTestProbeOrigins {
+		if origin == "" || strings.ContainsAny(origin, "/ ") {
+			errs.add("server.self_test_probe_origins: %q is not a host", origin)
+		}
+	}
+	if _, opsPort, err := net.SplitHostPort(c.Server.OpsAddress); err != nil {
+		errs.add("server.ops_address: %q is not a host:port address", c.Server.OpsAddress)
+	} else if opsPort == c.Port {
+		errs.add("server.ops_address: port %s is also used by the public listener", opsPort)
+	} else {
+		validatePort("server.ops_address", opsPort, &errs)
+	}
+
+	if _, ok := logLevels[c.Log.Level]; !ok {
+		errs.add("log.level: %q is not one of debug, info, warn, error", c.Log.Level)
+	}
+	if c.Log.Format != logFormatText && c.Log.Format != logFormatJSON {
+		errs.add("log.format: %q is not one of %s, %s", c.Log.Format, logFormatText, logFormatJSON)
+	}
+
+	if c.Debug.CaptureFile != "" && !c.Debug.DevMode {
+		errs.add("debug.capture_file: captures hold private data of clients and require dev_mode")
+	}
+
+	return errs.err()
+}
+
+func (c gatewayConfig) customContent() bool {
+	return c.Content.RequestType != "" && c.Content.ResponseType != "" && c.Content.RequestType != c.Content.ResponseType
+}
+
+func (c gatewayConfig) protoHTTPContent() bool {
+	return c.Content.RequestType == gateway.ProtoHTTPRequestType && c.Content.ResponseType == gateway.ProtoHTTPResponseType ||
+		c.Content.RequestType == gateway.ProtoHTTPV2RequestType && c.Content.ResponseType == gateway.ProtoHTTPV2ResponseType
+}
+
+// newGateway creates a gateway for the given key configurations using the configured content
+// types to label encapsulated messages.
+func (c gatewayConfig) newGateway(configs ...ohttp.PrivateConfig) ohttp.Gateway {
+	if c.customContent() {
+		return ohttp.NewCustomGateway(configs, c.Content.RequestType, c.Content.ResponseType)
+	}
+	return ohttp.NewDefaultGateway(configs)
+}
+
+// redacted returns a copy of the configuration that is safe to print.
+func (c gatewayConfig) redacted() gatewayConfig {
+	if c.Keys.Seed != "" {
+		c.Keys.Seed = redactedValue
+	}
+	if len(c.Relay.HMACKeys) > 0 {
+		keys := make(map[string]string)
+		for keyID := range c.Relay.HMACKeys {
+			keys[keyID] = redactedValue
+		}
+		c.Relay.HMACKeys = keys
+	}
+	if c.Upstream.Proxy.Password != "" {
+		c.Upstream.Proxy.Password = redactedValue
+	}
+	if proxyURL, err := url.Parse(c.Upstream.Proxy.URL); err == nil {
+		c.Upstream.Proxy.URL = proxyURL.Redacted()
+	}
+	return c
+}
+
+// loadConfig builds the effective configuration from the defaults, the JSON file at path (if
+// any) and the environment, and validates it.
+func loadConfig(path string) (gatewayConfig, error) {
+	cfg := defaultGatewayConfig()
+	var errs configErrors
+	if path != "" {
+		// The environment is still checked when the file is invalid, so that every error is
+		// reported at once
+		if err := readConfigFile(path, &cfg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	envOverrides(&cfg, &errs)
+	cfg.Debug.CaptureRedact = withDefaultCaptureRedact(cfg.Debug.CaptureRedact)
+	if err := cfg.validate(); err != nil {
+		errs = append(errs, err.(configErrors)...)
+	}
+	return cfg, errs.err()
+}
+
+// withDefaultCaptureRedact adds the headers of defaultCaptureRedact missing from fields, so that
+// redacting more fields never stops credentials of clients from being redacted.
+func withDefaultCaptureRedact(fields []string) []string {
+	merged := append([]string(nil), fields...)
+	for _, header := range defaultCaptureRedact {
+		found := false
+		for _, field := range fields {
+			if strings.EqualFold(strings.TrimSpace(field), header) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, header)
+		}
+	}
+	return merged
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,516 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gateway
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Metrics constants
+	metricsResultCacheHit         = "cache_hit"
+	metricsResultCacheMiss        = "cache_miss"
+	metricsResultCacheRevalidated = "cache_revalidated"
+	metricsResultCacheBypass      = "cache_bypass"
+)
+
+// Request headers that carry credentials. Requests with any of them are never served from
+// or stored in the cache.
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// Request headers that make a request conditional or partial. Such requests are passed
+// through, as the cache only deals in complete responses.
+var conditionalHeaders = []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range", "Range"}
+
+// Status codes whose responses a cache may store (RFC 9110, Section 15.1).
+var cacheableStatusCodes = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// cacheControl holds the parsed directives of a Cache-Control header.
+type cacheControl map[string]string
+
+func parseCacheControl(header http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, line := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(line, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, value := directive, ""
+			if i := strings.IndexByte(directive, '='); i >= 0 {
+				name, value = directive[:i], strings.Trim(strings.TrimSpace(directive[i+1:]), `"`)
+			}
+			cc[strings.ToLower(strings.TrimSpace(name))] = value
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	value, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// cacheEntry is a stored response, along with what is needed to compute its age.
+type cacheEntry struct {
+	primaryKey   string
+	key          string
+	statusCode   int
+	header       http.Header
+	body         []byte
+	requestTime  time.Time
+	responseTime time.Time
+	lifetime     time.Duration
+	noCache      bool
+}
+
+func (e *cacheEntry) size() int64 {
+	size := int64(len(e.key) + len(e.body))
+	for name, values := range e.header {
+		for _, value := range values {
+			size += int64(len(name) + len(value))
+		}
+	}
+	return size
+}
+
+// age computes the current age of the entry (RFC 9111, Section 4.2.3).
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	apparentAge := time.Duration(0)
+	if date, err := http.ParseTime(e.header.Get("Date")); err == nil && e.responseTime.After(date) {
+		apparentAge = e.responseTime.Sub(date)
+	}
+	correctedAge := e.responseTime.Sub(e.requestTime)
+	if ageValue, err := strconv.ParseUint(e.header.Get("Age"), 10, 32); err == nil {
+		correctedAge += time.Duration(ageValue) * time.Second
+	}
+	if apparentAge > correctedAge {
+		correctedAge = apparentAge
+	}
+	return correctedAge + now.Sub(e.responseTime)
+}
+
+func (e *cacheEntry) hasValidator() bool {
+	return e.header.Get("ETag") != "" || e.header.Get("Last-Modified") != ""
+}
+
+func (e *cacheEntry) response(req *http.Request, now time.Time) *http.Response {
+	header := e.header.Clone()
+	header.Set("Age", strconv.Itoa(int(e.age(now)/time.Second)))
+
+	var body io.ReadCloser = http.NoBody
+	if req.Method != http.MethodHead {
+		body = io.NopCloser(bytes.NewReader(e.body))
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(e.statusCode) + " " + http.StatusText(e.statusCode),
+		StatusCode:    e.statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          body,
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
+
+// freshnessLifetime computes how long a response stays fresh in a shared cache (RFC 9111,
+// Section 4.2.1). No heuristic freshness is applied: without explicit freshness
+// information, a response is stale as soon as it is stored.
+func freshnessLifetime(header http.Header, cc cacheControl) time.Duration {
+	if lifetime, ok := cc.seconds("s-maxage"); ok {
+		return lifetime
+	}
+	if lifetime, ok := cc.seconds("max-age"); ok {
+		return lifetime
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			return 0
+		}
+		if lifetime := expiresAt.Sub(date); lifetime > 0 {
+			return lifetime
+		}
+	}
+	return 0
+}
+
+// ResponseCache is a size-bounded, least-recently-used store of target responses that
+// follows the rules for shared caches in RFC 9111.
+type ResponseCache struct {
+	mu            sync.Mutex
+	maxBytes      int64
+	maxEntryBytes int64
+	usedBytes     int64
+	entries       map[string]*list.Element
+	lru           *list.List
+	vary          map[string][]string // header names each resource varies on
+	variants      map[string]int      // number of stored responses for each resource
+	now           func() time.Time
+}
+
+// NewResponseCache creates a ResponseCache holding at most maxBytes of responses, none of
+// which is larger than maxEntryBytes.
+func NewResponseCache(maxBytes, maxEntryBytes int64) *ResponseCache {
+	if maxEntryBytes > maxBytes {
+		maxEntryBytes = maxBytes
+	}
+	return &ResponseCache{
+		maxBytes:      maxBytes,
+		maxEntryBytes: maxEntryBytes,
+		entries:       make(map[string]*list.Element),
+		lru:           list.New(),
+		vary:          make(map[string][]string),
+		variants:      make(map[string]int),
+		now:           time.Now,
+	}
+}
+
+// The primary cache key is the target URI. HEAD requests are answered from stored GET
+// responses, and only GET responses are stored.
+func primaryCacheKey(req *http.Request) string {
+	return req.URL.String()
+}
+
+func secondaryCacheKey(primaryKey string, varyNames []string, req *http.Request) string {
+	if len(varyNames) == 0 {
+		return primaryKey
+	}
+	var key strings.Builder
+	key.WriteString(primaryKey)
+	for _, name := range varyNames {
+		key.WriteString("\x00")
+		key.WriteString(name)
+		key.WriteString("=")
+		key.WriteString(strings.Join(req.Header.Values(name), ","))
+	}
+	return key.String()
+}
+
+// parseVary returns the normalised field names listed in the Vary header, and whether the
+// response varies on everything ("*").
+func parseVary(header http.Header) ([]string, bool) {
+	names := []string{}
+	for _, line := range header.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil, true
+			}
+			if name != "" {
+				names = append(names, textproto.CanonicalMIMEHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, false
+}
+
+func (c *ResponseCache) lookup(req *http.Request) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	primaryKey := primaryCacheKey(req)
+	element, ok := c.entries[secondaryCacheKey(primaryKey, c.vary[primaryKey], req)]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(element)
+	return element.Value.(*cacheEntry)
+}
+
+func (c *ResponseCache) removeElement(element *list.Element) {
+	entry := element.Value.(*cacheEntry)
+	c.lru.Remove(element)
+	delete(c.entries, entry.key)
+	c.usedBytes -= entry.size()
+	if c.variants[entry.primaryKey]--; c.variants[entry.primaryKey] <= 0 {
+		delete(c.variants, entry.primaryKey)
+		delete(c.vary, entry.primaryKey)
+	}
+}
+
+func (c *ResponseCache) store(req *http.Request, entry *cacheEntry, varyNames []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry.primaryKey = primaryCacheKey(req)
+	entry.key = secondaryCacheKey(entry.primaryKey, varyNames, req)
+	if element, ok := c.entries[entry.key]; ok {
+		c.removeElement(element)
+	}
+
+	size := entry.size()
+	if size > c.maxEntryBytes {
+		return
+	}
+	for c.usedBytes+size > c.maxBytes {
+		oldest := c.lru.Back()
+		if oldest == nil {
+			break
+		}
+		c.removeElement(oldest)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.usedBytes += size
+	c.vary[entry.primaryKey] = varyNames
+	c.variants[entry.primaryKey]++
+}
+
+// invalidate removes every stored response for the target of req (RFC 9111, Section 4.4).
+func (c *ResponseCache) invalidate(req *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	primaryKey := primaryCacheKey(req)
+	if c.variants[primaryKey] == 0 {
+		return
+	}
+	for element := c.lru.Front(); element != nil; {
+		next := element.Next()
+		if element.Value.(*cacheEntry).primaryKey == primaryKey {
+			c.removeElement(element)
+		}
+		element = next
+	}
+}
+
+// CachingHttpRequestHandler is a HttpRequestHandler that answers GET and HEAD requests from
+// a shared ResponseCache where possible, and otherwise passes requests to another handler.
+type CachingHttpRequestHandler struct {
+	httpHandler HttpRequestHandler
+	cache       *ResponseCache
+}
+
+func isCacheableRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	for _, name := range credentialHeaders {
+		if req.Header.Get(name) != "" {
+			return false
+		}
+	}
+	for _, name := range conditionalHeaders {
+		if req.Header.Get(name) != "" {
+			return false
+		}
+	}
+	return !parseCacheControl(req.Header).has("no-store")
+}
+
+func isUnsafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return false
+	default:
+		return true
+	}
+}
+
+// newCacheEntry returns an entry for resp if it may be stored in a shared cache.
+func newCacheEntry(req *http.Request, resp *http.Response, requestTime, responseTime time.Time) (*cacheEntry, []string, bool) {
+	if req.Method != http.MethodGet || !cacheableStatusCodes[resp.StatusCode] {
+		return nil, nil, false
+	}
+	// Responses that set cookies are specific to a client, whatever their Cache-Control says
+	if resp.Header.Get("Set-Cookie") != "" {
+		return nil, nil, false
+	}
+	cc := parseCacheControl(resp.Header)
+	if cc.has("no-store") || cc.has("private") {
+		return nil, nil, false
+	}
+	varyNames, varyAll := parseVary(resp.Header)
+	if varyAll {
+		return nil, nil, false
+	}
+
+	entry := &cacheEntry{
+		statusCode:   resp.StatusCode,
+		header:       resp.Header.Clone(),
+		requestTime:  requestTime,
+		responseTime: responseTime,
+		lifetime:     freshnessLifetime(resp.Header, cc),
+		noCache:      cc.has("no-cache"),
+	}
+	if entry.lifetime <= 0 && !entry.hasValidator() {
+		return nil, nil, false
+	}
+	return entry, varyNames, true
+}
+
+// readBody reads up to limit bytes of the response body. If the body is longer, or cannot be
+// read, the response body is replaced so that the caller still sees it in full.
+func readBody(resp *http.Response, limit int64) ([]byte, bool) {
+	if resp.Body == nil {
+		return nil, true
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil || int64(len(body)) > limit {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil, false
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return body, true
+}
+
+func (h CachingHttpRequestHandler) fetchAndStore(req *http.Request, metrics Metrics) (*http.Response, error) {
+	requestTime := h.cache.now()
+	resp, err := h.httpHandler.Handle(req, metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, varyNames, ok := newCacheEntry(req, resp, requestTime, h.cache.now())
+	if !ok {
+		return resp, nil
+	}
+	body, ok := readBody(resp, h.cache.maxEntryBytes)
+	if !ok {
+		return resp, nil
+	}
+	entry.body = body
+	h.cache.store(req, entry, varyNames)
+	return resp, nil
+}
+
+// revalidate sends a conditional request for a stale entry. If the target confirms that the
+// entry is still valid, the entry is refreshed and served.
+func (h CachingHttpRequestHandler) revalidate(req *http.Request, entry *cacheEntry, metrics Metrics) (*http.Response, error) {
+	conditionalReq := req.Clone(req.Context())
+	if etag := entry.header.Get("ETag"); etag != "" {
+		conditionalReq.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := entry.header.Get("Last-Modified"); lastModified != "" {
+		conditionalReq.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	requestTime := h.cache.now()
+	resp, err := h.httpHandler.Handle(conditionalReq, metrics)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusNotModified {
+		metrics.Fire(metricsResultCacheMiss)
+		h.cache.invalidate(req)
+		newEntry, varyNames, ok := newCacheEntry(req, resp, requestTime, h.cache.now())
+		if !ok {
+			return resp, nil
+		}
+		if body, ok := readBody(resp, h.cache.maxEntryBytes); ok {
+			newEntry.body = body
+			h.cache.store(req, newEntry, varyNames)
+		}
+		return resp, nil
+	}
+	discardResponse(resp)
+
+	// Update the stored response with the header fields of the 304 (RFC 9111, Section 4.3.4)
+	refreshed := *entry
+	refreshed.header = entry.header.Clone()
+	for name, values := range resp.Header {
+		if name == "Content-Length" {
+			continue
+		}
+		refreshed.header[name] = values
+	}
+	cc := parseCacheControl(refreshed.header)
+	refreshed.lifetime = freshnessLifetime(refreshed.header, cc)
+	refreshed.noCache = cc.has("no-cache")
+	refreshed.requestTime = requestTime
+	refreshed.responseTime = h.cache.now()
+	varyNames, _ := parseVary(refreshed.header)
+	h.cache.store(req, &refreshed, varyNames)
+
+	metrics.Fire(metricsResultCacheRevalidated)
+	return refreshed.response(req, h.cache.now()), nil
+}
+
+// Handle serves the request from the cache if a fresh response is stored, revalidates a stale
+// response if it has validators, and otherwise fetches the response and stores it if allowed.
+func (h CachingHttpRequestHandler) Handle(req *http.Request, metrics Metrics) (*http.Response, error) {
+	if !isCacheableRequest(req) {
+		metrics.Fire(metricsResultCacheBypass)
+		resp, err := h.httpHandler.Handle(req, metrics)
+		if err == nil && isUnsafeMethod(req.Method) && resp.StatusCode < http.StatusBadRequest {
+			h.cache.invalidate(req)
+		}
+		return resp, err
+	}
+
+	entry := h.cache.lookup(req)
+	if entry == nil {
+		metrics.Fire(metricsResultCacheMiss)
+		if req.Method == http.MethodHead {
+			return h.httpHandler.Handle(req, metrics)
+		}
+		return h.fetchAndStore(req, metrics)
+	}
+
+	requestCC := parseCacheControl(req.Header)
+	forceRevalidation := entry.noCache || requestCC.has("no-cache") || req.Header.Get("Pragma") == "no-cache"
+	if maxAge, ok := requestCC.seconds("max-age"); ok && entry.age(h.cache.now()) > maxAge {
+		forceRevalidation = true
+	}
+
+	now := h.cache.now()
+	if !forceRevalidation && entry.age(now) < entry.lifetime {
+		metrics.Fire(metricsResultCacheHit)
+		metrics.Fire(metricsResultSuccess)
+		return entry.response(req, now), nil
+	}
+	if entry.hasValidator() && req.Method == http.MethodGet {
+		return h.revalidate(req, entry, metrics)
+	}
+
+	metrics.Fire(metricsResultCacheMiss)
+	if req.Method == http.MethodHead {
+		return h.httpHandler.Handle(req, metrics)
+	}
+	return h.fetchAndStore(req, metrics)
+}
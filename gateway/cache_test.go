@@ -0,0 +1,199 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gateway
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// StaticHttpRequestHandler is a HttpRequestHandler that answers every request with a fixed
+// response, or with 304 (Not Modified) to a request whose If-None-Match matches its ETag.
+type StaticHttpRequestHandler struct {
+	header   http.Header
+	body     []byte
+	requests []*http.Request
+}
+
+func (h *StaticHttpRequestHandler) Handle(req *http.Request, metrics Metrics) (*http.Response, error) {
+	h.requests = append(h.requests, req)
+	metrics.Fire(metricsResultSuccess)
+
+	status := http.StatusOK
+	body := h.body
+	if etag := h.header.Get("ETag"); etag != "" && req.Header.Get("If-None-Match") == etag {
+		status = http.StatusNotModified
+		body = nil
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     h.header.Clone(),
+		Body:       io.NopCloser(bytes.NewReader(body)),
+	}, nil
+}
+
+func createCachingHandler(header http.Header, maxBytes int64) (CachingHttpRequestHandler, *StaticHttpRequestHandler, *fakeClock) {
+	origin := &StaticHttpRequestHandler{
+		header: header,
+		body:   []byte("cacheable content"),
+	}
+	clock := &fakeClock{now: time.Now()}
+	cache := NewResponseCache(maxBytes, maxBytes)
+	cache.now = clock.Now
+	return CachingHttpRequestHandler{
+		httpHandler: origin,
+		cache:       cache,
+	}, origin, clock
+}
+
+func fetchCached(t *testing.T, handler HttpRequestHandler, method, url string, header http.Header) (*http.Response, *MockMetrics) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	metrics := &MockMetrics{resultLabels: map[string]bool{}}
+	resp, err := handler.Handle(req, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, metrics
+}
+
+func expectCacheResult(t *testing.T, metrics *MockMetrics, result string) {
+	t.Helper()
+	if !metrics.resultLabels[result] {
+		t.Fatalf("Expected metrics result %s, got %v", result, metrics.resultLabels)
+	}
+}
+
+func TestResponseCacheHit(t *testing.T) {
+	handler, origin, clock := createCachingHandler(http.Header{"Cache-Control": {"max-age=60"}}, 1<<20)
+	url := "https://" + ALLOWED_TARGET + "/config.json"
+
+	_, metrics := fetchCached(t, handler, http.MethodGet, url, nil)
+	expectCacheResult(t, metrics, metricsResultCacheMiss)
+
+	clock.now = clock.now.Add(30 * time.Second)
+	resp, metrics := fetchCached(t, handler, http.MethodGet, url, nil)
+	expectCacheResult(t, metrics, metricsResultCacheHit)
+	expectBody(t, resp, "cacheable content")
+	if age := resp.Header.Get("Age"); age != "30" {
+		t.Fatalf("Expected Age 30, got %q", age)
+	}
+
+	resp, metrics = fetchCached(t, handler, http.MethodHead, url, nil)
+	expectCacheResult(t, metrics, metricsResultCacheHit)
+	expectBody(t, resp, "")
+
+	clock.now = clock.now.Add(time.Minute)
+	_, metrics = fetchCached(t, handler, http.MethodGet, url, nil)
+	expectCacheResult(t, metrics, metricsResultCacheMiss)
+
+	if len(origin.requests) != 2 {
+		t.Fatalf("Expected 2 origin fetches, got %d", len(origin.requests))
+	}
+}
+
+func TestResponseCacheUncacheableResponses(t *testing.T) {
+	for _, header := range []http.Header{
+		{"Cache-Control": {"private, max-age=60"}},
+		{"Cache-Control": {"no-store"}},
+		{"Cache-Control": {"max-age=60"}, "Vary": {"*"}},
+		{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"session=1"}},
+		{},
+	} {
+		handler, origin, _ := createCachingHandler(header, 1<<20)
+		url := "https://" + ALLOWED_TARGET + "/"
+		fetchCached(t, handler, http.MethodGet, url, nil)
+		fetchCached(t, handler, http.MethodGet, url, nil)
+		if len(origin.requests) != 2 {
+			t.Fatalf("Expected response with header %v not to be cached", header)
+		}
+	}
+}
+
+func TestResponseCacheBypassesCredentials(t *testing.T) {
+	handler, origin, _ := createCachingHandler(http.Header{"Cache-Control": {"public, max-age=60"}}, 1<<20)
+	url := "https://" + ALLOWED_TARGET + "/"
+
+	credentials := http.Header{"Authorization": {"Bearer secret"}}
+	_, metrics := fetchCached(t, handler, http.MethodGet, url, credentials)
+	expectCacheResult(t, metrics, metricsResultCacheBypass)
+	_, metrics = fetchCached(t, handler, http.MethodGet, url, nil)
+	expectCacheResult(t, metrics, metricsResultCacheMiss)
+	_, metrics = fetchCached(t, handler, http.MethodGet, url, credentials)
+	expectCacheResult(t, metrics, metricsResultCacheBypass)
+
+	if len(origin.requests) != 3 {
+		t.Fatalf("Expected 3 origin fetches, got %d", len(origin.requests))
+	}
+}
+
+func TestResponseCacheVary(t *testing.T) {
+	handler, origin, _ := createCachingHandler(http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"accept-language"}}, 1<<20)
+	url := "https://" + ALLOWED_TARGET + "/"
+
+	english := http.Header{"Accept-Language": {"en"}}
+	french := http.Header{"Accept-Language": {"fr"}}
+	fetchCached(t, handler, http.MethodGet, url, english)
+	_, metrics := fetchCached(t, handler, http.MethodGet, url, french)
+	expectCacheResult(t, metrics, metricsResultCacheMiss)
+	_, metrics = fetchCached(t, handler, http.MethodGet, url, english)
+	expectCacheResult(t, metrics, metricsResultCacheHit)
+	_, metrics = fetchCached(t, handler, http.MethodGet, url, french)
+	expectCacheResult(t, metrics, metricsResultCacheHit)
+
+	if len(origin.requests) != 2 {
+		t.Fatalf("Expected 2 origin fetches, got %d", len(origin.requests))
+	}
+}
+
+func TestResponseCacheRevalidation(t *testing.T) {
+	handler, origin, clock := createCachingHandler(http.Header{"Cache-Control": {"max-age=10"}, "Etag": {`"v1"`}}, 1<<20)
+	url := "https://" + ALLOWED_TARGET + "/"
+
+	fetchCached(t, handler, http.MethodGet, url, nil)
+	clock.now = clock.now.Add(time.Minute)
+
+	resp, metrics := fetchCached(t, handler, http.MethodGet, url, nil)
+	expectCacheResult(t, metrics, metricsResultCacheRevalidated)
+	expectBody(t, resp, "cacheable content")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if got := origin.requests[1].Header.Get("If-None-Match"); got != `"v1"` {
+		t.Fatalf("Expected conditional request with If-None-Match, got %q", got)
+	}
+
+	_, metrics = fetchCached(t, handler, http.MethodGet, url, nil)
+	expectCacheResult(t, metrics, metricsResultCacheHit)
+	if len(origin.requests) != 2 {
+		t.Fatalf("Expected 2 origin fetches, got %d", len(origin.requests))
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	handler, origin, _ := createCachingHandler(http.Header{"Cache-Control": {"max-age=60"}}, 100)
+
+	first := "https://" + ALLOWED_TARGET + "/first"
+	second := "https://" + ALLOWED_TARGET + "/second"
+	fetchCached(t, handler, http.MethodGet, first, nil)
+	fetchCached(t, handler, http.MethodGet, second, nil)
+	_, metrics := fetchCached(t, handler, http.MethodGet, second, nil)
+	expectCacheResult(t, metrics, metricsResultCacheHit)
+	_, metrics = fetchCached(t, handler, http.MethodGet, first, nil)
+	expectCacheResult(t, metrics, metricsResultCacheMiss)
+
+	if len(origin.requests) != 3 {
+		t.Fatalf("Expected 3 origin fetches, got %d", len(origin.requests))
+	}
+}
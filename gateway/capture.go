@@ -0,0 +1,322 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chris-wood/ohttp-go"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// Pseudo-fields that can be redacted from captures, besides header names
+	CaptureFieldBody  = "body"
+	CaptureFieldQuery = "query"
+)
+
+// CapturedRequest is a decapsulated request in a capture.
+type CapturedRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+	// BodyRedacted is set if the body was removed from the capture.
+	BodyRedacted bool `json:"body_redacted,omitempty"`
+}
+
+// CapturedResponse is a response to a decapsulated request in a capture.
+type CapturedResponse struct {
+	StatusCode   int         `json:"status_code"`
+	Header       http.Header `json:"header,omitempty"`
+	Body         []byte      `json:"body,omitempty"`
+	BodyRedacted bool        `json:"body_redacted,omitempty"`
+}
+
+// CaptureRecord is a line of a capture, holding a decapsulated request and its response before
+// encapsulation. Content that is neither binary HTTP nor protohttp, or that cannot be decoded, is
+// captured as is, unless fields are redacted from the capture.
+type CaptureRecord struct {
+	Time        time.Time         `json:"time"`
+	ContentType string            `json:"content_type"`
+	Request     *CapturedRequest  `json:"request,omitempty"`
+	Response    *CapturedResponse `json:"response,omitempty"`
+	RawRequest  []byte            `json:"raw_request,omitempty"`
+	RawResponse []byte            `json:"raw_response,omitempty"`
+	// Error is the error of the application handler, if it failed.
+	Error string `json:"error,omitempty"`
+}
+
+// Capture writes the decapsulated requests to a gateway and their responses as JSON lines, for
+// debugging. Captures hold private data of clients, so they must only be enabled in development.
+type Capture struct {
+	mu              sync.Mutex
+	encoder         *json.Encoder
+	redactedHeaders map[string]bool
+	redactBody      bool
+	redactQuery     bool
+}
+
+// NewCapture creates a Capture writing to w. Values of the header names in redactedFields are
+// replaced, and the pseudo-fields "body" and "query" remove bodies and URL queries.
+func NewCapture(w io.Writer, redactedFields []string) *Capture {
+	c := &Capture{
+		encoder:         json.NewEncoder(w),
+		redactedHeaders: make(map[string]bool),
+	}
+	for _, field := range redactedFields {
+		switch strings.ToLower(field) {
+		case CaptureFieldBody:
+			c.redactBody = true
+		case CaptureFieldQuery:
+			c.redactQuery = true
+		default:
+			c.redactedHeaders[http.CanonicalHeaderKey(field)] = true
+		}
+	}
+	return c
+}
+
+func (c *Capture) redactHeader(header http.Header) http.Header {
+	if len(header) == 0 {
+		return nil
+	}
+	// Binary HTTP field names are lower case, so names are canonicalized for lookups
+	redacted := make(http.Header, len(header))
+	for name, values := range header {
+		name = http.CanonicalHeaderKey(name)
+		if c.redactedHeaders[name] {
+			values = []string{redactedLogValue}
+		}
+		redacted[name] = append(redacted[name], values...)
+	}
+	return redacted
+}
+
+func (c *Capture) captureRequest(req *http.Request) (*CapturedRequest, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+	}
+	url := *req.URL
+	if c.redactQuery && url.RawQuery != "" {
+		url.RawQuery = redactedLogValue
+	}
+	captured := &CapturedRequest{
+		Method: req.Method,
+		URL:    url.String(),
+		Header: c.redactHeader(req.Header),
+		Body:   body,
+	}
+	if c.redactBody && len(body) > 0 {
+		captured.Body, captured.BodyRedacted = nil, true
+	}
+	return captured, nil
+}
+
+func (c *Capture) captureResponse(resp *http.Response) (*CapturedResponse, error) {
+	var body []byte
+	if resp.Body != nil {
+		var err error
+		if body, err = io.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
+	}
+	captured := &CapturedResponse{
+		StatusCode: resp.StatusCode,
+		Header:     c.redactHeader(resp.Header),
+		Body:       body,
+	}
+	if c.redactBody && len(body) > 0 {
+		captured.Body, captured.BodyRedacted = nil, true
+	}
+	return captured, nil
+}
+
+// redacting reports whether any field is redacted from captures. Content that cannot be decoded
+// cannot be redacted, so it is then left out rather than captured as is.
+func (c *Capture) redacting() bool {
+	return c.redactBody || c.redactQuery || len(c.redactedHeaders) > 0
+}
+
+// decodeRequest decodes a request with the given content type, returning false if it cannot be.
+func (c *Capture) decodeRequest(contentType string, binaryRequest []byte) (*CapturedRequest, bool) {
+	var req *http.Request
+	var err error
+	switch contentType {
+	case binaryHTTPRequestType:
+		if req, err = ohttp.UnmarshalBinaryRequest(binaryRequest); err != nil {
+			return nil, false
+		}
+	case ProtoHTTPRequestType, ProtoHTTPV2RequestType:
+		codec := protoHTTPCodecs[contentType]
+		protoRequest := codec.newRequest()
+		if err = proto.Unmarshal(binaryRequest, protoRequest); err != nil {
+			return nil, false
+		}
+		if req, err = codec.toHTTPRequest(protoRequest); err != nil {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+
+	captured, err := c.captureRequest(req)
+	return captured, err == nil
+}
+
+// decodeResponse decodes a response to a request with the given content type, returning false if
+// it cannot be.
+func (c *Capture) decodeResponse(contentType string, binaryResponse []byte) (*CapturedResponse, bool) {
+	var resp *http.Response
+	var err error
+	switch contentType {
+	case binaryHTTPRequestType:
+		if resp, err = ohttp.UnmarshalBinaryResponse(binaryResponse); err != nil {
+			return nil, false
+		}
+	case ProtoHTTPRequestType, ProtoHTTPV2RequestType:
+		codec := protoHTTPCodecs[contentType]
+		protoResponse := codec.newResponse()
+		if err = proto.Unmarshal(binaryResponse, protoResponse); err != nil {
+			return nil, false
+		}
+		if resp, err = codec.toHTTPResponse(protoResponse); err != nil {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+
+	captured, err := c.captureResponse(resp)
+	return captured, err == nil
+}
+
+// record writes a decapsulated request with the given content type, and its response. The request
+// and response are decoded separately, so that one that cannot be decoded does not hide the other.
+func (c *Capture) record(contentType string, binaryRequest, binaryResponse []byte, handlerErr error) {
+	record := CaptureRecord{
+		Time:        time.Now(),
+		ContentType: contentType,
+	}
+	if handlerErr != nil {
+		record.Error = handlerErr.Error()
+	}
+	var ok bool
+	if record.Request, ok = c.decodeRequest(contentType, binaryRequest); !ok && !c.redacting() {
+		record.RawRequest = binaryRequest
+	}
+	if len(binaryResponse) > 0 {
+		if record.Response, ok = c.decodeResponse(contentType, binaryResponse); !ok && !c.redacting() {
+			record.RawResponse = binaryResponse
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.encoder.Encode(record)
+}
+
+// capturingAppHandler is an AppContentHandler recording the content handled by another one.
+type capturingAppHandler struct {
+	appHandler  AppContentHandler
+	capture     *Capture
+	contentType string
+}
+
+func (h capturingAppHandler) Handle(e *EncapsulatedChunkWriter, binaryRequest []byte, metrics Metrics) error {
+	var response bytes.Buffer
+	err := h.appHandler.Handle(NewEncapsulatedChunkWriter(io.MultiWriter(e, &response)), binaryRequest, metrics)
+	h.capture.record(h.contentType, binaryRequest, response.Bytes(), err)
+	return err
+}
+
+// Replay sends the captured request again with handler, and returns the response. Redacted
+// headers and bodies are not sent.
+func (r CaptureRecord) Replay(handler HttpRequestHandler) (*CapturedResponse, error) {
+	if r.Request == nil {
+		return nil, fmt.Errorf("no decoded request in capture of %s content", r.ContentType)
+	}
+	req, err := http.NewRequest(r.Request.Method, r.Request.URL, bytes.NewReader(r.Request.Body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range r.Request.Header {
+		if len(values) == 1 && values[0] == redactedLogValue {
+			continue
+		}
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+
+	resp, err := handler.Handle(req, noopMetrics{})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &CapturedResponse{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       body,
+	}, nil
+}
+
+// DiffCapturedResponses describes how a replayed response differs from the captured one, ignoring
+// framing headers, the given headers and redacted values. It returns nothing if they match.
+func DiffCapturedResponses(captured, replayed *CapturedResponse, ignoredHeaders []string) []string {
+	var diffs []string
+	if captured.StatusCode != replayed.StatusCode {
+		diffs = append(diffs, fmt.Sprintf("status %d, captured %d", replayed.StatusCode, captured.StatusCode))
+	}
+
+	// Framing differs between binary HTTP and the HTTP version of the replayed response
+	ignored := map[string]bool{
+		"Content-Length":    true,
+		"Transfer-Encoding": true,
+	}
+	for _, name := range ignoredHeaders {
+		ignored[http.CanonicalHeaderKey(name)] = true
+	}
+	names := make(map[string]bool)
+	for name := range captured.Header {
+		names[http.CanonicalHeaderKey(name)] = true
+	}
+	for name := range replayed.Header {
+		names[http.CanonicalHeaderKey(name)] = true
+	}
+	sortedNames := make([]string, 0, len(names))
+	for name := range names {
+		sortedNames = append(sortedNames, name)
+	}
+	sort.Strings(sortedNames)
+	for _, name := range sortedNames {
+		capturedValue := strings.Join(captured.Header.Values(name), ", ")
+		replayedValue := strings.Join(replayed.Header.Values(name), ", ")
+		if ignored[name] || capturedValue == redactedLogValue || capturedValue == replayedValue {
+			continue
+		}
+		diffs = append(diffs, fmt.Sprintf("header %s: %q, captured %q", name, replayedValue, capturedValue))
+	}
+
+	if !captured.BodyRedacted && !bytes.Equal(captured.Body, replayed.Body) {
+		diffs = append(diffs, fmt.Sprintf("body of %d bytes differs from captured body of %d bytes", len(replayed.Body), len(captured.Body)))
+	}
+	return diffs
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/chris-wood/ohttp-go"
+)
+
+func TestCaptureAndReplay(t *testing.T) {
+	target := &StaticHttpRequestHandler{
+		header: http.Header{"Set-Cookie": {"session=secret"}, "X-Target": {"yes"}},
+		body:   []byte("first"),
+	}
+	var captured bytes.Buffer
+	handler := capturingAppHandler{
+		appHandler:  BinaryHTTPAppHandler{httpHandler: target},
+		capture:     NewCapture(&captured, []string{"authorization", "set-cookie"}),
+		contentType: binaryHTTPRequestType,
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "https://"+ALLOWED_TARGET+"/path", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Accept", "text/plain")
+	binaryRequest := ohttp.BinaryRequest(*req)
+	encodedRequest, err := binaryRequest.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response bytes.Buffer
+	if err := handler.Handle(NewEncapsulatedChunkWriter(&response), encodedRequest, &MockMetrics{resultLabels: map[string]bool{}}); err != nil {
+		t.Fatal(err)
+	}
+	if response.Len() == 0 {
+		t.Fatal("Expected the response to be written to the client too")
+	}
+	if bytes.Contains(captured.Bytes(), []byte("secret")) {
+		t.Fatalf("Expected redacted fields to be left out of the capture: %s", captured.String())
+	}
+
+	var record CaptureRecord
+	if err := json.Unmarshal(captured.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Request == nil || record.Response == nil {
+		t.Fatalf("Expected a decoded request and response, got %+v", record)
+	}
+	if record.Request.Header.Get("Accept") != "text/plain" || record.Response.StatusCode != http.StatusOK || string(record.Response.Body) != "first" {
+		t.Fatalf("Unexpected capture %+v, %+v", record.Request, record.Response)
+	}
+
+	replayed, err := record.Replay(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := DiffCapturedResponses(record.Response, replayed, nil); len(diffs) > 0 {
+		t.Fatalf("Expected the same response, got %v", diffs)
+	}
+	if replayRequest := target.requests[1]; replayRequest.Header.Get("Authorization") != "" || replayRequest.Header.Get("Accept") != "text/plain" {
+		t.Fatalf("Expected only unredacted headers to be replayed, got %v", replayRequest.Header)
+	}
+
+	target.body = []byte("second")
+	target.header.Set("X-Target", "no")
+	replayed, err = record.Replay(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := DiffCapturedResponses(record.Response, replayed, nil); len(diffs) != 2 {
+		t.Fatalf("Expected the header and body to differ, got %v", diffs)
+	}
+	if diffs := DiffCapturedResponses(record.Response, replayed, []string{"x-target"}); len(diffs) != 1 || !strings.HasPrefix(diffs[0], "body") {
+		t.Fatalf("Expected only the body to differ, got %v", diffs)
+	}
+}
+
+func TestCaptureUndecodableContent(t *testing.T) {
+	var captured bytes.Buffer
+	capture := NewCapture(&captured, []string{CaptureFieldBody})
+	capture.record(binaryHTTPRequestType, []byte{0xff}, nil, ErrPayloadMarshalling)
+	capture.record("message/custom", []byte("payload"), []byte("response"), nil)
+
+	lines := strings.Split(strings.TrimSpace(captured.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 records, got %d", len(lines))
+	}
+	var record CaptureRecord
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Request != nil || record.RawRequest != nil || record.Error != ErrPayloadMarshalling.Error() {
+		t.Fatalf("Expected only the error of undecodable content with redacted bodies, got %+v", record)
+	}
+	if _, err := record.Replay(NewFilteredHttpRequestHandler(http.DefaultClient, nil, nil)); err == nil {
+		t.Fatal("Expected replay of an undecoded request to fail")
+	}
+}
+
+func TestCaptureRawContent(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "https://"+ALLOWED_TARGET+"/path", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binaryRequest := ohttp.BinaryRequest(*req)
+	encodedRequest, err := binaryRequest.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		redactedFields []string
+		raw            bool
+	}{
+		{nil, true},
+		{[]string{"authorization"}, false},
+		{[]string{CaptureFieldQuery}, false},
+	} {
+		var captured bytes.Buffer
+		capture := NewCapture(&captured, test.redactedFields)
+		capture.record(binaryHTTPRequestType, encodedRequest, []byte{0xff}, nil)
+
+		var record CaptureRecord
+		if err := json.Unmarshal(captured.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		// The request is decoded even though the response cannot be
+		if record.Request == nil || record.Request.URL != req.URL.String() || record.RawRequest != nil || record.Response != nil {
+			t.Fatalf("Expected only the request to be decoded with %v, got %+v", test.redactedFields, record)
+		}
+		if (record.RawResponse != nil) != test.raw {
+			t.Fatalf("Expected raw response %v with %v, got %x", test.raw, test.redactedFields, record.RawResponse)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gateway
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Metrics constants
+	metricsResultTargetCircuitOpen = "request_circuit_open"
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitClosed:
+		return "closed"
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// circuit tracks the outcome of the most recent requests to a single origin.
+type circuit struct {
+	origin    string
+	state     circuitState
+	outcomes  []bool // ring buffer of recent outcomes, true for failures
+	next      int
+	requests  int
+	failures  int
+	openedAt  time.Time
+	probes    int // half-open probes currently in flight
+	successes int // successful half-open probes
+}
+
+func (c *circuit) reset() {
+	for i := range c.outcomes {
+		c.outcomes[i] = false
+	}
+	c.next, c.requests, c.failures = 0, 0, 0
+	c.probes, c.successes = 0, 0
+}
+
+func (c *circuit) add(failed bool) {
+	if c.requests == len(c.outcomes) {
+		if c.outcomes[c.next] {
+			c.failures--
+		}
+	} else {
+		c.requests++
+	}
+	c.outcomes[c.next] = failed
+	if failed {
+		c.failures++
+	}
+	c.next = (c.next + 1) % len(c.outcomes)
+}
+
+// CircuitSnapshot is the externally visible state of the circuit for one origin.
+type CircuitSnapshot struct {
+	State    string     `json:"state"`
+	Requests int        `json:"requests"`
+	Failures int        `json:"failures"`
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+}
+
+// CircuitBreaker keeps a circuit per target authority. A circuit opens once the failure
+// rate over a window of recent requests crosses a threshold, rejects requests for a
+// cool-down period, and then admits a limited number of probes (half-open) to decide
+// whether to close again.
+type CircuitBreaker struct {
+	mu             sync.Mutex
+	windowSize     int
+	minRequests    int
+	failureRate    float64
+	coolDown       time.Duration
+	halfOpenProbes int
+	circuits       map[string]*list.Element
+	lru            *list.List
+	now            func() time.Time
+	logger         *slog.Logger
+	// originLabel returns the metrics label of an origin, which is safe to log
+	originLabel func(origin string) string
+}
+
+// NewCircuitBreaker creates a CircuitBreaker that opens a circuit when at least failureRate
+// of the last windowSize requests (and at least minRequests of them) failed, keeps it open
+// for coolDown, and then closes it after halfOpenProbes consecutive successful probes.
+func NewCircuitBreaker(windowSize, minRequests int, failureRate float64, coolDown time.Duration, halfOpenProbes int) *CircuitBreaker {
+	if windowSize < 1 {
+		windowSize = 1
+	}
+	if minRequests > windowSize {
+		minRequests = windowSize
+	}
+	if halfOpenProbes < 1 {
+		halfOpenProbes = 1
+	}
+	return &CircuitBreaker{
+		windowSize:     windowSize,
+		minRequests:    minRequests,
+		failureRate:    failureRate,
+		coolDown:       coolDown,
+		halfOpenProbes: halfOpenProbes,
+		circuits:       make(map[string]*list.Element),
+		lru:            list.New(),
+		now:            time.Now,
+		logger:         defaultLogger(),
+	}
+}
+
+func (b *CircuitBreaker) circuit(origin string) *circuit {
+	if element, ok := b.circuits[origin]; ok {
+		b.lru.MoveToFront(element)
+		return element.Value.(*circuit)
+	}
+	// Without an allowlist, clients choose the origins, so the least recently used circuit is
+	// evicted whatever its state to keep the number of circuits bounded
+	if b.lru.Len() >= maxTrackedOrigins {
+		oldest := b.lru.Back()
+		b.lru.Remove(oldest)
+		delete(b.circuits, oldest.Value.(*circuit).origin)
+	}
+	c := &circuit{
+		origin:   origin,
+		outcomes: make([]bool, b.windowSize),
+	}
+	b.circuits[origin] = b.lru.PushFront(c)
+	return c
+}
+
+func (b *CircuitBreaker) transition(origin string, c *circuit, state circuitState) {
+	// The origin is only logged in the clear if it is allowed, like in metrics
+	label := metricsTagValueOther
+	if b.originLabel != nil {
+		label = b.originLabel(origin)
+	}
+	b.logger.Info("Target circuit changed state", metricsTagOrigin, label, LogKeyTargetOrigin, origin, "from", c.state.String(), "to", state.String())
+	c.state = state
+	switch state {
+	case circuitOpen:
+		c.openedAt = b.now()
+		c.probes, c.successes = 0, 0
+	case circuitClosed:
+		c.reset()
+	}
+}
+
+// Allow reports whether a request to origin may be sent. If not, it also returns how
+// long the circuit remains open.
+func (b *CircuitBreaker) Allow(origin string) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.circuit(origin)
+	switch c.state {
+	case circuitOpen:
+		remaining := b.coolDown - b.now().Sub(c.openedAt)
+		if remaining > 0 {
+			return false, remaining
+		}
+		b.transition(origin, c, circuitHalfOpen)
+		c.probes++
+		return true, 0
+	case circuitHalfOpen:
+		if c.probes+c.successes >= b.halfOpenProbes {
+			return false, 0
+		}
+		c.probes++
+		return true, 0
+	default:
+		return true, 0
+	}
+}
+
+// Record records the outcome of a request to origin that was admitted by Allow.
+func (b *CircuitBreaker) Record(origin string, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.circuit(origin)
+	switch c.state {
+	case circuitHalfOpen:
+		if c.probes > 0 {
+			c.probes--
+		}
+		if failed {
+			b.transition(origin, c, circuitOpen)
+			return
+		}
+		c.successes++
+		if c.successes >= b.halfOpenProbes {
+			b.transition(origin, c, circuitClosed)
+		}
+	case circuitClosed:
+		c.add(failed)
+		if c.requests >= b.minRequests && float64(c.failures) >= b.failureRate*float64(c.requests) && c.failures > 0 {
+			b.transition(origin, c, circuitOpen)
+		}
+	}
+}
+
+// Release gives back the admission of a request to origin whose outcome says nothing about the
+// origin, such as a request canceled by the client. It counts as neither a success nor a failure,
+// but frees the slot of a half-open probe.
+func (b *CircuitBreaker) Release(origin string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.circuit(origin)
+	if c.state == circuitHalfOpen && c.probes > 0 {
+		c.probes--
+	}
+}
+
+// Snapshot returns the state of every tracked circuit, keyed by origin.
+func (b *CircuitBreaker) Snapshot() map[string]CircuitSnapshot {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	snapshot := make(map[string]CircuitSnapshot, len(b.circuits))
+	for origin, element := range b.circuits {
+		c := element.Value.(*circuit)
+		s := CircuitSnapshot{
+			State:    c.state.String(),
+			Requests: c.requests,
+			Failures: c.failures,
+		}
+		if c.state != circuitClosed {
+			openedAt := c.openedAt
+			s.OpenedAt = &openedAt
+		}
+		snapshot[origin] = s
+	}
+	return snapshot
+}
+
+// circuitOpenResponse is the target response returned in place of sending a request to an
+// origin whose circuit is open.
+func circuitOpenResponse(openFor time.Duration) *http.Response {
+	body := []byte(http.StatusText(http.StatusServiceUnavailable))
+	header := make(http.Header)
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	if openFor > 0 {
+		header.Set("Retry-After", strconv.Itoa(int((openFor+time.Second-1)/time.Second)))
+	}
+	return &http.Response{
+		StatusCode:    http.StatusServiceUnavailable,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
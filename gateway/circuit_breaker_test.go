@@ -0,0 +1,207 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func createTestCircuitBreaker(clock *fakeClock) *CircuitBreaker {
+	breaker := NewCircuitBreaker(4, 4, 0.5, time.Minute, 1)
+	breaker.now = clock.Now
+	return breaker
+}
+
+func expectCircuitState(t *testing.T, breaker *CircuitBreaker, origin string, state circuitState) {
+	t.Helper()
+	if got := breaker.Snapshot()[origin].State; got != state.String() {
+		t.Fatalf("Expected circuit for %s to be %s, got %s", origin, state, got)
+	}
+}
+
+func TestCircuitBreakerOpensOnFailureRate(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	breaker := createTestCircuitBreaker(clock)
+
+	for _, failed := range []bool{true, false, true} {
+		if allowed, _ := breaker.Allow(ALLOWED_TARGET); !allowed {
+			t.Fatal("Expected request to be allowed while the circuit is closed")
+		}
+		breaker.Record(ALLOWED_TARGET, failed)
+	}
+	expectCircuitState(t, breaker, ALLOWED_TARGET, circuitClosed)
+
+	breaker.Record(ALLOWED_TARGET, false)
+	expectCircuitState(t, breaker, ALLOWED_TARGET, circuitOpen)
+
+	allowed, openFor := breaker.Allow(ALLOWED_TARGET)
+	if allowed || openFor != time.Minute {
+		t.Fatalf("Expected request to be rejected for %s, got allowed=%v openFor=%s", time.Minute, allowed, openFor)
+	}
+	if allowed, _ := breaker.Allow(FORBIDDEN_TARGET); !allowed {
+		t.Fatal("Expected circuits to be tracked per origin")
+	}
+}
+
+func TestCircuitBreakerEviction(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	breaker := createTestCircuitBreaker(clock)
+
+	// Open circuits are evicted too, least recently used first
+	for i := 0; i < maxTrackedOrigins+10; i++ {
+		origin := fmt.Sprintf("origin-%d.example", i)
+		for j := 0; j < 4; j++ {
+			breaker.Record(origin, true)
+		}
+		if i == 0 {
+			expectCircuitState(t, breaker, origin, circuitOpen)
+		}
+		// Keep the first origin in use so that it is not evicted
+		breaker.Allow("origin-0.example")
+	}
+	snapshot := breaker.Snapshot()
+	if len(snapshot) != maxTrackedOrigins {
+		t.Fatalf("Expected %d tracked circuits, got %d", maxTrackedOrigins, len(snapshot))
+	}
+	if _, ok := snapshot["origin-1.example"]; ok {
+		t.Fatal("Expected the least recently used circuit to be evicted")
+	}
+	expectCircuitState(t, breaker, "origin-0.example", circuitOpen)
+}
+
+func TestCircuitBreakerLogsAllowedOrigins(t *testing.T) {
+	var logs bytes.Buffer
+	breaker := createTestCircuitBreaker(&fakeClock{now: time.Now()})
+	breaker.logger = slog.New(NewRedactingHandler(slog.NewTextHandler(&logs, nil), false))
+	breaker.originLabel = NewFilteredHttpRequestHandler(nil, []string{ALLOWED_TARGET}, nil).originLabel
+
+	for i := 0; i < 4; i++ {
+		breaker.Record(ALLOWED_TARGET, true)
+		breaker.Record(FORBIDDEN_TARGET, true)
+	}
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 state changes, got:\n%s", logs.String())
+	}
+	if !strings.Contains(lines[0], metricsTagOrigin+"="+ALLOWED_TARGET) {
+		t.Fatalf("Expected the allowed origin to be logged, got:\n%s", lines[0])
+	}
+	if strings.Contains(lines[1], FORBIDDEN_TARGET) || !strings.Contains(lines[1], metricsTagOrigin+"="+metricsTagValueForbidden) {
+		t.Fatalf("Expected the other origin to be redacted, got:\n%s", lines[1])
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	breaker := createTestCircuitBreaker(clock)
+	for i := 0; i < 4; i++ {
+		breaker.Allow(ALLOWED_TARGET)
+		breaker.Record(ALLOWED_TARGET, true)
+	}
+	expectCircuitState(t, breaker, ALLOWED_TARGET, circuitOpen)
+
+	// A failed probe after the cool-down reopens the circuit
+	clock.now = clock.now.Add(time.Minute)
+	if allowed, _ := breaker.Allow(ALLOWED_TARGET); !allowed {
+		t.Fatal("Expected a probe to be allowed after the cool-down")
+	}
+	if allowed, _ := breaker.Allow(ALLOWED_TARGET); allowed {
+		t.Fatal("Expected a single probe to be allowed while half-open")
+	}
+	breaker.Record(ALLOWED_TARGET, true)
+	expectCircuitState(t, breaker, ALLOWED_TARGET, circuitOpen)
+
+	// A successful probe closes it
+	clock.now = clock.now.Add(time.Minute)
+	if allowed, _ := breaker.Allow(ALLOWED_TARGET); !allowed {
+		t.Fatal("Expected a probe to be allowed after the cool-down")
+	}
+	breaker.Record(ALLOWED_TARGET, false)
+	expectCircuitState(t, breaker, ALLOWED_TARGET, circuitClosed)
+}
+
+func TestCircuitBreakerCanceledProbe(t *testing.T) {
+	server, count := createFlakyTarget(t, 1<<30, http.StatusServiceUnavailable, "")
+	clock := &fakeClock{now: time.Now()}
+	breaker := createTestCircuitBreaker(clock)
+	for i := 0; i < 4; i++ {
+		breaker.Allow(server.Listener.Addr().String())
+		breaker.Record(server.Listener.Addr().String(), true)
+	}
+	clock.now = clock.now.Add(time.Minute)
+	handler := FilteredHttpRequestHandler{
+		client:         server.Client(),
+		circuitBreaker: breaker,
+	}
+
+	// A probe canceled by the client neither closes nor reopens the circuit, and frees its slot
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handler.Handle(req, &MockMetrics{resultLabels: map[string]bool{}}); !errors.Is(err, ErrClientCanceled) {
+		t.Fatalf("Expected %v, got %v", ErrClientCanceled, err)
+	}
+	expectCircuitState(t, breaker, req.Host, circuitHalfOpen)
+	if got := atomic.LoadInt32(count); got != 0 {
+		t.Fatalf("Expected the canceled probe not to reach the target, got %d requests", got)
+	}
+	if allowed, _ := breaker.Allow(req.Host); !allowed {
+		t.Fatal("Expected the slot of the canceled probe to be released")
+	}
+	breaker.Record(req.Host, false)
+	expectCircuitState(t, breaker, req.Host, circuitClosed)
+}
+
+func TestFilteredHttpRequestHandlerCircuitOpen(t *testing.T) {
+	server, count := createFlakyTarget(t, 1<<30, http.StatusServiceUnavailable, "")
+	clock := &fakeClock{now: time.Now()}
+	handler := FilteredHttpRequestHandler{
+		client:         server.Client(),
+		circuitBreaker: createTestCircuitBreaker(clock),
+	}
+
+	var metrics *MockMetrics
+	for i := 0; i < 5; i++ {
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metrics = &MockMetrics{resultLabels: map[string]bool{}}
+		resp, err := handler.Handle(req, metrics)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("Expected status %d, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+		}
+	}
+
+	if got := atomic.LoadInt32(count); got != 4 {
+		t.Fatalf("Expected 4 requests to reach the target, got %d", got)
+	}
+	if !metrics.resultLabels[metricsResultTargetCircuitOpen] {
+		t.Fatalf("Expected metrics result %s to be fired", metricsResultTargetCircuitOpen)
+	}
+}
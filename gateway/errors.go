@@ -0,0 +1,142 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gateway
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Description of the error handling in the specification:
+// https://ietf-wg-ohai.github.io/oblivious-http/draft-ietf-ohai-ohttp.html#name-errors:
+
+// ErrorCategory classifies the errors of the gateway. It determines the status of the response to
+// a failed request, and labels its metrics.
+type ErrorCategory string
+
+const (
+	// Errors of the encapsulation, returned as the status of the gateway response
+	ErrorCategoryConfigMismatch ErrorCategory = "config_mismatch"
+	ErrorCategoryEncapsulation  ErrorCategory = "encapsulation"
+
+	// Errors after decapsulation, returned as the status of the encapsulated response
+	ErrorCategoryPayload           ErrorCategory = "payload"
+	ErrorCategoryTargetForbidden   ErrorCategory = "target_forbidden"
+	ErrorCategoryInternal          ErrorCategory = "internal"
+	ErrorCategoryTargetUnreachable ErrorCategory = "target_unreachable"
+	ErrorCategoryTargetTimeout     ErrorCategory = "target_timeout"
+	ErrorCategoryClientCanceled    ErrorCategory = "client_canceled"
+
+	// Status of requests canceled by the client, which never receives it. This is the status
+	// that nginx uses for them.
+	statusClientClosedRequest = 499
+)
+
+var errorCategories = map[ErrorCategory]struct {
+	message string
+	status  int
+}{
+	ErrorCategoryConfigMismatch:    {"configuration mismatch", http.StatusUnauthorized},
+	ErrorCategoryEncapsulation:     {"encapsulation error", http.StatusBadRequest},
+	ErrorCategoryPayload:           {"issues with payload marshalling (BHTTP or Protobuf)", http.StatusBadRequest},
+	ErrorCategoryTargetForbidden:   {"target forbidden on gateway (request was blocked by gateway)", http.StatusForbidden},
+	ErrorCategoryInternal:          {"the request failed to be processed after decapsulation", http.StatusInternalServerError},
+	ErrorCategoryTargetUnreachable: {"the target could not be reached", http.StatusBadGateway},
+	ErrorCategoryTargetTimeout:     {"the target did not respond in time", http.StatusGatewayTimeout},
+	ErrorCategoryClientCanceled:    {"the request was canceled by the client", statusClientClosedRequest},
+}
+
+// GatewayError is an error of the gateway, with its category and the underlying cause, if any.
+// Errors match the sentinel error of their category with errors.Is.
+type GatewayError struct {
+	Category ErrorCategory
+	Cause    error
+}
+
+func (e *GatewayError) Error() string {
+	message := errorCategories[e.Category].message
+	if e.Cause == nil {
+		return message
+	}
+	return message + ": " + e.Cause.Error()
+}
+
+func (e *GatewayError) Unwrap() error {
+	return e.Cause
+}
+
+// Is reports whether target is the sentinel error of the category of e.
+func (e *GatewayError) Is(target error) bool {
+	sentinel, ok := target.(*GatewayError)
+	return ok && sentinel.Cause == nil && sentinel.Category == e.Category
+}
+
+// StatusCode returns the status of the response to a request that failed with e.
+func (e *GatewayError) StatusCode() int {
+	return errorCategories[e.Category].status
+}
+
+// Sentinel errors of each category, matching any error of their category with errors.Is
+var (
+	// 401 - Unauthorized in Gateway response
+	ErrConfigMismatch = &GatewayError{Category: ErrorCategoryConfigMismatch}
+	// 400 - BadRequest in Gateway response
+	ErrEncapsulation = &GatewayError{Category: ErrorCategoryEncapsulation}
+	// 400 - BadRequest in Payload response. Payload is not a valid protobuf or marshalling error.
+	ErrPayloadMarshalling = &GatewayError{Category: ErrorCategoryPayload}
+	// 403 - Forbidden in Payload response. The request is not allowed to be sent to the target.
+	ErrGatewayTargetForbidden = &GatewayError{Category: ErrorCategoryTargetForbidden}
+	// 500 - Internal server error in Payload response. The request failed to be processed after decapsulation.
+	ErrGatewayInternalServer = &GatewayError{Category: ErrorCategoryInternal}
+	// 502 - Bad gateway in Payload response. The target could not be resolved, connected to, or
+	// authenticated, or it closed the connection.
+	ErrGatewayTargetUnreachable = &GatewayError{Category: ErrorCategoryTargetUnreachable}
+	// 504 - Gateway timeout in Payload response. The target did not respond in time.
+	ErrGatewayTargetTimeout = &GatewayError{Category: ErrorCategoryTargetTimeout}
+	// 499 in Payload response, which the client never receives. The client canceled the request.
+	ErrClientCanceled = &GatewayError{Category: ErrorCategoryClientCanceled}
+)
+
+// newTargetError wraps the error of a target request in a GatewayError of its category.
+func newTargetError(err error) *GatewayError {
+	category := ErrorCategoryInternal
+	switch targetErrorType(err) {
+	case targetErrorCanceled:
+		category = ErrorCategoryClientCanceled
+	case targetErrorTimeout:
+		category = ErrorCategoryTargetTimeout
+	case targetErrorDNS, targetErrorConnect, targetErrorTLS, targetErrorReset:
+		category = ErrorCategoryTargetUnreachable
+	}
+	return &GatewayError{
+		Category: category,
+		Cause:    err,
+	}
+}
+
+// errorCategory returns the category of err, which is internal unless it is a GatewayError.
+func errorCategory(err error) ErrorCategory {
+	var gatewayError *GatewayError
+	if errors.As(err, &gatewayError) {
+		return gatewayError.Category
+	}
+	return ErrorCategoryInternal
+}
+
+// Errors happened during decapsulation/encapsulation are returned as gateway response's error status (401 and 400)
+func ErrEncapsulationToGatewayStatusCode(e error) int {
+	if errors.Is(e, ErrConfigMismatch) {
+		return http.StatusUnauthorized
+	}
+	return http.StatusBadRequest
+}
+
+// Errors happened after decapsulation are returned as encapsulated payload errors while gatewy status is 200
+func payloadErrorToPayloadStatusCode(e error) int {
+	var gatewayError *GatewayError
+	if errors.As(e, &gatewayError) {
+		return gatewayError.StatusCode()
+	}
+	return http.StatusBadRequest
+}
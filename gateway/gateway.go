@@ -0,0 +1,216 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/chris-wood/ohttp-go"
+)
+
+type gatewayResource struct {
+	logger                *slog.Logger
+	legacyKeyID           uint8
+	gateway               ohttp.Gateway
+	encapsulationHandlers map[string]EncapsulationHandler
+	debugResponse         bool
+	metricsFactory        MetricsFactory
+	relayAuthenticator    RelayAuthenticator
+	contentType           string
+}
+
+const (
+	ohttpRequestContentType         = "message/ohttp-req"
+	ohttpResponseContentType        = "message/ohttp-res"
+	ohttpChunkedRequestContentType  = "message/ohttp-chunked-req"
+	ohttpChunkedResponseContentType = "message/ohttp-chunked-res"
+	twelveHours                     = 12 * 3600
+	twentyFourHours                 = 24 * 3600
+	maxRequestBodySize              = 100 << 20
+	maxOpaqueResponseSize           = 100 << 20
+
+	// Metrics constants
+	metricsEventGatewayRequest      = "gateway_request"
+	metricsEventConfigsRequest      = "configs_request"
+	metricsResultConfigsUnavalable  = "configs_unavailable"
+	metricsResultInvalidMethod      = "invalid_method"
+	metricsResultInvalidContentType = "invalid_content_type"
+	metricsResultInvalidContent     = "invalid_content"
+	metricsMethodOther              = "OTHER"
+)
+
+// metricsMethod returns the method of r to report in metrics. Clients can send any method token,
+// so methods other than the ones the gateway serves are reported as metricsMethodOther, keeping the
+// number of distinct labels fixed.
+func metricsMethod(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodPost:
+		return r.Method
+	default:
+		return metricsMethodOther
+	}
+}
+
+func (s *gatewayResource) httpError(w http.ResponseWriter, logger *slog.Logger, status int, debugMessage string, metrics Metrics, metricsPrefix string) {
+	logger.Debug("Request failed", "status", status, "reason", debugMessage)
+	if s.debugResponse {
+		http.Error(w, debugMessage, status)
+	} else {
+		http.Error(w, http.StatusText(status), status)
+	}
+	metrics.ResponseStatus(metricsPrefix, status)
+}
+
+// requestLogger returns a logger for the entries of a request, with a new correlation ID.
+func (s *gatewayResource) requestLogger(r *http.Request) *slog.Logger {
+	logger := s.logger.With(logKeyRequestID, newRequestID())
+	logger.Debug("Handling request", "method", r.Method, "path", r.URL.Path, LogKeyClientIP, r.RemoteAddr)
+	return logger
+}
+
+func (s *gatewayResource) gatewayHandler(w http.ResponseWriter, r *http.Request) {
+	logger := s.requestLogger(r)
+
+	metrics := s.metricsFactory.Create(metricsEventGatewayRequest)
+
+	// Limit request body size to 100MB, including the bodies read to authenticate relays.
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+
+	if s.relayAuthenticator != nil {
+		relay, err := s.relayAuthenticator.Authenticate(r)
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			metrics.Fire(metricsResultInvalidContent)
+			s.httpError(w, logger, http.StatusBadRequest, "Reading request body failed", metrics, metricsMethod(r))
+			return
+		}
+		if err != nil {
+			metrics.Fire(metricsResultRelayUnauthenticated)
+			s.httpError(w, logger, http.StatusForbidden, err.Error(), metrics, metricsMethod(r))
+			return
+		}
+		metrics.Tag(metricsTagRelay, relay)
+	}
+
+	if r.Method != http.MethodPost {
+		metrics.Fire(metricsResultInvalidMethod)
+		s.httpError(w, logger, http.StatusBadRequest, fmt.Sprintf("Invalid method: %s", r.Method), metrics, metricsMethod(r))
+		return
+	}
+
+	switch r.Header.Get("Content-Type") {
+	case ohttpRequestContentType:
+		s.ohttpGatewayHandler(w, r, logger, metrics)
+		return
+	}
+	// Chunked requests (ohttpChunkedRequestContentType) are rejected like any other content type
+	// until ohttp-go supports chunked encapsulation, which is needed to serve them.
+
+	metrics.Fire(metricsResultInvalidContentType)
+	s.httpError(w, logger, http.StatusBadRequest, fmt.Sprintf("Invalid content type: %s", r.Header.Get("Content-Type")), metrics, metricsMethod(r))
+}
+
+func (s *gatewayResource) ohttpGatewayHandler(w http.ResponseWriter, r *http.Request, logger *slog.Logger, metrics Metrics) {
+	encapHandler, ok := s.encapsulationHandlers[r.URL.Path]
+	if !ok {
+		s.httpError(w, logger, http.StatusBadRequest, "Unknown handler", metrics, metricsMethod(r))
+		return
+	}
+
+	startedAt := time.Now()
+	encryptedMessageBytes, err := io.ReadAll(r.Body)
+	metrics.Phase(metricsPhaseReadBody, time.Since(startedAt))
+	if err != nil {
+		metrics.Fire(metricsResultInvalidContent)
+		s.httpError(w, logger, http.StatusBadRequest, "Reading request body failed", metrics, metricsMethod(r))
+		return
+	}
+	metrics.MessageSize(metricsMessageEncapsulatedRequest, messageSizeBucket(len(encryptedMessageBytes)))
+
+	encapsulatedReq, err := ohttp.UnmarshalEncapsulatedRequest(encryptedMessageBytes)
+	if err != nil {
+		metrics.Fire(metricsResultInvalidContent)
+		s.httpError(w, logger, http.StatusBadRequest, "Reading request body failed", metrics, metricsMethod(r))
+		return
+	}
+	s.tagEncapsulation(encapsulatedReq, metrics)
+
+	encapsulatedResp, err := encapHandler.Handle(r, encapsulatedReq, metrics)
+	if err != nil {
+		logger.Debug("Handling encapsulated request failed", "error_category", errorCategory(err), LogKeyErrorDetail, err)
+		metrics.Tag(metricsTagErrorCategory, string(errorCategory(err)))
+
+		errorCode := ErrEncapsulationToGatewayStatusCode(err)
+		s.httpError(w, logger, errorCode, http.StatusText(errorCode), metrics, metricsMethod(r))
+		return
+	}
+
+	packedResponse := encapsulatedResp.Marshal()
+	metrics.MessageSize(metricsMessageEncapsulatedResponse, messageSizeBucket(len(packedResponse)))
+
+	w.Header().Set("Content-Type", ohttpResponseContentType)
+	w.Header().Set("Connection", "Keep-Alive")
+	startedAt = time.Now()
+	w.Write(packedResponse)
+	metrics.Phase(metricsPhaseWriteResponse, time.Since(startedAt))
+	metrics.ResponseStatus(metricsMethod(r), http.StatusOK)
+}
+
+// tagEncapsulation labels the metrics of a request with its key configuration and content type.
+// Requests for unknown key configurations are labelled as unknown, so that clients cannot create
+// arbitrary labels.
+func (s *gatewayResource) tagEncapsulation(encapsulatedReq ohttp.EncapsulatedRequest, metrics Metrics) {
+	config, err := s.gateway.Config(encapsulatedReq.KeyID)
+	if err != nil {
+		metrics.Tag(metricsTagKeyID, metricsTagValueUnknown)
+		metrics.Tag(metricsTagKEM, metricsTagValueUnknown)
+	} else {
+		metrics.Tag(metricsTagKeyID, strconv.Itoa(int(config.ID)))
+		metrics.Tag(metricsTagKEM, KEMName(config.KEMID))
+	}
+	metrics.Tag(metricsTagContentType, s.contentType)
+}
+
+func (s *gatewayResource) legacyConfigHandler(w http.ResponseWriter, r *http.Request) {
+	logger := s.requestLogger(r)
+	metrics := s.metricsFactory.Create(metricsEventConfigsRequest)
+
+	config, err := s.gateway.Config(s.legacyKeyID)
+	if err != nil {
+		logger.Error("Legacy key configuration unavailable", "key_id", s.legacyKeyID)
+		metrics.Fire(metricsResultConfigsUnavalable)
+		s.httpError(w, logger, http.StatusInternalServerError, "Config unavailable", metrics, metricsMethod(r))
+		return
+	}
+
+	// Make expiration time even/random throughout interval 12-36h
+	rand.Seed(time.Now().UnixNano())
+	maxAge := twelveHours + rand.Intn(twentyFourHours)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d, private", maxAge))
+
+	w.Write(config.Marshal())
+
+	metrics.ResponseStatus(metricsMethod(r), http.StatusOK)
+}
+
+func (s *gatewayResource) configHandler(w http.ResponseWriter, r *http.Request) {
+	s.requestLogger(r)
+	metrics := s.metricsFactory.Create(metricsEventConfigsRequest)
+
+	// Make expiration time even/random throughout interval 12-36h
+	rand.Seed(time.Now().UnixNano())
+	maxAge := twelveHours + rand.Intn(twentyFourHours)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d, private", maxAge))
+	w.Header().Set("Content-Type", "application/ohttp-keys")
+
+	w.Write(s.gateway.MarshalConfigs())
+	metrics.ResponseStatus(metricsMethod(r), http.StatusOK)
+}
@@ -0,0 +1,1213 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/chris-wood/ohttp-go"
+	"github.com/cloudflare/circl/hpke"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	LEGACY_KEY_ID    = uint8(0x00)
+	CURRENT_KEY_ID   = uint8(LEGACY_KEY_ID + 1)
+	FORBIDDEN_TARGET = "forbidden.example"
+	ALLOWED_TARGET   = "allowed.example"
+	GATEWAY_DEBUG    = true
+)
+
+func createGateway(t *testing.T) ohttp.Gateway {
+	legacyConfig, err := ohttp.NewConfig(LEGACY_KEY_ID, hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM)
+	if err != nil {
+		t.Fatal("Failed to create a valid config. Exiting now.")
+	}
+	config, err := ohttp.NewConfig(CURRENT_KEY_ID, hpke.KEM_X25519_KYBER768_DRAFT00, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM)
+	if err != nil {
+		t.Fatal("Failed to create a valid config. Exiting now.")
+	}
+
+	return ohttp.NewDefaultGateway([]ohttp.PrivateConfig{config, legacyConfig})
+}
+
+type MockMetrics struct {
+	eventName    string
+	resultLabels map[string]bool
+	tags         map[string]string
+	phases       map[string]time.Duration
+	sizes        map[string]int
+}
+
+func (s *MockMetrics) Tag(name, value string) {
+	if s.tags == nil {
+		s.tags = map[string]string{}
+	}
+	s.tags[name] = value
+}
+
+func (s *MockMetrics) Phase(name string, duration time.Duration) {
+	if s.phases == nil {
+		s.phases = map[string]time.Duration{}
+	}
+	s.phases[name] += duration
+}
+
+func (s *MockMetrics) MessageSize(name string, size int) {
+	if s.sizes == nil {
+		s.sizes = map[string]int{}
+	}
+	s.sizes[name] = size
+}
+
+func (s *MockMetrics) ResponseStatus(prefix string, status int) {
+	s.Fire(fmt.Sprintf("%s_response_status_%d", prefix, status))
+}
+
+func (s *MockMetrics) Fire(result string) {
+	// This just assertion that we don't call the `Fire` twice for the same result/label
+	_, exists := s.resultLabels[result]
+	if exists {
+		panic("Metrics.Fire called twice for the same result")
+	}
+	s.resultLabels[result] = true
+}
+
+type MockMetricsFactory struct {
+	metrics []*MockMetrics
+}
+
+func (f *MockMetricsFactory) Create(eventName string) Metrics {
+	metrics := &MockMetrics{
+		eventName:    eventName,
+		resultLabels: map[string]bool{},
+	}
+	f.metrics = append(f.metrics, metrics)
+	return metrics
+}
+
+type ForbiddenCheckHttpRequestHandler struct {
+	forbidden string
+}
+
+func mustGetMetricsFactory(t *testing.T, gateway gatewayResource) *MockMetricsFactory {
+	factory, ok := gateway.metricsFactory.(*MockMetricsFactory)
+	if !ok {
+		panic("Failed to get metrics factory")
+	}
+	return factory
+}
+
+func (h ForbiddenCheckHttpRequestHandler) Handle(req *http.Request, metrics Metrics) (*http.Response, error) {
+	if req.Host == h.forbidden {
+		metrics.Fire(metricsResultTargetRequestForbidden)
+		return nil, ErrGatewayTargetForbidden
+	}
+
+	metrics.Fire(metricsResultSuccess)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+	}, nil
+}
+
+func createMockEchoGatewayServer(t *testing.T) gatewayResource {
+	gateway := createGateway(t)
+	echoEncapHandler := DefaultEncapsulationHandler{
+		gateway:    gateway,
+		appHandler: EchoAppHandler{},
+	}
+	mockProtoHTTPFilterHandler := DefaultEncapsulationHandler{
+		gateway: gateway,
+		appHandler: ProtoHTTPAppHandler{
+			httpHandler: ForbiddenCheckHttpRequestHandler{
+				FORBIDDEN_TARGET,
+			},
+		},
+	}
+
+	encapHandlers := make(map[string]EncapsulationHandler)
+	encapHandlers[DefaultEchoEndpoint] = echoEncapHandler
+	encapHandlers[DefaultGatewayEndpoint] = mockProtoHTTPFilterHandler
+	encapHandlers[DefaultMetadataEndpoint] = MetadataEncapsulationHandler{gateway: gateway}
+	return gatewayResource{
+		gateway:               gateway,
+		encapsulationHandlers: encapHandlers,
+		debugResponse:         GATEWAY_DEBUG,
+		metricsFactory:        &MockMetricsFactory{},
+		contentType:           binaryHTTPRequestType,
+		logger:                defaultLogger(),
+	}
+}
+
+func TestLegacyConfigHandler(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+	config, err := target.gateway.Config(LEGACY_KEY_ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	marshalledConfig := config.Marshal()
+
+	handler := http.HandlerFunc(target.legacyConfigHandler)
+
+	request, err := http.NewRequest("GET", DefaultLegacyConfigEndpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatal(fmt.Errorf("Failed request with error code: %d", status))
+	}
+
+	body, err := ioutil.ReadAll(rr.Result().Body)
+	if err != nil {
+		t.Fatal("Failed to read body:", err)
+	}
+
+	if !bytes.Equal(body, marshalledConfig) {
+		t.Fatal("Received invalid config")
+	}
+
+	// checking correct header exists
+	// Cache-Control: max-age=%d, private
+	cctrl := rr.Header().Get("Cache-Control")
+
+	if strings.HasPrefix(cctrl, "max-age=") && strings.HasSuffix(cctrl, ", private") {
+		maxAge := strings.TrimPrefix(strings.TrimSuffix(cctrl, ", private"), "max-age=")
+		age, err := strconv.Atoi(maxAge)
+		if err != nil {
+			t.Fatal("max-age value should be int", err)
+		}
+		if age < twelveHours || age > twelveHours+twentyFourHours {
+			t.Fatal("age should be between 12 and 36 hours")
+		}
+	} else {
+		t.Fatal("Cache-Control format should be 'max-age=86400, private'")
+	}
+}
+
+func TestConfigHandler(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+	marshalledConfigs := target.gateway.MarshalConfigs()
+
+	handler := http.HandlerFunc(target.configHandler)
+	request, err := http.NewRequest("GET", DefaultConfigEndpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatal(fmt.Errorf("Failed request with error code: %d", status))
+	}
+
+	body, err := ioutil.ReadAll(rr.Result().Body)
+	if err != nil {
+		t.Fatal("Failed to read body:", err)
+	}
+
+	if !bytes.Equal(body, marshalledConfigs) {
+		t.Fatal("Received invalid config")
+	}
+
+	// checking correct header exists
+	// Cache-Control: max-age=%d, private
+	cctrl := rr.Header().Get("Cache-Control")
+
+	if strings.HasPrefix(cctrl, "max-age=") && strings.HasSuffix(cctrl, ", private") {
+		maxAge := strings.TrimPrefix(strings.TrimSuffix(cctrl, ", private"), "max-age=")
+		age, err := strconv.Atoi(maxAge)
+		if err != nil {
+			t.Fatal("max-age value should be int", err)
+		}
+		if age < twelveHours || age > twelveHours+twentyFourHours {
+			t.Fatal("age should be between 12 and 36 hours")
+		}
+	} else {
+		t.Fatal("Cache-Control format should be 'max-age=86400, private'")
+	}
+}
+
+func testBodyContainsError(t *testing.T, resp *http.Response, expectedText string) {
+	body, err := io.ReadAll(resp.Body)
+	if err == nil {
+		if !strings.Contains(string(body), expectedText) {
+			t.Fatal(fmt.Errorf("Failed to return expected text (%s) in response. Body text is: %s",
+				expectedText, body))
+		}
+	}
+}
+
+func testMetricsContainsResult(t *testing.T, metricsCollector *MockMetricsFactory, event, result string) {
+	for _, metric := range metricsCollector.metrics {
+		if metric.eventName == event {
+			_, exists := metric.resultLabels[result]
+			if !exists {
+				t.Fatalf("Expected event %s/%s was not fired. resultLabels len=%d", event, result, len(metric.resultLabels))
+			} else {
+				return
+			}
+		}
+	}
+	t.Fatalf("Expected metric for event %s was not initialized", event)
+}
+
+func TestQueryHandlerChunkedContentType(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+
+	request := httptest.NewRequest(http.MethodPost, DefaultGatewayEndpoint, bytes.NewReader([]byte{0xCA, 0xFE}))
+	request.Header.Add("Content-Type", ohttpChunkedRequestContentType)
+
+	rr := httptest.NewRecorder()
+	target.gatewayHandler(rr, request)
+
+	if status := rr.Result().StatusCode; status != http.StatusBadRequest {
+		t.Fatalf("Expected chunked requests to be rejected with %d, got %d", http.StatusBadRequest, status)
+	}
+	testBodyContainsError(t, rr.Result(), "Invalid content type: "+ohttpChunkedRequestContentType)
+	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultInvalidContentType)
+}
+
+func TestQueryHandlerInvalidContentType(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+
+	handler := http.HandlerFunc(target.gatewayHandler)
+
+	request, err := http.NewRequest(http.MethodPost, DefaultGatewayEndpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Add("Content-Type", "application/not-the-droids-youre-looking-for")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	if status := rr.Result().StatusCode; status != http.StatusBadRequest {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusBadRequest, status))
+	}
+
+	testBodyContainsError(t, rr.Result(), "Invalid content type: application/not-the-droids-youre-looking-for")
+	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultInvalidContentType)
+}
+
+func TestLegacyGatewayHandler(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+
+	handler := http.HandlerFunc(target.gatewayHandler)
+
+	config, err := target.gateway.Config(LEGACY_KEY_ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := ohttp.NewDefaultClient(config)
+
+	testMessage := []byte{0xCA, 0xFE}
+	req, _, err := client.EncapsulateRequest(testMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, DefaultEchoEndpoint, bytes.NewReader(req.Marshal()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Add("Content-Type", "message/ohttp-req")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	if status := rr.Result().StatusCode; status != http.StatusOK {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusOK, status))
+	}
+	if rr.Result().Header.Get("Content-Type") != "message/ohttp-res" {
+		t.Fatal("Invalid content type response")
+	}
+
+	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultSuccess)
+}
+
+func TestGatewayHandler(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+
+	handler := http.HandlerFunc(target.gatewayHandler)
+
+	config, err := target.gateway.Config(CURRENT_KEY_ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := ohttp.NewDefaultClient(config)
+
+	testMessage := []byte{0xCA, 0xFE}
+	req, _, err := client.EncapsulateRequest(testMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, DefaultEchoEndpoint, bytes.NewReader(req.Marshal()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Add("Content-Type", "message/ohttp-req")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	if status := rr.Result().StatusCode; status != http.StatusOK {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusOK, status))
+	}
+	if rr.Result().Header.Get("Content-Type") != "message/ohttp-res" {
+		t.Fatal("Invalid content type response")
+	}
+
+	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultSuccess)
+}
+
+func TestGatewayHandlerWithInvalidMethod(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+
+	handler := http.HandlerFunc(target.gatewayHandler)
+
+	config, err := target.gateway.Config(CURRENT_KEY_ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := ohttp.NewDefaultClient(config)
+
+	testMessage := []byte{0xCA, 0xFE}
+	req, _, err := client.EncapsulateRequest(testMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := http.NewRequest(http.MethodGet, DefaultEchoEndpoint, bytes.NewReader(req.Marshal()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Add("Content-Type", "message/ohttp-req")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	if status := rr.Result().StatusCode; status != http.StatusBadRequest {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusBadRequest, status))
+	}
+
+	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultInvalidMethod)
+}
+
+func TestGatewayHandlerWithInvalidKey(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+
+	handler := http.HandlerFunc(target.gatewayHandler)
+
+	// Generate a new config that's different from the target's
+	privateConfig, err := ohttp.NewConfig(CURRENT_KEY_ID, hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM)
+	if err != nil {
+		t.Fatal("Failed to create a valid config. Exiting now.")
+	}
+	client := ohttp.NewDefaultClient(privateConfig.Config())
+
+	testMessage := []byte{0xCA, 0xFE}
+	req, _, err := client.EncapsulateRequest(testMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, DefaultEchoEndpoint, bytes.NewReader(req.Marshal()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Add("Content-Type", "message/ohttp-req")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	if status := rr.Result().StatusCode; status != http.StatusBadRequest {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusBadRequest, status))
+	}
+
+	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultDecapsulationFailed)
+}
+
+func TestGatewayHandlerWithUnknownKey(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+
+	handler := http.HandlerFunc(target.gatewayHandler)
+
+	// Generate a new config that's different from the target's in the key ID
+	privateConfig, err := ohttp.NewConfig(CURRENT_KEY_ID^0xFF, hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM)
+	if err != nil {
+		t.Fatal("Failed to create a valid config. Exiting now.")
+	}
+	client := ohttp.NewDefaultClient(privateConfig.Config())
+
+	testMessage := []byte{0xCA, 0xFE}
+	req, _, err := client.EncapsulateRequest(testMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, DefaultEchoEndpoint, bytes.NewReader(req.Marshal()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Add("Content-Type", "message/ohttp-req")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	if status := rr.Result().StatusCode; status != http.StatusUnauthorized {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusUnauthorized, status))
+	}
+
+	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultConfigurationMismatch)
+	metrics := mustGetMetricsFactory(t, target).metrics[0]
+	if metrics.tags[metricsTagKeyID] != metricsTagValueUnknown || metrics.tags[metricsTagKEM] != metricsTagValueUnknown {
+		t.Fatalf("Expected unknown key configuration labels, got %v", metrics.tags)
+	}
+}
+
+func TestGatewayHandlerMetricsDimensions(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+
+	handler := http.HandlerFunc(target.gatewayHandler)
+
+	config, err := target.gateway.Config(CURRENT_KEY_ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := ohttp.NewDefaultClient(config)
+
+	req, _, err := client.EncapsulateRequest([]byte{0xCA, 0xFE})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, DefaultMetadataEndpoint, bytes.NewReader(req.Marshal()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Add("Content-Type", "message/ohttp-req")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	if status := rr.Result().StatusCode; status != http.StatusOK {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusOK, status))
+	}
+
+	metrics := mustGetMetricsFactory(t, target).metrics[0]
+	expectedTags := map[string]string{
+		metricsTagKeyID:       strconv.Itoa(int(CURRENT_KEY_ID)),
+		metricsTagKEM:         "x25519_kyber768",
+		metricsTagContentType: binaryHTTPRequestType,
+	}
+	for name, value := range expectedTags {
+		if metrics.tags[name] != value {
+			t.Fatalf("Expected tag %s to be %q, got %q", name, value, metrics.tags[name])
+		}
+	}
+	expectedSizes := map[string]int{
+		// The Kyber768 encapsulated key alone is over a kilobyte
+		metricsMessageEncapsulatedRequest: 4 << 10,
+		metricsMessageRequest:             256,
+	}
+	for name, size := range expectedSizes {
+		if metrics.sizes[name] != size {
+			t.Fatalf("Expected size of %s to be %d, got %d", name, size, metrics.sizes[name])
+		}
+	}
+	for _, name := range []string{metricsMessageResponse, metricsMessageEncapsulatedResponse} {
+		if _, ok := metrics.sizes[name]; !ok {
+			t.Fatalf("Expected size of %s to be reported", name)
+		}
+	}
+}
+
+func TestGatewayHandlerWithCorruptContent(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+
+	handler := http.HandlerFunc(target.gatewayHandler)
+
+	config, err := target.gateway.Config(CURRENT_KEY_ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := ohttp.NewDefaultClient(config)
+
+	// Corrupt the message
+	testMessage := []byte{0xCA, 0xFE}
+	req, _, err := client.EncapsulateRequest(testMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqEnc := req.Marshal()
+	reqEnc[len(reqEnc)-1] ^= 0xFF
+
+	request, err := http.NewRequest(http.MethodPost, DefaultEchoEndpoint, bytes.NewReader(reqEnc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Add("Content-Type", "message/ohttp-req")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	if status := rr.Result().StatusCode; status != http.StatusBadRequest {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusBadRequest, status))
+	}
+
+	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultDecapsulationFailed)
+}
+
+func TestGatewayHandlerProtoHTTPRequestWithForbiddenTarget(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+
+	handler := http.HandlerFunc(target.gatewayHandler)
+
+	config, err := target.gateway.Config(CURRENT_KEY_ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := ohttp.NewDefaultClient(config)
+
+	httpRequest, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s%s", FORBIDDEN_TARGET, DefaultGatewayEndpoint), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	binaryRequest, err := requestToProtoHTTP(httpRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encodedRequest, err := proto.Marshal(binaryRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, context, err := client.EncapsulateRequest(encodedRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqEnc := req.Marshal()
+
+	request, err := http.NewRequest(http.MethodPost, DefaultGatewayEndpoint, bytes.NewReader(reqEnc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Add("Content-Type", "message/ohttp-req")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	if status := rr.Result().StatusCode; status != http.StatusOK {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusOK, status))
+	}
+
+	bodyBytes, err := ioutil.ReadAll(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encapResp, err := ohttp.UnmarshalEncapsulatedResponse(bodyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	binaryResp, err := context.DecapsulateResponse(encapResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := &Response{}
+	if err := proto.Unmarshal(binaryResp, resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatal(fmt.Errorf("Encapsulated result did not yield %d, got %d instead", http.StatusForbidden, resp.StatusCode))
+	}
+
+	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultTargetRequestForbidden)
+}
+
+func TestGatewayHandlerProtoHTTPRequestWithAllowedTarget(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+
+	handler := http.HandlerFunc(target.gatewayHandler)
+
+	config, err := target.gateway.Config(CURRENT_KEY_ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := ohttp.NewDefaultClient(config)
+
+	httpRequest, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s%s", ALLOWED_TARGET, DefaultGatewayEndpoint), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	binaryRequest, err := requestToProtoHTTP(httpRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encodedRequest, err := proto.Marshal(binaryRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, context, err := client.EncapsulateRequest(encodedRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqEnc := req.Marshal()
+
+	request, err := http.NewRequest(http.MethodPost, DefaultGatewayEndpoint, bytes.NewReader(reqEnc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Add("Content-Type", "message/ohttp-req")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	if status := rr.Result().StatusCode; status != http.StatusOK {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusOK, status))
+	}
+
+	if status := rr.Result().StatusCode; status != http.StatusOK {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusOK, status))
+	}
+
+	bodyBytes, err := ioutil.ReadAll(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encapResp, err := ohttp.UnmarshalEncapsulatedResponse(bodyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	binaryResp, err := context.DecapsulateResponse(encapResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := &Response{}
+	if err := proto.Unmarshal(binaryResp, resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(fmt.Errorf("Encapsulated result did not yield %d, got %d instead", http.StatusOK, resp.StatusCode))
+	}
+
+	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultSuccess)
+}
+
+func TestOpaqueForwardingAppHandler(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/x-telemetry" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(append([]byte("ack:"), body...))
+	}))
+	defer backend.Close()
+
+	handler := NewOpaqueForwardingAppHandler(backend.Client(), backend.URL, "application/x-telemetry")
+
+	var response bytes.Buffer
+	metrics := &MockMetrics{resultLabels: map[string]bool{}}
+	if err := handler.Handle(NewEncapsulatedChunkWriter(&response), []byte{0xCA, 0xFE}, metrics); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response.Bytes(), []byte{'a', 'c', 'k', ':', 0xCA, 0xFE}) {
+		t.Fatalf("Unexpected forwarded response: %x", response.Bytes())
+	}
+	if !metrics.resultLabels[metricsResultSuccess] {
+		t.Fatal("Expected success metrics result")
+	}
+
+	handler.contentType = "application/octet-stream"
+	metrics = &MockMetrics{resultLabels: map[string]bool{}}
+	if err := handler.Handle(NewEncapsulatedChunkWriter(&response), []byte{0xCA, 0xFE}, metrics); err != ErrGatewayInternalServer {
+		t.Fatalf("Expected %v for a failed backend response, got %v", ErrGatewayInternalServer, err)
+	}
+	if !metrics.resultLabels[metricsResultTargetRequestFailed] {
+		t.Fatal("Expected request failed metrics result")
+	}
+
+	handler.contentType = "application/x-telemetry"
+	handler.maxResponseSize = len("ack:")
+	response.Reset()
+	metrics = &MockMetrics{resultLabels: map[string]bool{}}
+	if err := handler.Handle(NewEncapsulatedChunkWriter(&response), []byte{0xCA, 0xFE}, metrics); !errors.Is(err, ErrGatewayInternalServer) {
+		t.Fatalf("Expected %v for an oversized backend response, got %v", ErrGatewayInternalServer, err)
+	}
+	if response.Len() != 0 {
+		t.Fatalf("Expected no partial response, got %x", response.Bytes())
+	}
+	if !metrics.resultLabels[metricsResultResponseTranslationFailed] {
+		t.Fatal("Expected response translation failed metrics result")
+	}
+}
+
+func TestGatewayHandlerOpaqueForwardingFailure(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+
+	target := createMockEchoGatewayServer(t)
+	target.encapsulationHandlers[DefaultGatewayEndpoint] = DefaultEncapsulationHandler{
+		gateway:    target.gateway,
+		appHandler: NewOpaqueForwardingAppHandler(backend.Client(), backend.URL, "application/octet-stream"),
+	}
+	config, err := target.gateway.Config(CURRENT_KEY_ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _, err := ohttp.NewDefaultClient(config).EncapsulateRequest([]byte{0xCA, 0xFE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := httptest.NewRequest(http.MethodPost, DefaultGatewayEndpoint, bytes.NewReader(req.Marshal()))
+	request.Header.Add("Content-Type", ohttpRequestContentType)
+
+	// Opaque payloads cannot carry an error, so a failed backend fails the outer request
+	rr := httptest.NewRecorder()
+	target.gatewayHandler(rr, request)
+	if rr.Code != http.StatusBadRequest || rr.Header().Get("Content-Type") == ohttpResponseContentType {
+		t.Fatalf("Expected an unencapsulated %d response, got %d with content type %q", http.StatusBadRequest, rr.Code, rr.Header().Get("Content-Type"))
+	}
+	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultTargetRequestFailed)
+}
+
+func TestFilteredHttpRequestHandlerOriginLabels(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	origin := strings.TrimPrefix(server.URL, "http://")
+
+	for _, test := range []struct {
+		allowedOrigins map[string]bool
+		label          string
+	}{
+		{nil, metricsTagValueOther},
+		{map[string]bool{origin: true}, origin},
+		{map[string]bool{ALLOWED_TARGET: true}, metricsTagValueForbidden},
+	} {
+		handler := FilteredHttpRequestHandler{
+			client:         server.Client(),
+			allowedOrigins: test.allowedOrigins,
+		}
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metrics := &MockMetrics{resultLabels: map[string]bool{}}
+		resp, err := handler.Handle(req, metrics)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if metrics.tags[metricsTagOrigin] != test.label {
+			t.Fatalf("Expected origin label %q, got %q", test.label, metrics.tags[metricsTagOrigin])
+		}
+		if test.label != metricsTagValueForbidden && !metrics.resultLabels["target_response_status_204"] {
+			t.Fatalf("Expected the target status to be reported, got %v", metrics.resultLabels)
+		}
+	}
+}
+
+func TestFilteredHttpRequestHandlerTargetErrors(t *testing.T) {
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer tlsServer.Close()
+	slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer slowServer.Close()
+	closedServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closedServer.Close()
+
+	canceledContext, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, test := range []struct {
+		url       string
+		client    *http.Client
+		ctx       context.Context
+		errorType string
+		sentinel  error
+		result    string
+	}{
+		// The default client does not trust the test server certificate
+		{tlsServer.URL, &http.Client{}, context.Background(), targetErrorTLS, ErrGatewayTargetUnreachable, metricsResultTargetRequestFailed},
+		{slowServer.URL, &http.Client{Timeout: 10 * time.Millisecond}, context.Background(), targetErrorTimeout, ErrGatewayTargetTimeout, metricsResultTargetRequestFailed},
+		{closedServer.URL, &http.Client{}, context.Background(), targetErrorConnect, ErrGatewayTargetUnreachable, metricsResultTargetRequestFailed},
+		{slowServer.URL, &http.Client{}, canceledContext, targetErrorCanceled, ErrClientCanceled, metricsResultClientCanceled},
+	} {
+		handler := FilteredHttpRequestHandler{client: test.client}
+		req, err := http.NewRequestWithContext(test.ctx, http.MethodGet, test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metrics := &MockMetrics{resultLabels: map[string]bool{}}
+		_, err = handler.Handle(req, metrics)
+		if !errors.Is(err, test.sentinel) {
+			t.Fatalf("Expected the request to %s to fail with %v, got %v", test.url, test.sentinel, err)
+		}
+		var urlError *url.Error
+		if !errors.As(err, &urlError) {
+			t.Fatalf("Expected the cause of the error to be kept, got %v", err)
+		}
+		if metrics.tags[metricsTagTargetError] != test.errorType {
+			t.Fatalf("Expected error type %q for %s, got %q", test.errorType, test.url, metrics.tags[metricsTagTargetError])
+		}
+		if !metrics.resultLabels[test.result] {
+			t.Fatalf("Expected the %s metrics result, got %v", test.result, metrics.resultLabels)
+		}
+	}
+}
+
+func TestGatewayError(t *testing.T) {
+	cause := &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}
+	err := fmt.Errorf("fetching target: %w", newTargetError(cause))
+	if !errors.Is(err, ErrGatewayTargetUnreachable) || errors.Is(err, ErrGatewayInternalServer) {
+		t.Fatalf("Expected %v to only match its category", err)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("Expected %v to match its cause", err)
+	}
+	if errorCategory(err) != ErrorCategoryTargetUnreachable || errorCategory(cause) != ErrorCategoryInternal {
+		t.Fatal("Unexpected error categories")
+	}
+	if errors.Is(ErrGatewayTargetUnreachable, err) {
+		t.Fatal("Expected the sentinel error not to match an error with a cause")
+	}
+
+	for _, test := range []struct {
+		err    error
+		status int
+	}{
+		{ErrPayloadMarshalling, http.StatusBadRequest},
+		{fmt.Errorf("wrapped: %w", ErrGatewayTargetForbidden), http.StatusForbidden},
+		{ErrGatewayInternalServer, http.StatusInternalServerError},
+		{err, http.StatusBadGateway},
+		{newTargetError(context.DeadlineExceeded), http.StatusGatewayTimeout},
+		{newTargetError(context.Canceled), statusClientClosedRequest},
+		{errors.New("unexpected"), http.StatusBadRequest},
+	} {
+		if status := payloadErrorToPayloadStatusCode(test.err); status != test.status {
+			t.Errorf("Expected status %d for %v, got %d", test.status, test.err, status)
+		}
+	}
+	if status := ErrEncapsulationToGatewayStatusCode(fmt.Errorf("wrapped: %w", ErrConfigMismatch)); status != http.StatusUnauthorized {
+		t.Fatalf("Expected status %d for a wrapped configuration mismatch, got %d", http.StatusUnauthorized, status)
+	}
+}
+
+func TestTargetErrorType(t *testing.T) {
+	for _, test := range []struct {
+		err       error
+		errorType string
+	}{
+		{&url.Error{Op: "Get", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Name: "target.invalid"}}}, targetErrorDNS},
+		{&url.Error{Op: "Get", Err: &net.OpError{Op: "read", Err: syscall.ECONNRESET}}, targetErrorReset},
+		{&url.Error{Op: "Get", Err: io.EOF}, targetErrorReset},
+		{&url.Error{Op: "Get", Err: context.Canceled}, targetErrorCanceled},
+		{errors.New("unexpected"), targetErrorOther},
+	} {
+		if errorType := targetErrorType(test.err); errorType != test.errorType {
+			t.Errorf("Expected error type %q for %v, got %q", test.errorType, test.err, errorType)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	config, err := ohttp.NewConfig(CURRENT_KEY_ID, hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyConfig, err := ohttp.NewConfig(LEGACY_KEY_ID, hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := New(); err == nil {
+		t.Fatal("Expected a gateway without keys to be rejected")
+	}
+	if _, err := New(WithKeys(config, legacyConfig), WithContentTypes("message/a", "message/b")); err == nil {
+		t.Fatal("Expected custom content without an application handler to be rejected")
+	}
+
+	handler, err := New(
+		WithKeys(config, legacyConfig),
+		WithEndpoints(Endpoints{Gateway: "/relay/gateway", Config: "/relay/keys"}),
+		WithMetrics(&MockMetricsFactory{}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStatus := func(method, path string, expected int) *httptest.ResponseRecorder {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(method, path, nil))
+		if rr.Code != expected {
+			t.Fatalf("Expected %s %s to yield %d, got %d", method, path, expected, rr.Code)
+		}
+		return rr
+	}
+
+	rr := expectStatus(http.MethodGet, "/relay/keys", http.StatusOK)
+	configs := ohttp.NewDefaultGateway([]ohttp.PrivateConfig{config, legacyConfig}).MarshalConfigs()
+	if !bytes.Equal(rr.Body.Bytes(), configs) {
+		t.Fatal("Expected the key configurations of the gateway")
+	}
+	expectStatus(http.MethodGet, "/relay/gateway", http.StatusBadRequest)
+	expectStatus(http.MethodGet, DefaultConfigEndpoint, http.StatusNotFound)
+	expectStatus(http.MethodGet, DefaultLegacyConfigEndpoint, http.StatusNotFound)
+	expectStatus(http.MethodPost, DefaultEchoEndpoint, http.StatusNotFound)
+}
+
+type failingHttpRequestHandler struct {
+	err  error
+	body io.Reader
+}
+
+// Handle fails the request with its error, or answers with a body that fails to be read if one
+// is set.
+func (h failingHttpRequestHandler) Handle(req *http.Request, metrics Metrics) (*http.Response, error) {
+	if h.body == nil {
+		metrics.Fire(metricsResultTargetRequestFailed)
+		return nil, h.err
+	}
+	metrics.Fire(metricsResultSuccess)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       io.NopCloser(h.body),
+	}, nil
+}
+
+func marshalBinaryRequest(t *testing.T, target string) []byte {
+	httpRequest, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://%s/", target), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binaryRequest := ohttp.BinaryRequest(*httpRequest)
+	encodedRequest, err := binaryRequest.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encodedRequest
+}
+
+func TestGatewayHandlerBinaryHTTPPayloadErrors(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		httpHandler HttpRequestHandler
+		content     []byte
+		status      int
+		category    ErrorCategory
+	}{
+		{"forbidden target", ForbiddenCheckHttpRequestHandler{FORBIDDEN_TARGET}, marshalBinaryRequest(t, FORBIDDEN_TARGET), http.StatusForbidden, ErrorCategoryTargetForbidden},
+		{"failed target request", failingHttpRequestHandler{err: errors.New("unexpected")}, marshalBinaryRequest(t, ALLOWED_TARGET), http.StatusInternalServerError, ErrorCategoryInternal},
+		{"unreachable target", failingHttpRequestHandler{err: newTargetError(&net.DNSError{Name: ALLOWED_TARGET})}, marshalBinaryRequest(t, ALLOWED_TARGET), http.StatusBadGateway, ErrorCategoryTargetUnreachable},
+		{"target timeout", failingHttpRequestHandler{err: newTargetError(context.DeadlineExceeded)}, marshalBinaryRequest(t, ALLOWED_TARGET), http.StatusGatewayTimeout, ErrorCategoryTargetTimeout},
+		{"invalid binary HTTP", ForbiddenCheckHttpRequestHandler{FORBIDDEN_TARGET}, []byte{0xCA, 0xFE}, http.StatusBadRequest, ErrorCategoryPayload},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			target := createMockEchoGatewayServer(t)
+			target.encapsulationHandlers[DefaultGatewayEndpoint] = DefaultEncapsulationHandler{
+				gateway:    target.gateway,
+				appHandler: BinaryHTTPAppHandler{httpHandler: test.httpHandler},
+			}
+
+			config, err := target.gateway.Config(CURRENT_KEY_ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, context, err := ohttp.NewDefaultClient(config).EncapsulateRequest(test.content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			request, err := http.NewRequest(http.MethodPost, DefaultGatewayEndpoint, bytes.NewReader(req.Marshal()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.Header.Add("Content-Type", ohttpRequestContentType)
+
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(target.gatewayHandler).ServeHTTP(rr, request)
+
+			// The relay must not learn how the encapsulated request was handled
+			if status := rr.Result().StatusCode; status != http.StatusOK {
+				t.Fatalf("Result did not yield %d, got %d instead", http.StatusOK, status)
+			}
+			if contentType := rr.Result().Header.Get("Content-Type"); contentType != ohttpResponseContentType {
+				t.Fatalf("Expected content type %s, got %s", ohttpResponseContentType, contentType)
+			}
+
+			encapResp, err := ohttp.UnmarshalEncapsulatedResponse(rr.Body.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			binaryResp, err := context.DecapsulateResponse(encapResp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := ohttp.UnmarshalBinaryResponse(binaryResp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != test.status {
+				t.Fatalf("Encapsulated result did not yield %d, got %d instead", test.status, resp.StatusCode)
+			}
+
+			metricsFactory := mustGetMetricsFactory(t, target)
+			testMetricsContainsResult(t, metricsFactory, metricsEventGatewayRequest, metricsPayloadStatusPrefix+strconv.Itoa(test.status))
+			if category := metricsFactory.metrics[0].tags[metricsTagErrorCategory]; category != string(test.category) {
+				t.Fatalf("Expected error category %q, got %q", test.category, category)
+			}
+		})
+	}
+}
+
+func TestBinaryHTTPAppHandlerStreamedErrors(t *testing.T) {
+	var content bytes.Buffer
+	handler := BinaryHTTPAppHandler{httpHandler: ForbiddenCheckHttpRequestHandler{FORBIDDEN_TARGET}}
+	metrics := &MockMetrics{resultLabels: map[string]bool{}}
+	if err := handler.Handle(NewEncapsulatedChunkWriter(&content), marshalBinaryRequest(t, FORBIDDEN_TARGET), metrics); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ohttp.UnmarshalBinaryResponse(content.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected status %d, got %d", http.StatusForbidden, resp.StatusCode)
+	}
+
+	// Once the response has started, an error response can no longer be written
+	content.Reset()
+	handler = BinaryHTTPAppHandler{httpHandler: failingHttpRequestHandler{body: iotest.ErrReader(syscall.ECONNRESET)}}
+	metrics = &MockMetrics{resultLabels: map[string]bool{}}
+	e := NewEncapsulatedChunkWriter(&content)
+	if err := handler.Handle(e, marshalBinaryRequest(t, ALLOWED_TARGET), metrics); err != ErrPayloadMarshalling {
+		t.Fatalf("Expected %v, got %v", ErrPayloadMarshalling, err)
+	}
+	if e.Written() == 0 || !metrics.resultLabels[metricsResultContentEncodingFailed] {
+		t.Fatalf("Expected a failure after the response started, got %d bytes and %v", e.Written(), metrics.resultLabels)
+	}
+}
+
+func TestProtoHTTPAppHandlerErrors(t *testing.T) {
+	httpRequest, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://%s/", ALLOWED_TARGET), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	protoRequest, err := requestToProtoHTTP(httpRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedRequest, err := proto.Marshal(protoRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name        string
+		httpHandler HttpRequestHandler
+		content     []byte
+		status      int
+	}{
+		{"invalid protobuf", ForbiddenCheckHttpRequestHandler{FORBIDDEN_TARGET}, []byte{0xFF}, http.StatusBadRequest},
+		{"target timeout", failingHttpRequestHandler{err: newTargetError(context.DeadlineExceeded)}, encodedRequest, http.StatusGatewayTimeout},
+	} {
+		var content bytes.Buffer
+		handler := ProtoHTTPAppHandler{httpHandler: test.httpHandler}
+		metrics := &MockMetrics{resultLabels: map[string]bool{}}
+		if err := handler.Handle(NewEncapsulatedChunkWriter(&content), test.content, metrics); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		resp := &Response{}
+		if err := proto.Unmarshal(content.Bytes(), resp); err != nil {
+			t.Fatal(err)
+		}
+		if int(resp.StatusCode) != test.status {
+			t.Fatalf("%s: expected status %d, got %d", test.name, test.status, resp.StatusCode)
+		}
+		if result := fmt.Sprintf("%s_response_status_%d", metricsPayloadStatusPrefix, test.status); !metrics.resultLabels[result] {
+			t.Fatalf("%s: expected the %s metrics result, got %v", test.name, result, metrics.resultLabels)
+		}
+	}
+}
+
+type failingAppHandler struct {
+	err error
+}
+
+func (h failingAppHandler) Handle(e *EncapsulatedChunkWriter, binaryRequest []byte, metrics Metrics) error {
+	return h.err
+}
+
+func TestGatewayHandlerLogsRedactedErrors(t *testing.T) {
+	var logs bytes.Buffer
+	target := createMockEchoGatewayServer(t)
+	target.logger = slog.New(NewRedactingHandler(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}), false))
+	targetURL := "https://" + ALLOWED_TARGET + "/private"
+	target.encapsulationHandlers[DefaultGatewayEndpoint] = DefaultEncapsulationHandler{
+		gateway:    target.gateway,
+		appHandler: failingAppHandler{err: newTargetError(&url.Error{Op: "Get", URL: targetURL, Err: errors.New("connection refused")})},
+	}
+
+	config, err := target.gateway.Config(CURRENT_KEY_ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _, err := ohttp.NewDefaultClient(config).EncapsulateRequest(marshalBinaryRequest(t, ALLOWED_TARGET))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := httptest.NewRequest(http.MethodPost, DefaultGatewayEndpoint, bytes.NewReader(req.Marshal()))
+	request.Header.Add("Content-Type", ohttpRequestContentType)
+	target.gatewayHandler(httptest.NewRecorder(), request)
+
+	if strings.Contains(logs.String(), "/private") {
+		t.Fatalf("Expected the target URL to be redacted from:\n%s", logs.String())
+	}
+	if !strings.Contains(logs.String(), LogKeyErrorDetail+"="+redactedLogValue) {
+		t.Fatalf("Expected the redacted error to be logged, got:\n%s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "error_category=internal") {
+		t.Fatalf("Expected the error category to be logged, got:\n%s", logs.String())
+	}
+}
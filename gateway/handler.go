@@ -0,0 +1,575 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/chris-wood/ohttp-go"
+	"google.golang.org/protobuf/proto"
+)
+
+// EncapsulationFail is called when the gateway is unable to decapsulate the request or unable to encapsulate the response. Leads to 401 or 400 on gateway level
+func EncapsulationFail(err error) (ohttp.EncapsulatedResponse, error) {
+	return ohttp.EncapsulatedResponse{}, err
+}
+
+const (
+	// Metrics constants
+	metricsResultConfigurationMismatch     = "config_mismatch"
+	metricsResultDecapsulationFailed       = "decapsulation_failed"
+	metricsResultEncapsulationFailed       = "encapsulation_failed"
+	metricsResultContentDecodingFailed     = "content_decode_failed"
+	metricsResultContentEncodingFailed     = "content_encode_failed"
+	metricsResultRequestTranslationFailed  = "request_translate_failed"
+	metricsResultResponseTranslationFailed = "response_translate_failed"
+	metricsResultTargetRequestForbidden    = "request_forbidden"
+	metricsResultTargetRequestFailed       = "request_failed"
+	metricsResultClientCanceled            = "client_canceled"
+	metricsResultSuccess                   = "success"
+	metricsPayloadStatusPrefix             = "gateway_payload"
+	metricsTargetStatusPrefix              = "target"
+
+	// Labels of target requests. Origins are only used as labels if they are allowed, since
+	// clients choose the targets of their requests.
+	metricsTagOrigin         = "origin"
+	metricsTagTargetError    = "target_error"
+	metricsTagErrorCategory  = "error_category"
+	metricsTagValueOther     = "other"
+	metricsTagValueForbidden = "forbidden"
+
+	// Types of target request errors
+	targetErrorDNS      = "dns"
+	targetErrorConnect  = "connect"
+	targetErrorTLS      = "tls"
+	targetErrorTimeout  = "timeout"
+	targetErrorReset    = "reset"
+	targetErrorCanceled = "canceled"
+	targetErrorOther    = "other"
+)
+
+// targetErrorType classifies the error of a target request for metrics.
+func targetErrorType(err error) string {
+	var dnsError *net.DNSError
+	var opError *net.OpError
+	var netError net.Error
+	var recordHeaderError tls.RecordHeaderError
+	var verificationError *tls.CertificateVerificationError
+	var unknownAuthorityError x509.UnknownAuthorityError
+	var certificateInvalidError x509.CertificateInvalidError
+	var hostnameError x509.HostnameError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return targetErrorCanceled
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netError) && netError.Timeout():
+		return targetErrorTimeout
+	case errors.As(err, &dnsError):
+		return targetErrorDNS
+	case errors.As(err, &recordHeaderError), errors.As(err, &verificationError),
+		errors.As(err, &unknownAuthorityError), errors.As(err, &certificateInvalidError),
+		errors.As(err, &hostnameError):
+		return targetErrorTLS
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE), errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		return targetErrorReset
+	case errors.As(err, &opError) && opError.Op == "dial":
+		return targetErrorConnect
+	default:
+		return targetErrorOther
+	}
+}
+
+// EncapsulationHandler handles OHTTP encapsulated requests and produces OHTTP encapsulated responses.
+type EncapsulationHandler interface {
+	// Handle processes an OHTTP encapsulated request and produces an OHTTP encapsulated response, or an error
+	// if any part of the encapsulation or decapsulation process fails.
+	Handle(outerRequest *http.Request, encapRequest ohttp.EncapsulatedRequest, metrics Metrics) (ohttp.EncapsulatedResponse, error)
+}
+
+// DefaultEncapsulationHandler is an EncapsulationHandler that uses a default OHTTP gateway to decapsulate
+// requests, pass them to an AppContentHandler to produce a response for encapsulation, and encapsulates the
+// response.
+type DefaultEncapsulationHandler struct {
+	gateway    ohttp.Gateway
+	appHandler AppContentHandler
+}
+
+// Handle attempts to decapsulate the incoming encapsulated request and, if successful, passes the
+// corresponding application payload to the AppContentHandler for producing a response to encapsulate
+// and return.
+func (h DefaultEncapsulationHandler) Handle(outerRequest *http.Request, encapsulatedReq ohttp.EncapsulatedRequest, metrics Metrics) (ohttp.EncapsulatedResponse, error) {
+	if !h.gateway.MatchesConfig(encapsulatedReq) {
+		metrics.Fire(metricsResultConfigurationMismatch)
+		return EncapsulationFail(ErrConfigMismatch)
+	}
+
+	startedAt := time.Now()
+	binaryRequest, context, err := h.gateway.DecapsulateRequest(encapsulatedReq)
+	metrics.Phase(metricsPhaseDecapsulate, time.Since(startedAt))
+	if err != nil {
+		metrics.Fire(metricsResultDecapsulationFailed)
+		return EncapsulationFail(ErrEncapsulation)
+	}
+	metrics.MessageSize(metricsMessageRequest, messageSizeBucket(len(binaryRequest)))
+
+	// The response is encapsulated as a single message, so the content is buffered
+	var binaryResponse bytes.Buffer
+	startedAt = time.Now()
+	err = h.appHandler.Handle(NewEncapsulatedChunkWriter(&binaryResponse), binaryRequest, metrics)
+	metrics.Phase(metricsPhaseAppHandler, time.Since(startedAt))
+	if err != nil {
+		return EncapsulationFail(err)
+	}
+
+	metrics.MessageSize(metricsMessageResponse, messageSizeBucket(binaryResponse.Len()))
+	startedAt = time.Now()
+	encapsulatedResponse, err := context.EncapsulateResponse(binaryResponse.Bytes())
+	metrics.Phase(metricsPhaseEncapsulate, time.Since(startedAt))
+	if err != nil {
+		metrics.Fire(metricsResultEncapsulationFailed)
+		return EncapsulationFail(ErrEncapsulation)
+	}
+
+	return encapsulatedResponse, nil
+}
+
+// MetadataEncapsulationHandler is an EncapsulationHandler that uses a default OHTTP gateway to decapsulate
+// requests and return metadata about the encapsulated request context as an encapsulated response. Metadata
+// includes, for example, the list of headers carried on the encapsulated request from the client or relay.
+type MetadataEncapsulationHandler struct {
+	gateway ohttp.Gateway
+}
+
+// Handle attempts to decapsulate the incoming encapsulated request and, if successful, foramts
+// metadata from the request context, and then encapsulates and returns the result.
+func (h MetadataEncapsulationHandler) Handle(outerRequest *http.Request, encapsulatedReq ohttp.EncapsulatedRequest, metrics Metrics) (ohttp.EncapsulatedResponse, error) {
+	if !h.gateway.MatchesConfig(encapsulatedReq) {
+		metrics.Fire(metricsResultConfigurationMismatch)
+		return EncapsulationFail(ErrConfigMismatch)
+	}
+
+	startedAt := time.Now()
+	binaryRequest, context, err := h.gateway.DecapsulateRequest(encapsulatedReq)
+	metrics.Phase(metricsPhaseDecapsulate, time.Since(startedAt))
+	if err != nil {
+		metrics.Fire(metricsResultDecapsulationFailed)
+		return EncapsulationFail(ErrEncapsulation)
+	}
+	metrics.MessageSize(metricsMessageRequest, messageSizeBucket(len(binaryRequest)))
+
+	// XXX(caw): maybe also include the encapsulated request and its plaintext form too?
+	binaryResponse, err := httputil.DumpRequest(outerRequest, false)
+	if err != nil {
+		// Note: we don't record an event for this as it's not necessary to track
+		return EncapsulationFail(ErrGatewayInternalServer)
+	}
+
+	metrics.MessageSize(metricsMessageResponse, messageSizeBucket(len(binaryResponse)))
+	startedAt = time.Now()
+	encapsulatedResponse, err := context.EncapsulateResponse(binaryResponse)
+	metrics.Phase(metricsPhaseEncapsulate, time.Since(startedAt))
+	if err != nil {
+		metrics.Fire(metricsResultEncapsulationFailed)
+		return EncapsulationFail(ErrEncapsulation)
+	}
+
+	metrics.Fire(metricsResultSuccess)
+	return encapsulatedResponse, nil
+}
+
+// AppContentHandler processes application-specific request content and produces response content.
+type AppContentHandler interface {
+	Handle(e *EncapsulatedChunkWriter, binaryRequest []byte, metrics Metrics) error
+}
+
+// EchoAppHandler is an AppContentHandler that returns the application request as the response.
+type EchoAppHandler struct{}
+
+// Handle writes the input request as the response.
+func (h EchoAppHandler) Handle(e *EncapsulatedChunkWriter, binaryRequest []byte, metrics Metrics) error {
+	if _, err := e.Write(binaryRequest); err != nil {
+		metrics.Fire(metricsResultContentEncodingFailed)
+		return err
+	}
+	metrics.Fire(metricsResultSuccess)
+	return nil
+}
+
+// ProtoHTTPAppHandler is an AppContentHandler that parses the application request as
+// a protobuf-based HTTP request for resolution with an HttpRequestHandler. The codec selects the
+// version of the encoding, which is version 1 if unset.
+type ProtoHTTPAppHandler struct {
+	httpHandler HttpRequestHandler
+	codec       protoHTTPCodec
+}
+
+func (h ProtoHTTPAppHandler) protoCodec() protoHTTPCodec {
+	if h.codec == nil {
+		return protoHTTPV1Codec{}
+	}
+	return h.codec
+}
+
+// wrappedError writes a protobuf-based HTTP response with the status of the category of a payload
+// error, in the same format as successful responses. Once content has been written, another
+// response cannot be, so the error is returned instead.
+func (h ProtoHTTPAppHandler) wrappedError(e *EncapsulatedChunkWriter, err error, metrics Metrics) error {
+	if e.Written() > 0 {
+		return err
+	}
+	status := payloadErrorToPayloadStatusCode(err)
+	category := errorCategory(err)
+	// The cause is left out, since it may describe the network of the gateway
+	resp := h.protoCodec().errorResponse(status, []byte(errorCategories[category].message))
+	respEnc, marshalErr := proto.Marshal(resp)
+	if marshalErr != nil {
+		return err
+	}
+	if _, writeErr := e.Write(respEnc); writeErr != nil {
+		return writeErr
+	}
+	metrics.Tag(metricsTagErrorCategory, string(category))
+	metrics.ResponseStatus(metricsPayloadStatusPrefix, status)
+	return nil
+}
+
+// Handle attempts to parse the application payload as a protobuf-based HTTP request and, if successful,
+// translates the result into an equivalent http.Request object to be processed by the handler's HttpRequestHandler.
+// The http.Response result from the handler is then translated back into an equivalent protobuf-based HTTP
+// response and written to the caller.
+func (h ProtoHTTPAppHandler) Handle(e *EncapsulatedChunkWriter, binaryRequest []byte, metrics Metrics) error {
+	codec := h.protoCodec()
+	req := codec.newRequest()
+	if err := proto.Unmarshal(binaryRequest, req); err != nil {
+		metrics.Fire(metricsResultContentDecodingFailed)
+		return h.wrappedError(e, ErrPayloadMarshalling, metrics)
+	}
+
+	httpRequest, err := codec.toHTTPRequest(req)
+	if err != nil {
+		metrics.Fire(metricsResultRequestTranslationFailed)
+		return h.wrappedError(e, ErrPayloadMarshalling, metrics)
+	}
+
+	httpResponse, err := h.httpHandler.Handle(httpRequest, metrics)
+	if err != nil {
+		// Return the status of the category of the error, such as 403 (Forbidden) in the event
+		// the client request was for a Target not on the allow list
+		var gatewayError *GatewayError
+		if !errors.As(err, &gatewayError) {
+			err = &GatewayError{Category: ErrorCategoryInternal, Cause: err}
+		}
+		return h.wrappedError(e, err, metrics)
+	}
+
+	protoResponse, err := codec.fromHTTPResponse(httpRequest, httpResponse)
+	if err != nil {
+		metrics.Fire(metricsResultResponseTranslationFailed)
+		return h.wrappedError(e, ErrPayloadMarshalling, metrics)
+	}
+
+	marshalledProtoResponse, err := proto.Marshal(protoResponse)
+	if err != nil {
+		metrics.Fire(metricsResultContentEncodingFailed)
+		return h.wrappedError(e, ErrPayloadMarshalling, metrics)
+	}
+	if _, err := e.Write(marshalledProtoResponse); err != nil {
+		return err
+	}
+	metrics.Fire(metricsPayloadStatusPrefix + "200")
+	return nil
+}
+
+// BinaryHTTPAppHandler is an AppContentHandler that parses the application request as
+// a binary HTTP request for resolution with an HttpRequestHandler.
+type BinaryHTTPAppHandler struct {
+	httpHandler HttpRequestHandler
+}
+
+// wrappedError writes a binary HTTP response with the status of the category of a payload error,
+// so that the error is encapsulated rather than revealed to the relay by the status of the outer
+// response. Once content has been written, another response cannot be, so the error is returned
+// instead.
+func (h BinaryHTTPAppHandler) wrappedError(e *EncapsulatedChunkWriter, err error, metrics Metrics) error {
+	if e.Written() > 0 {
+		return err
+	}
+	category := errorCategory(err)
+	status := payloadErrorToPayloadStatusCode(err)
+	resp := &http.Response{
+		StatusCode: status,
+		Header:     http.Header{},
+		// The cause is left out, since it may describe the network of the gateway
+		Body: io.NopCloser(bytes.NewBufferString(errorCategories[category].message)),
+	}
+	if encodeErr := NewBinaryResponseEncoder(e).Encode(resp); encodeErr != nil {
+		return err
+	}
+	metrics.Tag(metricsTagErrorCategory, string(category))
+	metrics.Fire(metricsPayloadStatusPrefix + strconv.Itoa(status))
+	return nil
+}
+
+// Handle attempts to parse the application payload as a binary HTTP request and, if successful,
+// translates the result into an equivalent http.Request object to be processed by the handler's HttpRequestHandler.
+// The http.Response result from the handler is then translated back into an equivalent binary HTTP
+// response and returned to the caller.
+func (h BinaryHTTPAppHandler) Handle(e *EncapsulatedChunkWriter, binaryRequest []byte, metrics Metrics) error {
+	req, err := ohttp.UnmarshalBinaryRequest(binaryRequest)
+	if err != nil {
+		metrics.Fire(metricsResultContentDecodingFailed)
+		return h.wrappedError(e, ErrPayloadMarshalling, metrics)
+	}
+
+	resp, err := h.httpHandler.Handle(req, metrics)
+	if err != nil {
+		// Return the status of the category of the error, such as 403 (Forbidden) in the event
+		// the client request was for a Target not on the allow list
+		var gatewayError *GatewayError
+		if !errors.As(err, &gatewayError) {
+			err = &GatewayError{Category: ErrorCategoryInternal, Cause: err}
+		}
+		return h.wrappedError(e, err, metrics)
+	}
+	defer resp.Body.Close()
+
+	if err := NewBinaryResponseEncoder(e).Encode(resp); err != nil {
+		metrics.Fire(metricsResultContentEncodingFailed)
+		return h.wrappedError(e, ErrPayloadMarshalling, metrics)
+	}
+
+	metrics.Fire(metricsPayloadStatusPrefix + "200")
+	return nil
+}
+
+// OpaqueForwardingAppHandler is an AppContentHandler that treats the application request as an
+// opaque payload for a single backend service. The payload is sent as the body of a POST request
+// to the backend, and the body of the backend's response, up to maxOpaqueResponseSize bytes, is
+// returned as the application response.
+type OpaqueForwardingAppHandler struct {
+	client          *http.Client
+	backendURL      string
+	contentType     string
+	maxResponseSize int
+}
+
+// NewOpaqueForwardingAppHandler creates an OpaqueForwardingAppHandler that forwards payloads to
+// backendURL with client, labelled with contentType.
+func NewOpaqueForwardingAppHandler(client *http.Client, backendURL, contentType string) OpaqueForwardingAppHandler {
+	return OpaqueForwardingAppHandler{
+		client:          client,
+		backendURL:      backendURL,
+		contentType:     contentType,
+		maxResponseSize: maxOpaqueResponseSize,
+	}
+}
+
+// Handle forwards the application payload to the backend and writes the backend's response body.
+// Responses with a non-2xx status are treated as failures, since an opaque payload has no way of
+// conveying a status to the client.
+//
+// Unlike the errors of the binary HTTP and protohttp handlers, failures of the backend are returned
+// rather than encapsulated, so they fail the outer request: an encapsulated error could not be told
+// apart from a response of the backend. The relay learns that the backend failed, but since there
+// is a single backend, configured rather than chosen by clients, nothing about the client request.
+func (h OpaqueForwardingAppHandler) Handle(e *EncapsulatedChunkWriter, binaryRequest []byte, metrics Metrics) error {
+	req, err := http.NewRequest(http.MethodPost, h.backendURL, bytes.NewReader(binaryRequest))
+	if err != nil {
+		metrics.Fire(metricsResultRequestTranslationFailed)
+		return ErrGatewayInternalServer
+	}
+	req.Header.Set("Content-Type", h.contentType)
+	// The backend is configured rather than chosen by clients, so it can always be a label
+	metrics.Tag(metricsTagOrigin, req.URL.Host)
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		metrics.Tag(metricsTagTargetError, targetErrorType(err))
+		metrics.Fire(metricsResultTargetRequestFailed)
+		return newTargetError(err)
+	}
+	defer resp.Body.Close()
+	metrics.ResponseStatus(metricsTargetStatusPrefix, resp.StatusCode)
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		metrics.Fire(metricsResultTargetRequestFailed)
+		return ErrGatewayInternalServer
+	}
+
+	// Read one byte past the limit to tell a response at the limit from a longer one
+	body, err := io.ReadAll(io.LimitReader(resp.Body, int64(h.maxResponseSize)+1))
+	if err != nil {
+		metrics.Fire(metricsResultResponseTranslationFailed)
+		return ErrGatewayInternalServer
+	}
+	if len(body) > h.maxResponseSize {
+		metrics.Fire(metricsResultResponseTranslationFailed)
+		return &GatewayError{
+			Category: ErrorCategoryInternal,
+			Cause:    fmt.Errorf("backend response exceeds %d bytes", h.maxResponseSize),
+		}
+	}
+	if _, err := e.Write(body); err != nil {
+		metrics.Fire(metricsResultResponseTranslationFailed)
+		return ErrGatewayInternalServer
+	}
+
+	metrics.Fire(metricsResultSuccess)
+	return nil
+}
+
+// HttpRequestHandler handles HTTP requests to produce responses.
+type HttpRequestHandler interface {
+	// Handle takes a http.Request and resolves it to produce a http.Response.
+	Handle(req *http.Request, metrics Metrics) (*http.Response, error)
+}
+
+// FilteredHttpRequestHandler represents a HttpRequestHandler that restricts
+// outbound HTTP requests to an allowed set of targets.
+type FilteredHttpRequestHandler struct {
+	client         *http.Client
+	allowedOrigins map[string]bool
+	logger         *slog.Logger
+	retryPolicy    *RetryPolicy
+	circuitBreaker *CircuitBreaker
+}
+
+// NewFilteredHttpRequestHandler creates a FilteredHttpRequestHandler sending requests with client
+// to the given origins (host and optional port), or to any origin if there are none.
+func NewFilteredHttpRequestHandler(client *http.Client, allowedOrigins []string, logger *slog.Logger) FilteredHttpRequestHandler {
+	h := FilteredHttpRequestHandler{
+		client: client,
+		logger: logger,
+	}
+	if len(allowedOrigins) > 0 {
+		h.allowedOrigins = make(map[string]bool)
+		for _, origin := range allowedOrigins {
+			h.allowedOrigins[origin] = true
+		}
+	}
+	return h
+}
+
+// Handle processes HTTP requests to targets that are permitted according to a list of
+// allowed targets.
+func (h FilteredHttpRequestHandler) Handle(req *http.Request, metrics Metrics) (*http.Response, error) {
+	metrics.Tag(metricsTagOrigin, h.originLabel(req.Host))
+	if h.allowedOrigins != nil {
+		_, ok := h.allowedOrigins[req.Host]
+		if !ok {
+			metrics.Fire(metricsResultTargetRequestForbidden)
+			if h.logger != nil {
+				// to allow clients to fix improper third party urls usage (e.g. to change URLs from our direct s3 refs to CDN)
+				h.logger.Debug("Target forbidden", LogKeyTargetOrigin, req.Host, LogKeyTargetURL, req.URL.String())
+			}
+			return nil, ErrGatewayTargetForbidden
+		}
+	}
+
+	if h.circuitBreaker != nil {
+		if allowed, openFor := h.circuitBreaker.Allow(req.Host); !allowed {
+			// Answer immediately rather than waiting on a target that is known to be failing
+			metrics.Fire(metricsResultTargetCircuitOpen)
+			return circuitOpenResponse(openFor), nil
+		}
+	}
+
+	startedAt := time.Now()
+	resp, err := h.retryPolicy.Do(h.client, req, metrics)
+	metrics.Phase(metricsPhaseTargetFetch, time.Since(startedAt))
+	if h.circuitBreaker != nil {
+		if err != nil && req.Context().Err() != nil {
+			// The client gave up, which says nothing about the target
+			h.circuitBreaker.Release(req.Host)
+		} else {
+			h.circuitBreaker.Record(req.Host, err != nil || isRetryableStatus(resp.StatusCode))
+		}
+	}
+	if err != nil {
+		targetError := newTargetError(err)
+		metrics.Tag(metricsTagTargetError, targetErrorType(err))
+		if targetError.Category == ErrorCategoryClientCanceled {
+			metrics.Fire(metricsResultClientCanceled)
+		} else {
+			metrics.Fire(metricsResultTargetRequestFailed)
+		}
+		return nil, targetError
+	}
+
+	metrics.ResponseStatus(metricsTargetStatusPrefix, resp.StatusCode)
+	metrics.Fire(metricsResultSuccess)
+	return resp, nil
+}
+
+// originLabel returns the metrics label of a target origin: the origin itself if it is allowed,
+// forbidden if it is not, and other if all origins are allowed.
+func (h FilteredHttpRequestHandler) originLabel(origin string) string {
+	switch {
+	case h.allowedOrigins == nil:
+		return metricsTagValueOther
+	case h.allowedOrigins[origin]:
+		return origin
+	default:
+		return metricsTagValueForbidden
+	}
+}
+
+// EncapsulatedChunkWriter is the writer of the content of a response to encapsulate, to which an
+// AppContentHandler writes its response.
+type EncapsulatedChunkWriter struct {
+	w       io.Writer
+	written int
+}
+
+// NewEncapsulatedChunkWriter creates an EncapsulatedChunkWriter writing content to w.
+func NewEncapsulatedChunkWriter(w io.Writer) *EncapsulatedChunkWriter {
+	return &EncapsulatedChunkWriter{
+		w: w,
+	}
+}
+
+func (e *EncapsulatedChunkWriter) Write(b []byte) (int, error) {
+	n, err := e.w.Write(b)
+	e.written += n
+	return n, err
+}
+
+// Written returns the number of bytes of content written so far.
+func (e *EncapsulatedChunkWriter) Written() int {
+	return e.written
+}
+
+func (e *EncapsulatedChunkWriter) Close() error {
+	return nil
+}
+
+type BinaryResponseEncoder struct {
+	w         io.Writer
+	ChunkSize int
+}
+
+func NewBinaryResponseEncoder(w io.Writer) *BinaryResponseEncoder {
+	return &BinaryResponseEncoder{
+		w:         w,
+		ChunkSize: 32 << 10,
+	}
+}
+
+func (e *BinaryResponseEncoder) Encode(res *http.Response) error {
+	bres := ohttp.CreateBinaryResponse(res)
+	return bres.Write(e.w)
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gateway
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+)
+
+// Keys of log attributes holding private data. Their values are redacted by the handlers created
+// with NewRedactingHandler, unless unredacted logging is enabled.
+const (
+	// LogKeySecret holds key material, such as the seed of the key configurations.
+	LogKeySecret = "secret"
+	// LogKeyClientIP holds the address of the client or relay that sent an outer request.
+	LogKeyClientIP = "client_ip"
+	// LogKeyTargetURL holds the URL of an encapsulated request.
+	LogKeyTargetURL = "target_url"
+	// LogKeyTargetOrigin holds the origin of an encapsulated request, which clients choose.
+	LogKeyTargetOrigin = "target_origin"
+	// LogKeyHeaders holds the headers of an encapsulated request.
+	LogKeyHeaders = "headers"
+	// LogKeyErrorDetail holds the text of an error of an encapsulated request, which can include
+	// its URL.
+	LogKeyErrorDetail = "error_detail"
+
+	// Key of the correlation ID of the log entries of a gateway request
+	logKeyRequestID = "request_id"
+
+	// Value logged instead of private data
+	redactedLogValue = "[REDACTED]"
+)
+
+var redactedLogKeys = map[string]bool{
+	LogKeySecret:       true,
+	LogKeyClientIP:     true,
+	LogKeyTargetURL:    true,
+	LogKeyTargetOrigin: true,
+	LogKeyHeaders:      true,
+	LogKeyErrorDetail:  true,
+}
+
+// RedactingHandler is a slog.Handler that replaces the values of attributes holding private data
+// before passing records to another handler. Private data must only be logged as attributes with
+// one of the LogKey keys, never in messages.
+type RedactingHandler struct {
+	next   slog.Handler
+	unsafe bool
+}
+
+// NewRedactingHandler creates a RedactingHandler passing redacted records to next. If unsafe is
+// set, records are passed unredacted, which exposes private data of clients in the logs.
+func NewRedactingHandler(next slog.Handler, unsafe bool) *RedactingHandler {
+	return &RedactingHandler{
+		next:   next,
+		unsafe: unsafe,
+	}
+}
+
+func (h *RedactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *RedactingHandler) Handle(ctx context.Context, record slog.Record) error {
+	if h.unsafe {
+		return h.next.Handle(ctx, record)
+	}
+	redacted := slog.NewRecord(record.Time, record.Level, record.Message, record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(redactLogAttr(attr))
+		return true
+	})
+	return h.next.Handle(ctx, redacted)
+}
+
+func (h *RedactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if !h.unsafe {
+		redacted := make([]slog.Attr, len(attrs))
+		for i, attr := range attrs {
+			redacted[i] = redactLogAttr(attr)
+		}
+		attrs = redacted
+	}
+	return &RedactingHandler{
+		next:   h.next.WithAttrs(attrs),
+		unsafe: h.unsafe,
+	}
+}
+
+func (h *RedactingHandler) WithGroup(name string) slog.Handler {
+	return &RedactingHandler{
+		next:   h.next.WithGroup(name),
+		unsafe: h.unsafe,
+	}
+}
+
+// redactLogAttr replaces the value of attr, or of the attributes in its group, if it holds private
+// data.
+func redactLogAttr(attr slog.Attr) slog.Attr {
+	if redactedLogKeys[attr.Key] {
+		return slog.String(attr.Key, redactedLogValue)
+	}
+	value := attr.Value.Resolve()
+	if value.Kind() != slog.KindGroup {
+		return attr
+	}
+	group := value.Group()
+	redacted := make([]any, len(group))
+	for i, groupAttr := range group {
+		redacted[i] = redactLogAttr(groupAttr)
+	}
+	return slog.Group(attr.Key, redacted...)
+}
+
+// defaultLogger returns a redacting logger writing to the default slog handler, for gateways
+// created without a logger.
+func defaultLogger() *slog.Logger {
+	return slog.New(NewRedactingHandler(slog.Default().Handler(), false))
+}
+
+// newRequestID returns a random correlation ID for the log entries of a request. It is not derived
+// from anything the client sent, so it cannot be used to link requests of a client.
+func newRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,46 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gateway
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRedactingHandler(t *testing.T) {
+	var output bytes.Buffer
+	logger := slog.New(NewRedactingHandler(slog.NewTextHandler(&output, nil), false))
+
+	logger.With(LogKeyClientIP, "192.0.2.1").Info("Handling request",
+		"method", "POST",
+		LogKeyTargetURL, "https://target.example/private",
+		slog.Group("inner", LogKeyHeaders, "Cookie: secret"),
+	)
+	for _, private := range []string{"192.0.2.1", "target.example", "Cookie"} {
+		if strings.Contains(output.String(), private) {
+			t.Fatalf("Expected %q to be redacted from:\n%s", private, output.String())
+		}
+	}
+	for _, expected := range []string{"method=POST", LogKeyTargetURL + "=" + redactedLogValue, "inner." + LogKeyHeaders + "=" + redactedLogValue} {
+		if !strings.Contains(output.String(), expected) {
+			t.Fatalf("Expected %q in:\n%s", expected, output.String())
+		}
+	}
+
+	output.Reset()
+	logger = slog.New(NewRedactingHandler(slog.NewTextHandler(&output, nil), true))
+	logger.Info("Handling request", LogKeyClientIP, "192.0.2.1")
+	if !strings.Contains(output.String(), "192.0.2.1") {
+		t.Fatalf("Expected unredacted output, got:\n%s", output.String())
+	}
+}
+
+func TestNewRequestID(t *testing.T) {
+	first, second := newRequestID(), newRequestID()
+	if len(first) != 16 || first == second {
+		t.Fatalf("Expected distinct random request IDs, got %q and %q", first, second)
+	}
+}
@@ -0,0 +1,175 @@
+package gateway
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/cloudflare/circl/hpke"
+)
+
+const (
+	// Phases of handling a request, whose latency is reported separately
+	metricsPhaseReadBody      = "read_body"
+	metricsPhaseDecapsulate   = "decapsulate"
+	metricsPhaseAppHandler    = "app_handler"
+	metricsPhaseTargetFetch   = "target_fetch"
+	metricsPhaseEncapsulate   = "encapsulate"
+	metricsPhaseWriteResponse = "write_response"
+
+	// Messages of a request, whose size is reported by bucket
+	metricsMessageEncapsulatedRequest  = "encapsulated_request"
+	metricsMessageEncapsulatedResponse = "encapsulated_response"
+	metricsMessageRequest              = "request"
+	metricsMessageResponse             = "response"
+
+	// Labels of gateway requests describing how they were encapsulated
+	metricsTagKeyID        = "key_id"
+	metricsTagKEM          = "kem"
+	metricsTagContentType  = "content_type"
+	metricsTagValueUnknown = "unknown"
+)
+
+// MessageSizeBuckets are the upper bounds, in bytes, of the buckets that message sizes are reported
+// in. Sizes are never reported exactly, so that metrics cannot be used to fingerprint requests.
+// Sizes above the largest bound are rounded up to a multiple of it.
+var MessageSizeBuckets = []int{256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20}
+
+// messageSizeBucket returns the upper bound of the bucket of a message of the given size.
+func messageSizeBucket(size int) int {
+	for _, bound := range MessageSizeBuckets {
+		if size <= bound {
+			return bound
+		}
+	}
+	largest := MessageSizeBuckets[len(MessageSizeBuckets)-1]
+	return (size + largest - 1) / largest * largest
+}
+
+// Names of the KEMs that key configurations may use, as used in metrics labels
+// Names of KEMs, which are the same in configuration, logs and metric labels
+var kemNames = map[hpke.KEM]string{
+	hpke.KEM_P256_HKDF_SHA256:        "p256",
+	hpke.KEM_P384_HKDF_SHA384:        "p384",
+	hpke.KEM_P521_HKDF_SHA512:        "p521",
+	hpke.KEM_X25519_HKDF_SHA256:      "x25519",
+	hpke.KEM_X448_HKDF_SHA512:        "x448",
+	hpke.KEM_X25519_KYBER768_DRAFT00: "x25519_kyber768",
+}
+
+// KEMName returns the name of kem, such as "x25519_kyber768", or its hex-encoded ID if it has
+// none.
+func KEMName(kem hpke.KEM) string {
+	if name, ok := kemNames[kem]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", uint16(kem))
+}
+
+type Metrics interface {
+	Fire(result string)
+	ResponseStatus(prefix string, status int)
+	// Tag adds a label to the results fired afterwards, such as the relay a request came from.
+	Tag(name, value string)
+	// Phase reports how long a phase of handling the event took, such as decapsulating the request.
+	Phase(name string, duration time.Duration)
+	// MessageSize reports the size of a message of the event, such as the encapsulated request. The
+	// size is the upper bound of its bucket in MessageSizeBuckets, never the exact size.
+	MessageSize(name string, size int)
+}
+
+type MetricsFactory interface {
+	Create(eventName string) Metrics
+}
+
+// noopMetrics discards all results, for gateways created without a MetricsFactory.
+type noopMetrics struct{}
+
+func (noopMetrics) Fire(result string)                        {}
+func (noopMetrics) ResponseStatus(prefix string, status int)  {}
+func (noopMetrics) Tag(name, value string)                    {}
+func (noopMetrics) Phase(name string, duration time.Duration) {}
+func (noopMetrics) MessageSize(name string, size int)         {}
+
+type noopMetricsFactory struct{}
+
+func (noopMetricsFactory) Create(eventName string) Metrics {
+	return noopMetrics{}
+}
+
+// MultiMetricsFactory reports every event to several metrics backends at once, for example while
+// migrating from one backend to another. A backend that panics is skipped for that call, and does
+// not prevent the event from being reported to the others.
+type MultiMetricsFactory struct {
+	factories []MetricsFactory
+	logger    *slog.Logger
+}
+
+// NewMultiMetricsFactory creates a MultiMetricsFactory reporting to every one of factories. Panics
+// of backends are logged with logger, which should be the logger of the gateway. If it is nil, they
+// are logged to the default slog handler.
+func NewMultiMetricsFactory(logger *slog.Logger, factories ...MetricsFactory) *MultiMetricsFactory {
+	if logger == nil {
+		logger = defaultLogger()
+	}
+	return &MultiMetricsFactory{
+		factories: factories,
+		logger:    logger,
+	}
+}
+
+func (f *MultiMetricsFactory) Create(eventName string) Metrics {
+	metrics := &multiMetrics{logger: f.logger}
+	for _, factory := range f.factories {
+		factory := factory
+		recoverMetricsPanic(f.logger, func() {
+			metrics.backends = append(metrics.backends, factory.Create(eventName))
+		})
+	}
+	return metrics
+}
+
+type multiMetrics struct {
+	backends []Metrics
+	logger   *slog.Logger
+}
+
+// each calls report with every backend, isolating the others from backends that panic.
+func (m *multiMetrics) each(report func(Metrics)) {
+	for _, backend := range m.backends {
+		backend := backend
+		recoverMetricsPanic(m.logger, func() {
+			report(backend)
+		})
+	}
+}
+
+func (m *multiMetrics) Fire(result string) {
+	m.each(func(backend Metrics) { backend.Fire(result) })
+}
+
+func (m *multiMetrics) ResponseStatus(prefix string, status int) {
+	m.each(func(backend Metrics) { backend.ResponseStatus(prefix, status) })
+}
+
+func (m *multiMetrics) Tag(name, value string) {
+	m.each(func(backend Metrics) { backend.Tag(name, value) })
+}
+
+func (m *multiMetrics) Phase(name string, duration time.Duration) {
+	m.each(func(backend Metrics) { backend.Phase(name, duration) })
+}
+
+func (m *multiMetrics) MessageSize(name string, size int) {
+	m.each(func(backend Metrics) { backend.MessageSize(name, size) })
+}
+
+// recoverMetricsPanic calls report, and logs rather than propagates a panic of the backend.
+func recoverMetricsPanic(logger *slog.Logger, report func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("Metrics backend panicked", "panic", fmt.Sprint(r))
+		}
+	}()
+	report()
+}
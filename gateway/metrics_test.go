@@ -0,0 +1,62 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gateway
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestMessageSizeBucket(t *testing.T) {
+	for _, test := range []struct {
+		size   int
+		bucket int
+	}{
+		{0, 256},
+		{256, 256},
+		{257, 1 << 10},
+		{60 << 10, 64 << 10},
+		{1 << 20, 1 << 20},
+		{1<<20 + 1, 2 << 20},
+		{5<<20 + 3, 6 << 20},
+	} {
+		if bucket := messageSizeBucket(test.size); bucket != test.bucket {
+			t.Errorf("Expected a message of %d bytes in bucket %d, got %d", test.size, test.bucket, bucket)
+		}
+	}
+}
+
+type panickingMetricsFactory struct{}
+
+func (panickingMetricsFactory) Create(eventName string) Metrics {
+	panic("backend unavailable")
+}
+
+func TestMultiMetricsFactory(t *testing.T) {
+	first, second := &MockMetricsFactory{}, &MockMetricsFactory{}
+	var logs bytes.Buffer
+	factory := NewMultiMetricsFactory(slog.New(slog.NewTextHandler(&logs, nil)), first, panickingMetricsFactory{}, second)
+
+	metrics := factory.Create(metricsEventGatewayRequest)
+	metrics.Tag(metricsTagRelay, "relay.example")
+	metrics.Fire(metricsResultSuccess)
+	// The first backend panics on a second success, which must not stop the other from reporting it
+	first.metrics[0].resultLabels["twice"] = true
+	metrics.Fire("twice")
+
+	for _, backend := range []*MockMetricsFactory{first, second} {
+		if len(backend.metrics) != 1 || backend.metrics[0].eventName != metricsEventGatewayRequest {
+			t.Fatalf("Expected one %s event, got %v", metricsEventGatewayRequest, backend.metrics)
+		}
+		reported := backend.metrics[0]
+		if !reported.resultLabels[metricsResultSuccess] || !reported.resultLabels["twice"] || reported.tags[metricsTagRelay] != "relay.example" {
+			t.Fatalf("Expected the event to be reported to every backend, got %+v", reported)
+		}
+	}
+	if !strings.Contains(logs.String(), "backend unavailable") {
+		t.Fatalf("Expected the panics to be logged with the given logger, got %q", logs.String())
+	}
+}
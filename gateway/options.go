@@ -0,0 +1,332 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/chris-wood/ohttp-go"
+)
+
+const (
+	// Default endpoints of the gateway routes
+	DefaultGatewayEndpoint      = "/gateway"
+	DefaultConfigEndpoint       = "/ohttp-keys"
+	DefaultLegacyConfigEndpoint = "/ohttp-configs"
+	DefaultEchoEndpoint         = "/gateway-echo"
+	DefaultMetadataEndpoint     = "/gateway-metadata"
+
+	// Content type of the binary HTTP application payload, which is the default
+	binaryHTTPRequestType = "message/bhttp request"
+
+	// Content types of the protohttp application payload
+	ProtoHTTPRequestType  = "message/protohttp request"
+	ProtoHTTPResponseType = "message/protohttp response"
+
+	// Content types of version 2 of the protobuf encoding of HTTP messages, in proto_http_v2.proto
+	ProtoHTTPV2RequestType  = "message/protohttp;version=2 request"
+	ProtoHTTPV2ResponseType = "message/protohttp;version=2 response"
+
+	// Timeout of target requests made with the default upstream client
+	defaultUpstreamTimeout = 30 * time.Second
+)
+
+// Endpoints are the paths on which the gateway routes are served. Routes with an empty path are
+// not served.
+type Endpoints struct {
+	// Gateway serves encapsulated requests with the application handler.
+	Gateway string
+	// Echo serves encapsulated requests by returning their content.
+	Echo string
+	// Metadata serves encapsulated requests by returning the headers of the outer request.
+	Metadata string
+	// Config serves the list of key configurations.
+	Config string
+	// LegacyConfig serves the legacy key configuration.
+	LegacyConfig string
+}
+
+// DefaultEndpoints returns the default paths of the gateway routes.
+func DefaultEndpoints() Endpoints {
+	return Endpoints{
+		Gateway:      DefaultGatewayEndpoint,
+		Echo:         DefaultEchoEndpoint,
+		Metadata:     DefaultMetadataEndpoint,
+		Config:       DefaultConfigEndpoint,
+		LegacyConfig: DefaultLegacyConfigEndpoint,
+	}
+}
+
+type options struct {
+	config             *ohttp.PrivateConfig
+	legacyConfig       *ohttp.PrivateConfig
+	requestType        string
+	responseType       string
+	endpoints          Endpoints
+	appHandler         AppContentHandler
+	upstreamClient     *http.Client
+	allowedOrigins     []string
+	retryPolicy        *RetryPolicy
+	circuitBreaker     *CircuitBreaker
+	responseCache      *ResponseCache
+	metricsFactory     MetricsFactory
+	relayAuthenticator RelayAuthenticator
+	debugResponses     bool
+	logger             *slog.Logger
+	capture            *Capture
+}
+
+// Option configures a gateway created by New.
+type Option func(*options)
+
+// WithKeys sets the key configurations of the gateway. The legacy configuration is served on the
+// legacy config endpoint, for clients that only support a single configuration. Both are
+// required.
+func WithKeys(config, legacyConfig ohttp.PrivateConfig) Option {
+	return func(o *options) {
+		o.config = &config
+		o.legacyConfig = &legacyConfig
+	}
+}
+
+// WithContentTypes sets the media types of encapsulated requests and responses, which are bound to
+// the encapsulation. By default, the content is binary HTTP. For protohttp content, requests are
+// resolved with the upstream client unless an application handler is set. Any other content type
+// requires an application handler.
+func WithContentTypes(requestType, responseType string) Option {
+	return func(o *options) {
+		o.requestType = requestType
+		o.responseType = responseType
+	}
+}
+
+// WithEndpoints sets the paths on which the gateway routes are served, replacing the defaults.
+func WithEndpoints(endpoints Endpoints) Option {
+	return func(o *options) {
+		o.endpoints = endpoints
+	}
+}
+
+// WithAppHandler sets the handler of the content of requests to the gateway endpoint, replacing
+// the handler that resolves them as HTTP requests with the upstream client.
+func WithAppHandler(handler AppContentHandler) Option {
+	return func(o *options) {
+		o.appHandler = handler
+	}
+}
+
+// WithUpstreamClient sets the client used to send requests to targets. By default, a client with
+// a 30 second timeout that ignores the proxy environment variables is used.
+func WithUpstreamClient(client *http.Client) Option {
+	return func(o *options) {
+		o.upstreamClient = client
+	}
+}
+
+// WithAllowedOrigins restricts target requests to the given origins (host and optional port).
+// By default, requests to any target are allowed.
+func WithAllowedOrigins(origins []string) Option {
+	return func(o *options) {
+		o.allowedOrigins = origins
+	}
+}
+
+// WithRetryPolicy retries failed target requests according to policy.
+func WithRetryPolicy(policy *RetryPolicy) Option {
+	return func(o *options) {
+		o.retryPolicy = policy
+	}
+}
+
+// WithCircuitBreaker stops sending requests to targets that keep failing.
+func WithCircuitBreaker(breaker *CircuitBreaker) Option {
+	return func(o *options) {
+		o.circuitBreaker = breaker
+	}
+}
+
+// WithResponseCache answers cacheable target requests from cache.
+func WithResponseCache(cache *ResponseCache) Option {
+	return func(o *options) {
+		o.responseCache = cache
+	}
+}
+
+// WithMetrics reports the results of requests to factory. By default, metrics are discarded.
+func WithMetrics(factory MetricsFactory) Option {
+	return func(o *options) {
+		o.metricsFactory = factory
+	}
+}
+
+// WithRelayAuthenticator only accepts encapsulated requests sent by relays that authenticator
+// accepts.
+func WithRelayAuthenticator(authenticator RelayAuthenticator) Option {
+	return func(o *options) {
+		o.relayAuthenticator = authenticator
+	}
+}
+
+// WithDebugResponses includes the reason for failures in error responses.
+func WithDebugResponses(enabled bool) Option {
+	return func(o *options) {
+		o.debugResponses = enabled
+	}
+}
+
+// WithLogger sets the logger of the gateway, which logs every request and the reason for failures
+// at debug level. Private data is only logged in attributes redacted by a RedactingHandler, which
+// the logger should use. By default, the gateway logs to the default slog handler with private
+// data redacted.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithCapture records the decapsulated requests to the gateway endpoint and their responses to
+// capture. Captures hold private data of clients, so this must only be used in development.
+func WithCapture(capture *Capture) Option {
+	return func(o *options) {
+		o.capture = capture
+	}
+}
+
+// Handler is an http.Handler serving a gateway created by New.
+type Handler struct {
+	mux            *http.ServeMux
+	gateway        ohttp.Gateway
+	keyIDs         []uint8
+	upstreamClient *http.Client
+	logger         *slog.Logger
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// New creates a gateway serving its encapsulated request, key configuration, echo and metadata
+// routes on the configured endpoints. Requests for other paths are answered with 404, so the
+// gateway can be mounted on the paths of its endpoints in another mux.
+func New(opts ...Option) (*Handler, error) {
+	o := options{
+		endpoints: DefaultEndpoints(),
+		upstreamClient: &http.Client{
+			Transport: DirectTransport(),
+			Timeout:   defaultUpstreamTimeout,
+		},
+		metricsFactory: noopMetricsFactory{},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.config == nil || o.legacyConfig == nil {
+		return nil, errors.New("no key configurations set")
+	}
+	if o.logger == nil {
+		o.logger = defaultLogger()
+	}
+	if o.circuitBreaker != nil {
+		o.circuitBreaker.logger = o.logger
+	}
+
+	configs := []ohttp.PrivateConfig{*o.config, *o.legacyConfig}
+	customContent := o.requestType != "" && o.responseType != "" && o.requestType != o.responseType
+	var gateway ohttp.Gateway
+	contentType := binaryHTTPRequestType
+	if customContent {
+		gateway = ohttp.NewCustomGateway(configs, o.requestType, o.responseType)
+		contentType = o.requestType
+	} else {
+		gateway = ohttp.NewDefaultGateway(configs)
+	}
+
+	appHandler := o.appHandler
+	if appHandler == nil {
+		filteredHandler := NewFilteredHttpRequestHandler(o.upstreamClient, o.allowedOrigins, o.logger)
+		filteredHandler.retryPolicy = o.retryPolicy
+		filteredHandler.circuitBreaker = o.circuitBreaker
+		if o.circuitBreaker != nil {
+			o.circuitBreaker.originLabel = filteredHandler.originLabel
+		}
+		var httpHandler HttpRequestHandler = filteredHandler
+		if o.responseCache != nil {
+			httpHandler = CachingHttpRequestHandler{
+				httpHandler: filteredHandler,
+				cache:       o.responseCache,
+			}
+		}
+
+		switch {
+		case !customContent:
+			appHandler = BinaryHTTPAppHandler{httpHandler: httpHandler}
+		case o.requestType == ProtoHTTPRequestType && o.responseType == ProtoHTTPResponseType:
+			appHandler = ProtoHTTPAppHandler{httpHandler: httpHandler, codec: protoHTTPV1Codec{}}
+		case o.requestType == ProtoHTTPV2RequestType && o.responseType == ProtoHTTPV2ResponseType:
+			appHandler = ProtoHTTPAppHandler{httpHandler: httpHandler, codec: protoHTTPV2Codec{}}
+		default:
+			return nil, fmt.Errorf("content types %q and %q require an application handler", o.requestType, o.responseType)
+		}
+	}
+
+	if o.capture != nil {
+		appHandler = capturingAppHandler{
+			appHandler:  appHandler,
+			capture:     o.capture,
+			contentType: contentType,
+		}
+	}
+
+	handlers := make(map[string]EncapsulationHandler)
+	if o.endpoints.Gateway != "" {
+		handlers[o.endpoints.Gateway] = DefaultEncapsulationHandler{
+			gateway:    gateway,
+			appHandler: appHandler,
+		}
+	}
+	if o.endpoints.Echo != "" {
+		handlers[o.endpoints.Echo] = DefaultEncapsulationHandler{
+			gateway:    gateway,
+			appHandler: EchoAppHandler{},
+		}
+	}
+	if o.endpoints.Metadata != "" {
+		handlers[o.endpoints.Metadata] = MetadataEncapsulationHandler{
+			gateway: gateway,
+		}
+	}
+
+	target := &gatewayResource{
+		logger:                o.logger,
+		legacyKeyID:           o.legacyConfig.Config().ID,
+		gateway:               gateway,
+		encapsulationHandlers: handlers,
+		debugResponse:         o.debugResponses,
+		metricsFactory:        o.metricsFactory,
+		relayAuthenticator:    o.relayAuthenticator,
+		contentType:           contentType,
+	}
+
+	mux := http.NewServeMux()
+	for endpoint := range handlers {
+		mux.HandleFunc(endpoint, target.gatewayHandler)
+	}
+	if o.endpoints.Config != "" {
+		mux.HandleFunc(o.endpoints.Config, target.configHandler)
+	}
+	if o.endpoints.LegacyConfig != "" {
+		mux.HandleFunc(o.endpoints.LegacyConfig, target.legacyConfigHandler)
+	}
+	return &Handler{
+		mux:            mux,
+		gateway:        gateway,
+		keyIDs:         []uint8{o.config.Config().ID, o.legacyConfig.Config().ID},
+		upstreamClient: o.upstreamClient,
+		logger:         o.logger,
+	}, nil
+}
@@ -1,7 +1,7 @@
 // Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
 // SPDX-License-Identifier: BSD-3-Clause
 
-package main
+package gateway
 
 import (
 	"bytes"
@@ -10,8 +10,72 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+
+	"google.golang.org/protobuf/proto"
 )
 
+// protoHTTPCodec translates between HTTP messages and a version of the protobuf encoding of HTTP
+// messages. Messages are unmarshalled and marshalled by the caller.
+type protoHTTPCodec interface {
+	// newRequest returns an empty request message of the version.
+	newRequest() proto.Message
+	// newResponse returns an empty response message of the version.
+	newResponse() proto.Message
+	// toHTTPRequest translates a request message into a request to the target.
+	toHTTPRequest(message proto.Message) (*http.Request, error)
+	// fromHTTPResponse translates the response of the target to req into a response message.
+	fromHTTPResponse(req *http.Request, resp *http.Response) (proto.Message, error)
+	// errorResponse returns a response message with the status and body of a gateway error.
+	errorResponse(status int, body []byte) proto.Message
+	// toHTTPResponse translates a response message into an http.Response.
+	toHTTPResponse(message proto.Message) (*http.Response, error)
+}
+
+// protoHTTPCodecs are the versions of the protobuf encoding, by request content type.
+var protoHTTPCodecs = map[string]protoHTTPCodec{
+	ProtoHTTPRequestType:   protoHTTPV1Codec{},
+	ProtoHTTPV2RequestType: protoHTTPV2Codec{},
+}
+
+// protoHTTPV1Codec is the codec of the original proto_http.proto schema.
+type protoHTTPV1Codec struct{}
+
+func (protoHTTPV1Codec) newRequest() proto.Message {
+	return &Request{}
+}
+
+func (protoHTTPV1Codec) newResponse() proto.Message {
+	return &Response{}
+}
+
+func (protoHTTPV1Codec) toHTTPRequest(message proto.Message) (*http.Request, error) {
+	return protoHTTPToRequest(message.(*Request))
+}
+
+func (protoHTTPV1Codec) fromHTTPResponse(req *http.Request, resp *http.Response) (proto.Message, error) {
+	return responseToProtoHTTP(resp)
+}
+
+func (protoHTTPV1Codec) errorResponse(status int, body []byte) proto.Message {
+	return &Response{
+		StatusCode: int32(status),
+		Body:       body,
+	}
+}
+
+func (protoHTTPV1Codec) toHTTPResponse(message proto.Message) (*http.Response, error) {
+	protoResponse := message.(*Response)
+	resp := &http.Response{
+		StatusCode: int(protoResponse.StatusCode),
+		Header:     make(http.Header),
+		Body:       io.NopCloser(bytes.NewReader(protoResponse.Body)),
+	}
+	for _, nv := range protoResponse.Headers {
+		resp.Header.Add(nv.Name, nv.Value)
+	}
+	return resp, nil
+}
+
 var requestMethodMap = map[Request_Method]string{
 	Request_GET:     "GET",
 	Request_HEAD:    "HEAD",
@@ -44,8 +108,13 @@ func requestToProtoHTTP(request *http.Request) (*Request, error) {
 		req.Method = Request_PUT
 	case http.MethodDelete:
 		req.Method = Request_DELETE
+	case http.MethodPatch:
+		req.Method = Request_PATCH
+	case http.MethodTrace:
+		req.Method = Request_TRACE
 	default:
-		break
+		// The zero value is GET, so other methods cannot be encoded
+		return nil, fmt.Errorf("unsupported request method: %s", request.Method)
 	}
 
 	if request.URL.Scheme == "http" || request.URL.Scheme == "HTTP" {
@@ -0,0 +1,373 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// Responses are padded to a multiple of this size, so that their size only leaks in steps
+	protoHTTPV2PaddingBlockSize = 256
+
+	// Field number of the padding of ResponseV2
+	protoHTTPV2ResponsePaddingField = 7
+)
+
+var requestV2MethodMap = map[RequestV2_Method]string{
+	RequestV2_GET:     http.MethodGet,
+	RequestV2_HEAD:    http.MethodHead,
+	RequestV2_POST:    http.MethodPost,
+	RequestV2_PUT:     http.MethodPut,
+	RequestV2_DELETE:  http.MethodDelete,
+	RequestV2_PATCH:   http.MethodPatch,
+	RequestV2_OPTIONS: http.MethodOptions,
+	RequestV2_TRACE:   http.MethodTrace,
+}
+
+var requestV2SchemeMap = map[RequestV2_Scheme]string{
+	RequestV2_HTTP:  "http",
+	RequestV2_HTTPS: "https",
+}
+
+// protoHTTPV2Codec is the codec of the proto_http_v2.proto schema. Unlike version 1, it rejects
+// requests that cannot be translated exactly, such as requests with unescaped paths, and carries
+// trailers and informational responses.
+type protoHTTPV2Codec struct{}
+
+func (protoHTTPV2Codec) newRequest() proto.Message {
+	return &RequestV2{}
+}
+
+func (protoHTTPV2Codec) newResponse() proto.Message {
+	return &ResponseV2{}
+}
+
+func (protoHTTPV2Codec) toHTTPRequest(message proto.Message) (*http.Request, error) {
+	return protoHTTPV2ToRequest(message.(*RequestV2))
+}
+
+func (protoHTTPV2Codec) fromHTTPResponse(req *http.Request, resp *http.Response) (proto.Message, error) {
+	return responseToProtoHTTPV2(req, resp)
+}
+
+func (protoHTTPV2Codec) errorResponse(status int, body []byte) proto.Message {
+	resp := &ResponseV2{
+		StatusCode: int32(status),
+		Reason:     http.StatusText(status),
+		Body:       body,
+	}
+	padProtoHTTPV2Response(resp)
+	return resp
+}
+
+func (protoHTTPV2Codec) toHTTPResponse(message proto.Message) (*http.Response, error) {
+	return protoHTTPV2ToResponse(message.(*ResponseV2))
+}
+
+// isTokenChar reports whether c is allowed in tokens, such as methods and field names:
+// https://www.rfc-editor.org/rfc/rfc9110#section-5.6.2
+func isTokenChar(c byte) bool {
+	return c < 0x80 && (c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0)
+}
+
+func validToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isTokenChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// validPercentEncoded reports whether s only has the characters of a path segment and the given
+// extra characters, and only valid percent-encodings:
+// https://www.rfc-editor.org/rfc/rfc3986#section-3.3
+func validPercentEncoded(s string, extra string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '%':
+			if i+2 >= len(s) || !isHexDigit(s[i+1]) || !isHexDigit(s[i+2]) {
+				return false
+			}
+			i += 2
+		case c >= '0' && c <= '9', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case strings.IndexByte("-._~!$&'()*+,;=:@", c) >= 0, strings.IndexByte(extra, c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// validPadding reports whether padding only has zero bytes.
+func validPadding(padding []byte) bool {
+	for _, b := range padding {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// fieldsToHeader adds the header or trailer fields of a v2 message to header, rejecting names
+// that are not tokens and values that could split fields.
+func fieldsToHeader(fields []*FieldV2, header http.Header) error {
+	for _, field := range fields {
+		if !validToken(field.Name) {
+			return fmt.Errorf("invalid field name: %q", field.Name)
+		}
+		if strings.ContainsAny(field.Value, "\r\n\x00") {
+			return fmt.Errorf("invalid value of field %s", field.Name)
+		}
+		header.Add(field.Name, field.Value)
+	}
+	return nil
+}
+
+// headerToFields returns the fields of header with lower case names, in the order of their names.
+func headerToFields(header http.Header) []*FieldV2 {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var fields []*FieldV2
+	for _, name := range names {
+		for _, value := range header[name] {
+			fields = append(fields, &FieldV2{
+				Name:  strings.ToLower(name),
+				Value: value,
+			})
+		}
+	}
+	return fields
+}
+
+// informationalResponsesKey is the context key of the informational responses received for a
+// request.
+type informationalResponsesKey struct{}
+
+type informationalResponses struct {
+	mu        sync.Mutex
+	responses []*InformationalResponseV2
+}
+
+// withInformationalResponses returns a context recording the informational responses to the
+// requests made with it.
+func withInformationalResponses(ctx context.Context) context.Context {
+	informational := &informationalResponses{}
+	ctx = context.WithValue(ctx, informationalResponsesKey{}, informational)
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			informational.mu.Lock()
+			defer informational.mu.Unlock()
+			informational.responses = append(informational.responses, &InformationalResponseV2{
+				StatusCode: int32(code),
+				Headers:    headerToFields(http.Header(header)),
+			})
+			return nil
+		},
+	})
+}
+
+func protoHTTPV2ToRequest(request *RequestV2) (*http.Request, error) {
+	if !validPadding(request.Padding) {
+		return nil, fmt.Errorf("invalid request padding")
+	}
+
+	method, ok := requestV2MethodMap[request.Method]
+	if request.Method == RequestV2_EXTENSION {
+		method = request.ExtensionMethod
+		if !validToken(method) {
+			return nil, fmt.Errorf("invalid extension method: %q", method)
+		}
+		for _, known := range requestV2MethodMap {
+			if method == known {
+				return nil, fmt.Errorf("extension method %s has a method value", method)
+			}
+		}
+		if method == http.MethodConnect {
+			return nil, fmt.Errorf("unsupported request method: %s", method)
+		}
+	} else if !ok {
+		return nil, fmt.Errorf("unsupported request method: %s", request.Method)
+	} else if request.ExtensionMethod != "" {
+		return nil, fmt.Errorf("extension method set with method %s", request.Method)
+	}
+
+	scheme, ok := requestV2SchemeMap[request.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported request scheme: %s", request.Scheme)
+	}
+
+	authority, err := url.Parse("//" + request.Authority)
+	if err != nil || request.Authority == "" || authority.Host != request.Authority {
+		return nil, fmt.Errorf("invalid request authority: %q", request.Authority)
+	}
+
+	if !strings.HasPrefix(request.Path, "/") || !validPercentEncoded(request.Path, "/") {
+		return nil, fmt.Errorf("invalid request path: %q", request.Path)
+	}
+	if !validPercentEncoded(request.Query, "/?") {
+		return nil, fmt.Errorf("invalid request query: %q", request.Query)
+	}
+	path, err := url.PathUnescape(request.Path)
+	if err != nil {
+		return nil, err
+	}
+	targetURL := &url.URL{
+		Scheme:   scheme,
+		Host:     request.Authority,
+		Path:     path,
+		RawPath:  request.Path,
+		RawQuery: request.Query,
+	}
+
+	ctx := withInformationalResponses(context.Background())
+	targetRequest, err := http.NewRequestWithContext(ctx, method, targetURL.String(), bytes.NewReader(request.Body))
+	if err != nil {
+		return nil, err
+	}
+	if err := fieldsToHeader(request.Headers, targetRequest.Header); err != nil {
+		return nil, err
+	}
+	if len(request.Trailers) > 0 {
+		targetRequest.Trailer = make(http.Header)
+		if err := fieldsToHeader(request.Trailers, targetRequest.Trailer); err != nil {
+			return nil, err
+		}
+		// Trailers are only sent with chunked content
+		targetRequest.ContentLength = -1
+	}
+	return targetRequest, nil
+}
+
+// requestToProtoHTTPV2 encodes a request, with methods that have no method value as extension
+// methods.
+func requestToProtoHTTPV2(request *http.Request) (*RequestV2, error) {
+	req := &RequestV2{
+		Method:    RequestV2_EXTENSION,
+		Scheme:    RequestV2_HTTPS,
+		Authority: request.Host,
+		Path:      request.URL.EscapedPath(),
+		Query:     request.URL.RawQuery,
+		Headers:   headerToFields(request.Header),
+	}
+	if req.Authority == "" {
+		req.Authority = request.URL.Host
+	}
+	for method, name := range requestV2MethodMap {
+		if request.Method == name {
+			req.Method = method
+		}
+	}
+	if req.Method == RequestV2_EXTENSION {
+		req.ExtensionMethod = request.Method
+	}
+	if strings.EqualFold(request.URL.Scheme, "http") {
+		req.Scheme = RequestV2_HTTP
+	}
+
+	if request.Body != nil {
+		body, err := io.ReadAll(request.Body)
+		if err != nil {
+			return nil, err
+		}
+		req.Body = body
+	}
+	req.Trailers = headerToFields(request.Trailer)
+	return req, nil
+}
+
+func responseToProtoHTTPV2(request *http.Request, targetResponse *http.Response) (*ResponseV2, error) {
+	resp := &ResponseV2{
+		StatusCode: int32(targetResponse.StatusCode),
+		Reason:     strings.TrimPrefix(targetResponse.Status, strconv.Itoa(targetResponse.StatusCode)+" "),
+		Headers:    headerToFields(targetResponse.Header),
+	}
+	if targetResponse.Body != nil {
+		defer targetResponse.Body.Close()
+		body, err := io.ReadAll(targetResponse.Body)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = body
+	}
+	// Trailers are only known once the body has been read
+	resp.Trailers = headerToFields(targetResponse.Trailer)
+
+	if request != nil {
+		if informational, ok := request.Context().Value(informationalResponsesKey{}).(*informationalResponses); ok {
+			informational.mu.Lock()
+			resp.InformationalResponses = informational.responses
+			informational.mu.Unlock()
+		}
+	}
+	padProtoHTTPV2Response(resp)
+	return resp, nil
+}
+
+func protoHTTPV2ToResponse(response *ResponseV2) (*http.Response, error) {
+	if !validPadding(response.Padding) {
+		return nil, fmt.Errorf("invalid response padding")
+	}
+	resp := &http.Response{
+		StatusCode: int(response.StatusCode),
+		Status:     strings.TrimSpace(fmt.Sprintf("%d %s", response.StatusCode, response.Reason)),
+		Header:     make(http.Header),
+		Body:       io.NopCloser(bytes.NewReader(response.Body)),
+	}
+	if err := fieldsToHeader(response.Headers, resp.Header); err != nil {
+		return nil, err
+	}
+	if len(response.Trailers) > 0 {
+		resp.Trailer = make(http.Header)
+		if err := fieldsToHeader(response.Trailers, resp.Trailer); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// padProtoHTTPV2Response sets the padding of resp so that its encoding is a multiple of
+// protoHTTPV2PaddingBlockSize bytes.
+func padProtoHTTPV2Response(resp *ResponseV2) {
+	resp.Padding = nil
+	size := proto.Size(resp)
+	gap := (protoHTTPV2PaddingBlockSize - size%protoHTTPV2PaddingBlockSize) % protoHTTPV2PaddingBlockSize
+	for gap > 0 {
+		// The padding field takes a tag and a length besides the padding, so the gap may have
+		// to grow by a block for them to fit
+		for n := gap - 3; n <= gap-2; n++ {
+			if n > 0 && protowire.SizeTag(protoHTTPV2ResponsePaddingField)+protowire.SizeBytes(n) == gap {
+				resp.Padding = make([]byte, n)
+				return
+			}
+		}
+		gap += protoHTTPV2PaddingBlockSize
+	}
+}
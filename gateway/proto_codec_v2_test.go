@@ -0,0 +1,175 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gateway
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestProtoHTTPV2AppHandler(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		if r.Method != "PROPFIND" || r.URL.EscapedPath() != "/a%2Fb/c" || r.URL.RawQuery != "q=1&r=%20" || string(body) != "content" || r.Trailer.Get("X-Checksum") != "abc" {
+			t.Errorf("Unexpected request %s %s %q, trailers %v", r.Method, r.URL, body, r.Trailer)
+		}
+		w.Header().Set("Link", "</style.css>; rel=preload")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Set("Trailer", "X-Result")
+		w.WriteHeader(http.StatusMultiStatus)
+		w.Write([]byte("multi"))
+		w.Header().Set("X-Result", "done")
+	}))
+	defer target.Close()
+	targetURL, err := url.Parse(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	protoRequest := &RequestV2{
+		Method:          RequestV2_EXTENSION,
+		ExtensionMethod: "PROPFIND",
+		Scheme:          RequestV2_HTTP,
+		Authority:       targetURL.Host,
+		Path:            "/a%2Fb/c",
+		Query:           "q=1&r=%20",
+		Headers:         []*FieldV2{{Name: "depth", Value: "1"}},
+		Body:            []byte("content"),
+		Trailers:        []*FieldV2{{Name: "x-checksum", Value: "abc"}},
+		Padding:         make([]byte, 16),
+	}
+	encodedRequest, err := proto.Marshal(protoRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var content bytes.Buffer
+	handler := ProtoHTTPAppHandler{
+		httpHandler: NewFilteredHttpRequestHandler(target.Client(), nil, nil),
+		codec:       protoHTTPV2Codec{},
+	}
+	metrics := &MockMetrics{resultLabels: map[string]bool{}}
+	if err := handler.Handle(NewEncapsulatedChunkWriter(&content), encodedRequest, metrics); err != nil {
+		t.Fatal(err)
+	}
+	if content.Len()%protoHTTPV2PaddingBlockSize != 0 {
+		t.Fatalf("Expected a response padded to a multiple of %d bytes, got %d bytes", protoHTTPV2PaddingBlockSize, content.Len())
+	}
+
+	resp := &ResponseV2{}
+	if err := proto.Unmarshal(content.Bytes(), resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusMultiStatus || resp.Reason != "Multi-Status" || string(resp.Body) != "multi" {
+		t.Fatalf("Unexpected response %d %s %q", resp.StatusCode, resp.Reason, resp.Body)
+	}
+	if len(resp.InformationalResponses) != 1 || resp.InformationalResponses[0].StatusCode != http.StatusEarlyHints {
+		t.Fatalf("Expected an early hints response, got %v", resp.InformationalResponses)
+	}
+	if len(resp.Trailers) != 1 || resp.Trailers[0].Name != "x-result" || resp.Trailers[0].Value != "done" {
+		t.Fatalf("Expected the trailers of the target, got %v", resp.Trailers)
+	}
+	for _, field := range resp.Headers {
+		if field.Name != strings.ToLower(field.Name) {
+			t.Fatalf("Expected lower case field names, got %s", field.Name)
+		}
+	}
+	if !validPadding(resp.Padding) {
+		t.Fatal("Expected zero padding")
+	}
+}
+
+func TestProtoHTTPV2RequestValidation(t *testing.T) {
+	valid := func() *RequestV2 {
+		return &RequestV2{
+			Method:    RequestV2_GET,
+			Scheme:    RequestV2_HTTPS,
+			Authority: ALLOWED_TARGET,
+			Path:      "/",
+		}
+	}
+	if _, err := protoHTTPV2ToRequest(valid()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		modify func(*RequestV2)
+	}{
+		{"missing extension method", func(r *RequestV2) { r.Method = RequestV2_EXTENSION }},
+		{"invalid extension method", func(r *RequestV2) { r.Method, r.ExtensionMethod = RequestV2_EXTENSION, "GET /" }},
+		{"extension method with a method value", func(r *RequestV2) { r.Method, r.ExtensionMethod = RequestV2_EXTENSION, "PATCH" }},
+		{"CONNECT", func(r *RequestV2) { r.Method, r.ExtensionMethod = RequestV2_EXTENSION, "CONNECT" }},
+		{"method and extension method", func(r *RequestV2) { r.ExtensionMethod = "PROPFIND" }},
+		{"missing scheme", func(r *RequestV2) { r.Scheme = RequestV2_SCHEME_UNSPECIFIED }},
+		{"missing authority", func(r *RequestV2) { r.Authority = "" }},
+		{"authority with a path", func(r *RequestV2) { r.Authority = ALLOWED_TARGET + "/path" }},
+		{"authority with user info", func(r *RequestV2) { r.Authority = "user@" + ALLOWED_TARGET }},
+		{"relative path", func(r *RequestV2) { r.Path = "path" }},
+		{"path with a query", func(r *RequestV2) { r.Path = "/path?q=1" }},
+		{"unescaped path", func(r *RequestV2) { r.Path = "/a b" }},
+		{"invalid percent-encoding", func(r *RequestV2) { r.Path = "/%zz" }},
+		{"query with a fragment", func(r *RequestV2) { r.Query = "q=1#fragment" }},
+		{"invalid field name", func(r *RequestV2) { r.Headers = []*FieldV2{{Name: "x header", Value: "1"}} }},
+		{"field value with a line break", func(r *RequestV2) { r.Trailers = []*FieldV2{{Name: "x-trailer", Value: "1\r\nx-other: 2"}} }},
+		{"non-zero padding", func(r *RequestV2) { r.Padding = []byte{0, 1} }},
+	} {
+		request := valid()
+		test.modify(request)
+		if _, err := protoHTTPV2ToRequest(request); err == nil {
+			t.Fatalf("%s: expected the request to be rejected", test.name)
+		}
+	}
+}
+
+func TestProtoHTTPV2RequestRoundTrip(t *testing.T) {
+	httpRequest, err := http.NewRequest(http.MethodPatch, "http://"+ALLOWED_TARGET+"/caf%C3%A9/a%2Fb?q=%C3%A9", strings.NewReader("patch"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	protoRequest, err := requestToProtoHTTPV2(httpRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if protoRequest.Method != RequestV2_PATCH || protoRequest.Path != "/caf%C3%A9/a%2Fb" || protoRequest.Query != "q=%C3%A9" {
+		t.Fatalf("Unexpected encoding %v", protoRequest)
+	}
+	decoded, err := protoHTTPV2ToRequest(protoRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Method != http.MethodPatch || decoded.URL.String() != httpRequest.URL.String() {
+		t.Fatalf("Expected %s %s, got %s %s", http.MethodPatch, httpRequest.URL, decoded.Method, decoded.URL)
+	}
+
+	// Version 1 cannot encode methods without a method value, since its zero value is GET
+	httpRequest.Method = "PROPFIND"
+	if _, err := requestToProtoHTTP(httpRequest); err == nil {
+		t.Fatal("Expected an unsupported method to be rejected")
+	}
+}
+
+func TestProtoHTTPV2ResponsePadding(t *testing.T) {
+	for size := 0; size < 3*protoHTTPV2PaddingBlockSize; size++ {
+		resp := protoHTTPV2Codec{}.errorResponse(http.StatusBadRequest, make([]byte, size)).(*ResponseV2)
+		if encodedSize := proto.Size(resp); encodedSize%protoHTTPV2PaddingBlockSize != 0 {
+			t.Fatalf("Expected the response with %d bytes of content to be padded to a multiple of %d bytes, got %d bytes", size, protoHTTPV2PaddingBlockSize, encodedSize)
+		}
+	}
+
+	resp := &ResponseV2{StatusCode: http.StatusOK, Padding: []byte{1}}
+	if _, err := protoHTTPV2ToResponse(resp); err == nil {
+		t.Fatal("Expected non-zero padding to be rejected")
+	}
+}
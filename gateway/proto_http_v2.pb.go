@@ -0,0 +1,670 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.28.1
+// 	protoc        (unknown)
+// source: proto_http_v2.proto
+
+package gateway
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// Control data
+type RequestV2_Method int32
+
+const (
+	// The method is the extension_method token
+	RequestV2_EXTENSION RequestV2_Method = 0
+	RequestV2_GET       RequestV2_Method = 1
+	RequestV2_HEAD      RequestV2_Method = 2
+	RequestV2_POST      RequestV2_Method = 3
+	RequestV2_PUT       RequestV2_Method = 4
+	RequestV2_DELETE    RequestV2_Method = 5
+	RequestV2_PATCH     RequestV2_Method = 6
+	RequestV2_OPTIONS   RequestV2_Method = 7
+	RequestV2_TRACE     RequestV2_Method = 8 // Note: CONNECT is not supported
+)
+
+// Enum value maps for RequestV2_Method.
+var (
+	RequestV2_Method_name = map[int32]string{
+		0: "EXTENSION",
+		1: "GET",
+		2: "HEAD",
+		3: "POST",
+		4: "PUT",
+		5: "DELETE",
+		6: "PATCH",
+		7: "OPTIONS",
+		8: "TRACE",
+	}
+	RequestV2_Method_value = map[string]int32{
+		"EXTENSION": 0,
+		"GET":       1,
+		"HEAD":      2,
+		"POST":      3,
+		"PUT":       4,
+		"DELETE":    5,
+		"PATCH":     6,
+		"OPTIONS":   7,
+		"TRACE":     8,
+	}
+)
+
+func (x RequestV2_Method) Enum() *RequestV2_Method {
+	p := new(RequestV2_Method)
+	*p = x
+	return p
+}
+
+func (x RequestV2_Method) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (RequestV2_Method) Descriptor() protoreflect.EnumDescriptor {
+	return file_proto_http_v2_proto_enumTypes[0].Descriptor()
+}
+
+func (RequestV2_Method) Type() protoreflect.EnumType {
+	return &file_proto_http_v2_proto_enumTypes[0]
+}
+
+func (x RequestV2_Method) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use RequestV2_Method.Descriptor instead.
+func (RequestV2_Method) EnumDescriptor() ([]byte, []int) {
+	return file_proto_http_v2_proto_rawDescGZIP(), []int{1, 0}
+}
+
+type RequestV2_Scheme int32
+
+const (
+	RequestV2_SCHEME_UNSPECIFIED RequestV2_Scheme = 0
+	RequestV2_HTTP               RequestV2_Scheme = 1
+	RequestV2_HTTPS              RequestV2_Scheme = 2
+)
+
+// Enum value maps for RequestV2_Scheme.
+var (
+	RequestV2_Scheme_name = map[int32]string{
+		0: "SCHEME_UNSPECIFIED",
+		1: "HTTP",
+		2: "HTTPS",
+	}
+	RequestV2_Scheme_value = map[string]int32{
+		"SCHEME_UNSPECIFIED": 0,
+		"HTTP":               1,
+		"HTTPS":              2,
+	}
+)
+
+func (x RequestV2_Scheme) Enum() *RequestV2_Scheme {
+	p := new(RequestV2_Scheme)
+	*p = x
+	return p
+}
+
+func (x RequestV2_Scheme) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (RequestV2_Scheme) Descriptor() protoreflect.EnumDescriptor {
+	return file_proto_http_v2_proto_enumTypes[1].Descriptor()
+}
+
+func (RequestV2_Scheme) Type() protoreflect.EnumType {
+	return &file_proto_http_v2_proto_enumTypes[1]
+}
+
+func (x RequestV2_Scheme) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use RequestV2_Scheme.Descriptor instead.
+func (RequestV2_Scheme) EnumDescriptor() ([]byte, []int) {
+	return file_proto_http_v2_proto_rawDescGZIP(), []int{1, 1}
+}
+
+// A header or trailer field. Names are lower case, as in Binary HTTP. The same name can occur
+// several times, like for cookies.
+type FieldV2 struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Name  string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Value string `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+}
+
+func (x *FieldV2) Reset() {
+	*x = FieldV2{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_proto_http_v2_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *FieldV2) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FieldV2) ProtoMessage() {}
+
+func (x *FieldV2) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_http_v2_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FieldV2.ProtoReflect.Descriptor instead.
+func (*FieldV2) Descriptor() ([]byte, []int) {
+	return file_proto_http_v2_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *FieldV2) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *FieldV2) GetValue() string {
+	if x != nil {
+		return x.Value
+	}
+	return ""
+}
+
+// Version 2 of the protobuf encoding of HTTP messages, inspired by Binary HTTP:
+//
+//	https://www.rfc-editor.org/rfc/rfc9292
+//
+// Padding consists of zero bytes. Messages with padding that is not all zero are malformed, as
+// in Binary HTTP. Padding carries no information: it only hides the size of messages.
+type RequestV2 struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Method RequestV2_Method `protobuf:"varint,1,opt,name=method,proto3,enum=protohttp.v2.RequestV2_Method" json:"method,omitempty"`
+	// Token of a method without a value of Method, such as PROPFIND. Set only if method is
+	// EXTENSION.
+	ExtensionMethod string           `protobuf:"bytes,2,opt,name=extension_method,json=extensionMethod,proto3" json:"extension_method,omitempty"`
+	Scheme          RequestV2_Scheme `protobuf:"varint,3,opt,name=scheme,proto3,enum=protohttp.v2.RequestV2_Scheme" json:"scheme,omitempty"`
+	// Host and optional port of the target
+	Authority string `protobuf:"bytes,4,opt,name=authority,proto3" json:"authority,omitempty"`
+	// Percent-encoded path, starting with "/", without the query
+	Path string `protobuf:"bytes,5,opt,name=path,proto3" json:"path,omitempty"`
+	// Percent-encoded query, without the leading "?"
+	Query   string     `protobuf:"bytes,6,opt,name=query,proto3" json:"query,omitempty"`
+	Headers []*FieldV2 `protobuf:"bytes,7,rep,name=headers,proto3" json:"headers,omitempty"`
+	// Content
+	Body     []byte     `protobuf:"bytes,8,opt,name=body,proto3" json:"body,omitempty"`
+	Trailers []*FieldV2 `protobuf:"bytes,9,rep,name=trailers,proto3" json:"trailers,omitempty"`
+	// Padding
+	Padding []byte `protobuf:"bytes,10,opt,name=padding,proto3" json:"padding,omitempty"`
+}
+
+func (x *RequestV2) Reset() {
+	*x = RequestV2{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_proto_http_v2_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *RequestV2) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RequestV2) ProtoMessage() {}
+
+func (x *RequestV2) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_http_v2_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RequestV2.ProtoReflect.Descriptor instead.
+func (*RequestV2) Descriptor() ([]byte, []int) {
+	return file_proto_http_v2_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *RequestV2) GetMethod() RequestV2_Method {
+	if x != nil {
+		return x.Method
+	}
+	return RequestV2_EXTENSION
+}
+
+func (x *RequestV2) GetExtensionMethod() string {
+	if x != nil {
+		return x.ExtensionMethod
+	}
+	return ""
+}
+
+func (x *RequestV2) GetScheme() RequestV2_Scheme {
+	if x != nil {
+		return x.Scheme
+	}
+	return RequestV2_SCHEME_UNSPECIFIED
+}
+
+func (x *RequestV2) GetAuthority() string {
+	if x != nil {
+		return x.Authority
+	}
+	return ""
+}
+
+func (x *RequestV2) GetPath() string {
+	if x != nil {
+		return x.Path
+	}
+	return ""
+}
+
+func (x *RequestV2) GetQuery() string {
+	if x != nil {
+		return x.Query
+	}
+	return ""
+}
+
+func (x *RequestV2) GetHeaders() []*FieldV2 {
+	if x != nil {
+		return x.Headers
+	}
+	return nil
+}
+
+func (x *RequestV2) GetBody() []byte {
+	if x != nil {
+		return x.Body
+	}
+	return nil
+}
+
+func (x *RequestV2) GetTrailers() []*FieldV2 {
+	if x != nil {
+		return x.Trailers
+	}
+	return nil
+}
+
+func (x *RequestV2) GetPadding() []byte {
+	if x != nil {
+		return x.Padding
+	}
+	return nil
+}
+
+// An informational (1xx) response received before the final response.
+type InformationalResponseV2 struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	StatusCode int32      `protobuf:"varint,1,opt,name=status_code,json=statusCode,proto3" json:"status_code,omitempty"`
+	Headers    []*FieldV2 `protobuf:"bytes,2,rep,name=headers,proto3" json:"headers,omitempty"`
+}
+
+func (x *InformationalResponseV2) Reset() {
+	*x = InformationalResponseV2{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_proto_http_v2_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *InformationalResponseV2) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*InformationalResponseV2) ProtoMessage() {}
+
+func (x *InformationalResponseV2) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_http_v2_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use InformationalResponseV2.ProtoReflect.Descriptor instead.
+func (*InformationalResponseV2) Descriptor() ([]byte, []int) {
+	return file_proto_http_v2_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *InformationalResponseV2) GetStatusCode() int32 {
+	if x != nil {
+		return x.StatusCode
+	}
+	return 0
+}
+
+func (x *InformationalResponseV2) GetHeaders() []*FieldV2 {
+	if x != nil {
+		return x.Headers
+	}
+	return nil
+}
+
+type ResponseV2 struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	InformationalResponses []*InformationalResponseV2 `protobuf:"bytes,1,rep,name=informational_responses,json=informationalResponses,proto3" json:"informational_responses,omitempty"`
+	// Control data of the final response
+	StatusCode int32 `protobuf:"varint,2,opt,name=status_code,json=statusCode,proto3" json:"status_code,omitempty"`
+	// Reason phrase of the status, which clients may ignore
+	Reason  string     `protobuf:"bytes,3,opt,name=reason,proto3" json:"reason,omitempty"`
+	Headers []*FieldV2 `protobuf:"bytes,4,rep,name=headers,proto3" json:"headers,omitempty"`
+	// Content
+	Body     []byte     `protobuf:"bytes,5,opt,name=body,proto3" json:"body,omitempty"`
+	Trailers []*FieldV2 `protobuf:"bytes,6,rep,name=trailers,proto3" json:"trailers,omitempty"`
+	// Padding
+	Padding []byte `protobuf:"bytes,7,opt,name=padding,proto3" json:"padding,omitempty"`
+}
+
+func (x *ResponseV2) Reset() {
+	*x = ResponseV2{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_proto_http_v2_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ResponseV2) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ResponseV2) ProtoMessage() {}
+
+func (x *ResponseV2) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_http_v2_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ResponseV2.ProtoReflect.Descriptor instead.
+func (*ResponseV2) Descriptor() ([]byte, []int) {
+	return file_proto_http_v2_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *ResponseV2) GetInformationalResponses() []*InformationalResponseV2 {
+	if x != nil {
+		return x.InformationalResponses
+	}
+	return nil
+}
+
+func (x *ResponseV2) GetStatusCode() int32 {
+	if x != nil {
+		return x.StatusCode
+	}
+	return 0
+}
+
+func (x *ResponseV2) GetReason() string {
+	if x != nil {
+		return x.Reason
+	}
+	return ""
+}
+
+func (x *ResponseV2) GetHeaders() []*FieldV2 {
+	if x != nil {
+		return x.Headers
+	}
+	return nil
+}
+
+func (x *ResponseV2) GetBody() []byte {
+	if x != nil {
+		return x.Body
+	}
+	return nil
+}
+
+func (x *ResponseV2) GetTrailers() []*FieldV2 {
+	if x != nil {
+		return x.Trailers
+	}
+	return nil
+}
+
+func (x *ResponseV2) GetPadding() []byte {
+	if x != nil {
+		return x.Padding
+	}
+	return nil
+}
+
+var File_proto_http_v2_proto protoreflect.FileDescriptor
+
+var file_proto_http_v2_proto_rawDesc = []byte{
+	0x0a, 0x13, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x5f, 0x68, 0x74, 0x74, 0x70, 0x5f, 0x76, 0x32, 0x2e,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x0c, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x68, 0x74, 0x74, 0x70,
+	0x2e, 0x76, 0x32, 0x22, 0x33, 0x0a, 0x07, 0x46, 0x69, 0x65, 0x6c, 0x64, 0x56, 0x32, 0x12, 0x12,
+	0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61,
+	0x6d, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x22, 0xa5, 0x04, 0x0a, 0x09, 0x52, 0x65, 0x71,
+	0x75, 0x65, 0x73, 0x74, 0x56, 0x32, 0x12, 0x36, 0x0a, 0x06, 0x6d, 0x65, 0x74, 0x68, 0x6f, 0x64,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x1e, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x68, 0x74,
+	0x74, 0x70, 0x2e, 0x76, 0x32, 0x2e, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x56, 0x32, 0x2e,
+	0x4d, 0x65, 0x74, 0x68, 0x6f, 0x64, 0x52, 0x06, 0x6d, 0x65, 0x74, 0x68, 0x6f, 0x64, 0x12, 0x29,
+	0x0a, 0x10, 0x65, 0x78, 0x74, 0x65, 0x6e, 0x73, 0x69, 0x6f, 0x6e, 0x5f, 0x6d, 0x65, 0x74, 0x68,
+	0x6f, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0f, 0x65, 0x78, 0x74, 0x65, 0x6e, 0x73,
+	0x69, 0x6f, 0x6e, 0x4d, 0x65, 0x74, 0x68, 0x6f, 0x64, 0x12, 0x36, 0x0a, 0x06, 0x73, 0x63, 0x68,
+	0x65, 0x6d, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x1e, 0x2e, 0x70, 0x72, 0x6f, 0x74,
+	0x6f, 0x68, 0x74, 0x74, 0x70, 0x2e, 0x76, 0x32, 0x2e, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
+	0x56, 0x32, 0x2e, 0x53, 0x63, 0x68, 0x65, 0x6d, 0x65, 0x52, 0x06, 0x73, 0x63, 0x68, 0x65, 0x6d,
+	0x65, 0x12, 0x1c, 0x0a, 0x09, 0x61, 0x75, 0x74, 0x68, 0x6f, 0x72, 0x69, 0x74, 0x79, 0x18, 0x04,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x61, 0x75, 0x74, 0x68, 0x6f, 0x72, 0x69, 0x74, 0x79, 0x12,
+	0x12, 0x0a, 0x04, 0x70, 0x61, 0x74, 0x68, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x70,
+	0x61, 0x74, 0x68, 0x12, 0x14, 0x0a, 0x05, 0x71, 0x75, 0x65, 0x72, 0x79, 0x18, 0x06, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x05, 0x71, 0x75, 0x65, 0x72, 0x79, 0x12, 0x2f, 0x0a, 0x07, 0x68, 0x65, 0x61,
+	0x64, 0x65, 0x72, 0x73, 0x18, 0x07, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x15, 0x2e, 0x70, 0x72, 0x6f,
+	0x74, 0x6f, 0x68, 0x74, 0x74, 0x70, 0x2e, 0x76, 0x32, 0x2e, 0x46, 0x69, 0x65, 0x6c, 0x64, 0x56,
+	0x32, 0x52, 0x07, 0x68, 0x65, 0x61, 0x64, 0x65, 0x72, 0x73, 0x12, 0x12, 0x0a, 0x04, 0x62, 0x6f,
+	0x64, 0x79, 0x18, 0x08, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x12, 0x31,
+	0x0a, 0x08, 0x74, 0x72, 0x61, 0x69, 0x6c, 0x65, 0x72, 0x73, 0x18, 0x09, 0x20, 0x03, 0x28, 0x0b,
+	0x32, 0x15, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x68, 0x74, 0x74, 0x70, 0x2e, 0x76, 0x32, 0x2e,
+	0x46, 0x69, 0x65, 0x6c, 0x64, 0x56, 0x32, 0x52, 0x08, 0x74, 0x72, 0x61, 0x69, 0x6c, 0x65, 0x72,
+	0x73, 0x12, 0x18, 0x0a, 0x07, 0x70, 0x61, 0x64, 0x64, 0x69, 0x6e, 0x67, 0x18, 0x0a, 0x20, 0x01,
+	0x28, 0x0c, 0x52, 0x07, 0x70, 0x61, 0x64, 0x64, 0x69, 0x6e, 0x67, 0x22, 0x6c, 0x0a, 0x06, 0x4d,
+	0x65, 0x74, 0x68, 0x6f, 0x64, 0x12, 0x0d, 0x0a, 0x09, 0x45, 0x58, 0x54, 0x45, 0x4e, 0x53, 0x49,
+	0x4f, 0x4e, 0x10, 0x00, 0x12, 0x07, 0x0a, 0x03, 0x47, 0x45, 0x54, 0x10, 0x01, 0x12, 0x08, 0x0a,
+	0x04, 0x48, 0x45, 0x41, 0x44, 0x10, 0x02, 0x12, 0x08, 0x0a, 0x04, 0x50, 0x4f, 0x53, 0x54, 0x10,
+	0x03, 0x12, 0x07, 0x0a, 0x03, 0x50, 0x55, 0x54, 0x10, 0x04, 0x12, 0x0a, 0x0a, 0x06, 0x44, 0x45,
+	0x4c, 0x45, 0x54, 0x45, 0x10, 0x05, 0x12, 0x09, 0x0a, 0x05, 0x50, 0x41, 0x54, 0x43, 0x48, 0x10,
+	0x06, 0x12, 0x0b, 0x0a, 0x07, 0x4f, 0x50, 0x54, 0x49, 0x4f, 0x4e, 0x53, 0x10, 0x07, 0x12, 0x09,
+	0x0a, 0x05, 0x54, 0x52, 0x41, 0x43, 0x45, 0x10, 0x08, 0x22, 0x35, 0x0a, 0x06, 0x53, 0x63, 0x68,
+	0x65, 0x6d, 0x65, 0x12, 0x16, 0x0a, 0x12, 0x53, 0x43, 0x48, 0x45, 0x4d, 0x45, 0x5f, 0x55, 0x4e,
+	0x53, 0x50, 0x45, 0x43, 0x49, 0x46, 0x49, 0x45, 0x44, 0x10, 0x00, 0x12, 0x08, 0x0a, 0x04, 0x48,
+	0x54, 0x54, 0x50, 0x10, 0x01, 0x12, 0x09, 0x0a, 0x05, 0x48, 0x54, 0x54, 0x50, 0x53, 0x10, 0x02,
+	0x22, 0x6b, 0x0a, 0x17, 0x49, 0x6e, 0x66, 0x6f, 0x72, 0x6d, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x61,
+	0x6c, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x56, 0x32, 0x12, 0x1f, 0x0a, 0x0b, 0x73,
+	0x74, 0x61, 0x74, 0x75, 0x73, 0x5f, 0x63, 0x6f, 0x64, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05,
+	0x52, 0x0a, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x43, 0x6f, 0x64, 0x65, 0x12, 0x2f, 0x0a, 0x07,
+	0x68, 0x65, 0x61, 0x64, 0x65, 0x72, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x15, 0x2e,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x68, 0x74, 0x74, 0x70, 0x2e, 0x76, 0x32, 0x2e, 0x46, 0x69, 0x65,
+	0x6c, 0x64, 0x56, 0x32, 0x52, 0x07, 0x68, 0x65, 0x61, 0x64, 0x65, 0x72, 0x73, 0x22, 0xb7, 0x02,
+	0x0a, 0x0a, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x56, 0x32, 0x12, 0x5e, 0x0a, 0x17,
+	0x69, 0x6e, 0x66, 0x6f, 0x72, 0x6d, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x61, 0x6c, 0x5f, 0x72, 0x65,
+	0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x25, 0x2e,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x68, 0x74, 0x74, 0x70, 0x2e, 0x76, 0x32, 0x2e, 0x49, 0x6e, 0x66,
+	0x6f, 0x72, 0x6d, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x61, 0x6c, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e,
+	0x73, 0x65, 0x56, 0x32, 0x52, 0x16, 0x69, 0x6e, 0x66, 0x6f, 0x72, 0x6d, 0x61, 0x74, 0x69, 0x6f,
+	0x6e, 0x61, 0x6c, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x73, 0x12, 0x1f, 0x0a, 0x0b,
+	0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x5f, 0x63, 0x6f, 0x64, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x05, 0x52, 0x0a, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x43, 0x6f, 0x64, 0x65, 0x12, 0x16, 0x0a,
+	0x06, 0x72, 0x65, 0x61, 0x73, 0x6f, 0x6e, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x72,
+	0x65, 0x61, 0x73, 0x6f, 0x6e, 0x12, 0x2f, 0x0a, 0x07, 0x68, 0x65, 0x61, 0x64, 0x65, 0x72, 0x73,
+	0x18, 0x04, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x15, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x68, 0x74,
+	0x74, 0x70, 0x2e, 0x76, 0x32, 0x2e, 0x46, 0x69, 0x65, 0x6c, 0x64, 0x56, 0x32, 0x52, 0x07, 0x68,
+	0x65, 0x61, 0x64, 0x65, 0x72, 0x73, 0x12, 0x12, 0x0a, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x18, 0x05,
+	0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x12, 0x31, 0x0a, 0x08, 0x74, 0x72,
+	0x61, 0x69, 0x6c, 0x65, 0x72, 0x73, 0x18, 0x06, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x15, 0x2e, 0x70,
+	0x72, 0x6f, 0x74, 0x6f, 0x68, 0x74, 0x74, 0x70, 0x2e, 0x76, 0x32, 0x2e, 0x46, 0x69, 0x65, 0x6c,
+	0x64, 0x56, 0x32, 0x52, 0x08, 0x74, 0x72, 0x61, 0x69, 0x6c, 0x65, 0x72, 0x73, 0x12, 0x18, 0x0a,
+	0x07, 0x70, 0x61, 0x64, 0x64, 0x69, 0x6e, 0x67, 0x18, 0x07, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x07,
+	0x70, 0x61, 0x64, 0x64, 0x69, 0x6e, 0x67, 0x42, 0x0b, 0x5a, 0x09, 0x2e, 0x3b, 0x67, 0x61, 0x74,
+	0x65, 0x77, 0x61, 0x79, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_proto_http_v2_proto_rawDescOnce sync.Once
+	file_proto_http_v2_proto_rawDescData = file_proto_http_v2_proto_rawDesc
+)
+
+func file_proto_http_v2_proto_rawDescGZIP() []byte {
+	file_proto_http_v2_proto_rawDescOnce.Do(func() {
+		file_proto_http_v2_proto_rawDescData = protoimpl.X.CompressGZIP(file_proto_http_v2_proto_rawDescData)
+	})
+	return file_proto_http_v2_proto_rawDescData
+}
+
+var file_proto_http_v2_proto_enumTypes = make([]protoimpl.EnumInfo, 2)
+var file_proto_http_v2_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_proto_http_v2_proto_goTypes = []interface{}{
+	(RequestV2_Method)(0),           // 0: protohttp.v2.RequestV2.Method
+	(RequestV2_Scheme)(0),           // 1: protohttp.v2.RequestV2.Scheme
+	(*FieldV2)(nil),                 // 2: protohttp.v2.FieldV2
+	(*RequestV2)(nil),               // 3: protohttp.v2.RequestV2
+	(*InformationalResponseV2)(nil), // 4: protohttp.v2.InformationalResponseV2
+	(*ResponseV2)(nil),              // 5: protohttp.v2.ResponseV2
+}
+var file_proto_http_v2_proto_depIdxs = []int32{
+	0, // 0: protohttp.v2.RequestV2.method:type_name -> protohttp.v2.RequestV2.Method
+	1, // 1: protohttp.v2.RequestV2.scheme:type_name -> protohttp.v2.RequestV2.Scheme
+	2, // 2: protohttp.v2.RequestV2.headers:type_name -> protohttp.v2.FieldV2
+	2, // 3: protohttp.v2.RequestV2.trailers:type_name -> protohttp.v2.FieldV2
+	2, // 4: protohttp.v2.InformationalResponseV2.headers:type_name -> protohttp.v2.FieldV2
+	4, // 5: protohttp.v2.ResponseV2.informational_responses:type_name -> protohttp.v2.InformationalResponseV2
+	2, // 6: protohttp.v2.ResponseV2.headers:type_name -> protohttp.v2.FieldV2
+	2, // 7: protohttp.v2.ResponseV2.trailers:type_name -> protohttp.v2.FieldV2
+	8, // [8:8] is the sub-list for method output_type
+	8, // [8:8] is the sub-list for method input_type
+	8, // [8:8] is the sub-list for extension type_name
+	8, // [8:8] is the sub-list for extension extendee
+	0, // [0:8] is the sub-list for field type_name
+}
+
+func init() { file_proto_http_v2_proto_init() }
+func file_proto_http_v2_proto_init() {
+	if File_proto_http_v2_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_proto_http_v2_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*FieldV2); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_proto_http_v2_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*RequestV2); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_proto_http_v2_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*InformationalResponseV2); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_proto_http_v2_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ResponseV2); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_proto_http_v2_proto_rawDesc,
+			NumEnums:      2,
+			NumMessages:   4,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_proto_http_v2_proto_goTypes,
+		DependencyIndexes: file_proto_http_v2_proto_depIdxs,
+		EnumInfos:         file_proto_http_v2_proto_enumTypes,
+		MessageInfos:      file_proto_http_v2_proto_msgTypes,
+	}.Build()
+	File_proto_http_v2_proto = out.File
+	file_proto_http_v2_proto_rawDesc = nil
+	file_proto_http_v2_proto_goTypes = nil
+	file_proto_http_v2_proto_depIdxs = nil
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gateway
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// EgressProxy sends target requests through a forward proxy, either an HTTP proxy (using
+// CONNECT for HTTPS targets) or a SOCKS5 proxy. Proxy credentials are taken from the
+// userinfo of the proxy URL. Origins on the bypass list are connected to directly.
+type EgressProxy struct {
+	url    *url.URL
+	bypass []string
+}
+
+// NewEgressProxy creates an EgressProxy for the proxy at rawURL. Each bypass entry is either a
+// host name, which matches exactly, or a domain prefixed with "." or "*.", which matches all of
+// its subdomains. Entries may carry a port, in which case they only match that port.
+func NewEgressProxy(rawURL string, bypass []string) (*EgressProxy, error) {
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid egress proxy URL: %w", err)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported egress proxy scheme %q", proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("egress proxy URL %q has no host", proxyURL.Redacted())
+	}
+
+	entries := make([]string, 0, len(bypass))
+	for _, entry := range bypass {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		entries = append(entries, strings.TrimPrefix(entry, "*"))
+	}
+
+	return &EgressProxy{
+		url:    proxyURL,
+		bypass: entries,
+	}, nil
+}
+
+// WithCredentials returns a copy of p which authenticates to the proxy with the given username
+// and password instead of the userinfo of the proxy URL.
+func (p *EgressProxy) WithCredentials(username, password string) *EgressProxy {
+	proxyURL := *p.url
+	proxyURL.User = url.UserPassword(username, password)
+	return &EgressProxy{
+		url:    &proxyURL,
+		bypass: p.bypass,
+	}
+}
+
+// String returns the proxy URL with any password redacted.
+func (p *EgressProxy) String() string {
+	return p.url.Redacted()
+}
+
+func (p *EgressProxy) bypassed(target *url.URL) bool {
+	host := strings.ToLower(target.Hostname())
+	port := target.Port()
+	if port == "" {
+		if target.Scheme == "http" {
+			port = "80"
+		} else {
+			port = "443"
+		}
+	}
+
+	for _, entry := range p.bypass {
+		entryHost, entryPort := entry, ""
+		if splitHost, splitPort, err := net.SplitHostPort(entry); err == nil {
+			entryHost, entryPort = splitHost, splitPort
+		}
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+		if strings.HasPrefix(entryHost, ".") {
+			if strings.HasSuffix(host, entryHost) || host == entryHost[1:] {
+				return true
+			}
+		} else if host == entryHost {
+			return true
+		}
+	}
+	return false
+}
+
+// Proxy returns the proxy to use for req, or nil if req should not be proxied. It is suitable
+// for use as http.Transport.Proxy.
+func (p *EgressProxy) Proxy(req *http.Request) (*url.URL, error) {
+	if p.bypassed(req.URL) {
+		return nil, nil
+	}
+	return p.url, nil
+}
+
+// Transport returns a copy of the default transport that sends requests through the proxy.
+func (p *EgressProxy) Transport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = p.Proxy
+	return transport
+}
+
+// DirectTransport returns a copy of the default transport that never uses a proxy. Unlike the
+// default transport, it ignores the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables,
+// so target requests only go through a proxy that is explicitly configured.
+func DirectTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	return transport
+}
@@ -0,0 +1,361 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gateway
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+const (
+	testProxyUsername = "gateway"
+	testProxyPassword = "hunter2"
+)
+
+// standInHTTPProxy is a minimal forward proxy supporting CONNECT tunnels and absolute-form
+// requests, which requires basic proxy authentication.
+type standInHTTPProxy struct {
+	requests int32
+}
+
+func (p *standInHTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&p.requests, 1)
+
+	credentials := base64.StdEncoding.EncodeToString([]byte(testProxyUsername + ":" + testProxyPassword))
+	if r.Header.Get("Proxy-Authorization") != "Basic "+credentials {
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+
+	if r.Method != http.MethodConnect {
+		r.RequestURI = ""
+		r.Header.Del("Proxy-Authorization")
+		resp, err := http.DefaultTransport.RoundTrip(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	targetConn, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	clientConn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		targetConn.Close()
+		return
+	}
+	clientConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	pipe(clientConn, targetConn)
+}
+
+func pipe(a, b net.Conn) {
+	go func() {
+		io.Copy(a, b)
+		a.Close()
+	}()
+	io.Copy(b, a)
+	b.Close()
+}
+
+// startStandInSOCKS5Proxy runs a minimal SOCKS5 proxy (RFC 1928) that requires
+// username/password authentication (RFC 1929) and supports the CONNECT command.
+func startStandInSOCKS5Proxy(t *testing.T) (string, *int32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var requests int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&requests, 1)
+			go serveSOCKS5(conn)
+		}
+	}()
+	return listener.Addr().String(), &requests
+}
+
+func serveSOCKS5(conn net.Conn) {
+	readBytes := func(n int) []byte {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil
+		}
+		return b
+	}
+
+	// Method negotiation: require username/password authentication
+	header := readBytes(2)
+	if header == nil || header[0] != 5 || readBytes(int(header[1])) == nil {
+		conn.Close()
+		return
+	}
+	conn.Write([]byte{5, 2})
+
+	authHeader := readBytes(2)
+	if authHeader == nil {
+		conn.Close()
+		return
+	}
+	username := readBytes(int(authHeader[1]))
+	passwordLength := readBytes(1)
+	if username == nil || passwordLength == nil {
+		conn.Close()
+		return
+	}
+	password := readBytes(int(passwordLength[0]))
+	if string(username) != testProxyUsername || string(password) != testProxyPassword {
+		conn.Write([]byte{1, 1})
+		conn.Close()
+		return
+	}
+	conn.Write([]byte{1, 0})
+
+	// CONNECT request
+	request := readBytes(4)
+	if request == nil || request[1] != 1 {
+		conn.Close()
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		host = net.IP(readBytes(4)).String()
+	case 3:
+		length := readBytes(1)
+		if length == nil {
+			conn.Close()
+			return
+		}
+		host = string(readBytes(int(length[0])))
+	case 4:
+		host = net.IP(readBytes(16)).String()
+	}
+	port := readBytes(2)
+	if port == nil {
+		conn.Close()
+		return
+	}
+
+	targetConn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		conn.Close()
+		return
+	}
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	pipe(conn, targetConn)
+}
+
+func createTestTarget(t *testing.T, tls bool) *httptest.Server {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	})
+	var server *httptest.Server
+	if tls {
+		server = httptest.NewTLSServer(handler)
+	} else {
+		server = httptest.NewServer(handler)
+	}
+	t.Cleanup(server.Close)
+	return server
+}
+
+func fetchThroughProxy(t *testing.T, proxy *EgressProxy, target *httptest.Server) (*http.Response, error) {
+	transport := proxy.Transport()
+	if targetTransport, ok := target.Client().Transport.(*http.Transport); ok && targetTransport.TLSClientConfig != nil {
+		transport.TLSClientConfig = targetTransport.TLSClientConfig.Clone()
+	}
+	handler := FilteredHttpRequestHandler{
+		client: &http.Client{Transport: transport},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, target.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handler.Handle(req, &MockMetrics{resultLabels: map[string]bool{}})
+}
+
+func expectBody(t *testing.T, resp *http.Response, expected string) {
+	t.Helper()
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != expected {
+		t.Fatalf("Expected body %q, got %q", expected, body)
+	}
+}
+
+func TestEgressProxyHTTPConnect(t *testing.T) {
+	standIn := &standInHTTPProxy{}
+	proxyServer := httptest.NewServer(standIn)
+	defer proxyServer.Close()
+	target := createTestTarget(t, true)
+
+	proxy, err := NewEgressProxy(proxyServer.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy = proxy.WithCredentials(testProxyUsername, testProxyPassword)
+
+	resp, err := fetchThroughProxy(t, proxy, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectBody(t, resp, "hello")
+	if got := atomic.LoadInt32(&standIn.requests); got != 1 {
+		t.Fatalf("Expected 1 request through the proxy, got %d", got)
+	}
+}
+
+func TestEgressProxyHTTPForward(t *testing.T) {
+	standIn := &standInHTTPProxy{}
+	proxyServer := httptest.NewServer(standIn)
+	defer proxyServer.Close()
+	target := createTestTarget(t, false)
+
+	proxyURL, err := url.Parse(proxyServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyURL.User = url.UserPassword(testProxyUsername, testProxyPassword)
+	proxy, err := NewEgressProxy(proxyURL.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := fetchThroughProxy(t, proxy, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectBody(t, resp, "hello")
+	if got := atomic.LoadInt32(&standIn.requests); got != 1 {
+		t.Fatalf("Expected 1 request through the proxy, got %d", got)
+	}
+}
+
+func TestEgressProxyAuthenticationRequired(t *testing.T) {
+	proxyServer := httptest.NewServer(&standInHTTPProxy{})
+	defer proxyServer.Close()
+	target := createTestTarget(t, true)
+
+	proxy, err := NewEgressProxy(proxyServer.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fetchThroughProxy(t, proxy, target); err == nil {
+		t.Fatal("Expected the request to fail without proxy credentials")
+	}
+}
+
+func TestEgressProxySOCKS5(t *testing.T) {
+	proxyAddr, requests := startStandInSOCKS5Proxy(t)
+	target := createTestTarget(t, true)
+
+	proxy, err := NewEgressProxy("socks5://"+proxyAddr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy = proxy.WithCredentials(testProxyUsername, testProxyPassword)
+
+	resp, err := fetchThroughProxy(t, proxy, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectBody(t, resp, "hello")
+	if got := atomic.LoadInt32(requests); got != 1 {
+		t.Fatalf("Expected 1 connection through the proxy, got %d", got)
+	}
+}
+
+func TestEgressProxyBypass(t *testing.T) {
+	standIn := &standInHTTPProxy{}
+	proxyServer := httptest.NewServer(standIn)
+	defer proxyServer.Close()
+	target := createTestTarget(t, false)
+
+	proxy, err := NewEgressProxy(proxyServer.URL, []string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := fetchThroughProxy(t, proxy, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectBody(t, resp, "hello")
+	if got := atomic.LoadInt32(&standIn.requests); got != 0 {
+		t.Fatalf("Expected no requests through the proxy, got %d", got)
+	}
+}
+
+func TestEgressProxyBypassMatching(t *testing.T) {
+	proxy, err := NewEgressProxy("http://proxy.internal:3128", []string{"exact.example", ".suffix.example", "*.wildcard.example", "ported.example:8443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]bool{
+		"https://exact.example/":           true,
+		"https://sub.exact.example/":       false,
+		"https://suffix.example/":          true,
+		"https://a.b.suffix.example/":      true,
+		"https://notsuffix.example/":       false,
+		"https://api.wildcard.example/":    true,
+		"https://ported.example:8443/":     true,
+		"https://ported.example/":          false,
+		"http://other.example/":            false,
+		"https://EXACT.example/path?query": true,
+	}
+	for rawURL, expected := range cases {
+		target, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := proxy.bypassed(target); got != expected {
+			t.Errorf("bypassed(%s) = %v, expected %v", rawURL, got, expected)
+		}
+	}
+}
+
+func TestEgressProxyInvalidScheme(t *testing.T) {
+	if _, err := NewEgressProxy("ftp://proxy.internal", nil); err == nil {
+		t.Fatal("Expected an unsupported proxy scheme to be rejected")
+	}
+}
+
+func TestDirectTransportIgnoresProxyEnvironment(t *testing.T) {
+	t.Setenv("HTTP_PROXY", "http://proxy.internal:3128")
+	t.Setenv("HTTPS_PROXY", "http://proxy.internal:3128")
+
+	request := httptest.NewRequest(http.MethodGet, "https://"+ALLOWED_TARGET+"/", nil)
+	if proxy := DirectTransport().Proxy; proxy != nil {
+		proxyURL, err := proxy(request)
+		t.Fatalf("Expected no proxy, got %v (%v)", proxyURL, err)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gateway
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Metrics constants
+	metricsResultRelayUnauthenticated = "relay_unauthenticated"
+	metricsTagRelay                   = "relay"
+
+	// Header carrying the HMAC of a relayed request, for example:
+	//   Relay-Authorization: HMAC-SHA256 keyid="relay-a", ts="1700000000", sig="<base64>"
+	relayAuthorizationHeader = "Relay-Authorization"
+	relayAuthorizationScheme = "HMAC-SHA256"
+)
+
+var ErrRelayUnauthenticated = errors.New("request was not sent by an allowed relay")
+
+// RelayAuthenticator identifies the relay that forwarded a request to the gateway. Requests
+// that do not come through an allowed relay bypass the relay's IP unlinkability, so the gateway
+// rejects them.
+type RelayAuthenticator interface {
+	// Authenticate returns the identity of the relay that sent r, or ErrRelayUnauthenticated.
+	Authenticate(r *http.Request) (string, error)
+}
+
+// ClientCertificateRelayAuthenticator authenticates relays by the TLS client certificate they
+// present. The certificate chain is verified against the relay CAs during the TLS handshake.
+type ClientCertificateRelayAuthenticator struct {
+	// Identities of allowed relays, matching a DNS or URI SAN, the subject common name or the
+	// complete subject of the client certificate. If empty, any certificate issued by a relay CA
+	// is allowed.
+	allowedIdentities []string
+}
+
+// NewClientCertificateRelayAuthenticator creates a ClientCertificateRelayAuthenticator allowing
+// relays with any of the given identities, or any relay if there are none.
+func NewClientCertificateRelayAuthenticator(allowedIdentities []string) ClientCertificateRelayAuthenticator {
+	return ClientCertificateRelayAuthenticator{
+		allowedIdentities: allowedIdentities,
+	}
+}
+
+// certificateIdentities lists the identities of a certificate in order of preference.
+func certificateIdentities(certificate *x509.Certificate) []string {
+	identities := append([]string{}, certificate.DNSNames...)
+	for _, uri := range certificate.URIs {
+		identities = append(identities, uri.String())
+	}
+	if certificate.Subject.CommonName != "" {
+		identities = append(identities, certificate.Subject.CommonName)
+	}
+	return append(identities, certificate.Subject.String())
+}
+
+func (a ClientCertificateRelayAuthenticator) Authenticate(r *http.Request) (string, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", ErrRelayUnauthenticated
+	}
+
+	identities := certificateIdentities(r.TLS.VerifiedChains[0][0])
+	if len(a.allowedIdentities) == 0 {
+		return identities[0], nil
+	}
+	for _, identity := range identities {
+		for _, allowed := range a.allowedIdentities {
+			if identity == allowed {
+				return allowed, nil
+			}
+		}
+	}
+	return "", ErrRelayUnauthenticated
+}
+
+// HMACRelayAuthenticator authenticates relays by an HMAC-SHA256 over the method, path and body
+// of the request and the time it was sent, keyed by a secret shared with the relay. Relays are
+// identified by the ID of their key, so keys can be rotated by adding a key with a new ID before
+// removing the old one. Verification is cheap compared to decapsulating the request, so it also
+// filters floods of requests not sent by a relay.
+type HMACRelayAuthenticator struct {
+	keys    map[string][]byte
+	maxSkew time.Duration
+	now     func() time.Time
+}
+
+// NewHMACRelayAuthenticator creates an HMACRelayAuthenticator accepting the given keys, by key
+// ID, for requests sent at most maxSkew before or after the current time.
+func NewHMACRelayAuthenticator(keys map[string][]byte, maxSkew time.Duration) *HMACRelayAuthenticator {
+	return &HMACRelayAuthenticator{
+		keys:    keys,
+		maxSkew: maxSkew,
+		now:     time.Now,
+	}
+}
+
+// relaySignature computes the HMAC of a request as sent by a relay.
+func relaySignature(key []byte, method, path string, timestamp int64, body []byte) []byte {
+	digest := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%s", method, path, timestamp, hex.EncodeToString(digest[:]))
+	return mac.Sum(nil)
+}
+
+// parseRelayAuthorization parses the parameters of a Relay-Authorization header.
+func parseRelayAuthorization(header string) (map[string]string, bool) {
+	parameters, ok := strings.CutPrefix(header, relayAuthorizationScheme+" ")
+	if !ok {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for _, parameter := range strings.Split(parameters, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(parameter), "=")
+		if !ok {
+			return nil, false
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		params[name] = value
+	}
+	return params, true
+}
+
+func (a *HMACRelayAuthenticator) Authenticate(r *http.Request) (string, error) {
+	params, ok := parseRelayAuthorization(r.Header.Get(relayAuthorizationHeader))
+	if !ok {
+		return "", ErrRelayUnauthenticated
+	}
+	keyID := params["keyid"]
+	key, ok := a.keys[keyID]
+	if !ok {
+		return "", fmt.Errorf("%w: unknown relay key %q", ErrRelayUnauthenticated, keyID)
+	}
+	timestamp, err := strconv.ParseInt(params["ts"], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid timestamp", ErrRelayUnauthenticated)
+	}
+	if skew := a.now().Sub(time.Unix(timestamp, 0)); skew > a.maxSkew || skew < -a.maxSkew {
+		return "", fmt.Errorf("%w: timestamp outside of the allowed window", ErrRelayUnauthenticated)
+	}
+	signature, err := base64.StdEncoding.DecodeString(params["sig"])
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid signature encoding", ErrRelayUnauthenticated)
+	}
+
+	// Read the body to authenticate it, and leave it for the gateway to read again. Oversized
+	// bodies are rejected rather than truncated, like the gateway does.
+	body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxRequestBodySize))
+	if err != nil {
+		return "", fmt.Errorf("%w: reading request body failed: %w", ErrRelayUnauthenticated, err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	if !hmac.Equal(signature, relaySignature(key, r.Method, r.URL.Path, timestamp, body)) {
+		return "", fmt.Errorf("%w: signature mismatch", ErrRelayUnauthenticated)
+	}
+	return keyID, nil
+}
+
+// AnyRelayAuthenticator accepts requests that any of its authenticators accepts, so that relays
+// can use different authentication schemes.
+type AnyRelayAuthenticator []RelayAuthenticator
+
+func (a AnyRelayAuthenticator) Authenticate(r *http.Request) (string, error) {
+	err := ErrRelayUnauthenticated
+	for _, authenticator := range a {
+		var identity string
+		if identity, err = authenticator.Authenticate(r); err == nil {
+			return identity, nil
+		}
+		// The body is only partially read, so no other authenticator can check it
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			return "", err
+		}
+	}
+	return "", err
+}
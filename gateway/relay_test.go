@@ -0,0 +1,277 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gateway
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+func createTestCA(t *testing.T) testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Relay CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCA{certificate: certificate, key: key}
+}
+
+// issueRelayConnectionState issues a client certificate from ca and returns the connection state
+// of a TLS connection that presented it, as seen by the gateway after verifying it.
+func (ca testCA) issueRelayConnectionState(t *testing.T, commonName string, dnsNames []string, uris []*url.URL) *tls.ConnectionState {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"Relay Operator"}},
+		DNSNames:     dnsNames,
+		URIs:         uris,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.certificate)
+	chains, err := certificate.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{certificate},
+		VerifiedChains:   chains,
+	}
+}
+
+func TestClientCertificateRelayAuthenticator(t *testing.T) {
+	ca := createTestCA(t)
+	spiffeID, _ := url.Parse("spiffe://relays.example/relay-b")
+	relayA := ca.issueRelayConnectionState(t, "relay-a", []string{"relay-a.example"}, nil)
+	relayB := ca.issueRelayConnectionState(t, "relay-b", nil, []*url.URL{spiffeID})
+	other := ca.issueRelayConnectionState(t, "other", []string{"other.example"}, nil)
+
+	authenticator := ClientCertificateRelayAuthenticator{
+		allowedIdentities: []string{"relay-a.example", spiffeID.String(), "CN=other,O=Relay Operator"},
+	}
+	cases := []struct {
+		state    *tls.ConnectionState
+		identity string
+	}{
+		{relayA, "relay-a.example"},
+		{relayB, spiffeID.String()},
+		{other, "CN=other,O=Relay Operator"},
+		{&tls.ConnectionState{}, ""},
+		{nil, ""},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodPost, DefaultGatewayEndpoint, nil)
+		req.TLS = c.state
+		identity, err := authenticator.Authenticate(req)
+		if c.identity == "" {
+			if err != ErrRelayUnauthenticated {
+				t.Fatalf("Expected %v, got identity %q and error %v", ErrRelayUnauthenticated, identity, err)
+			}
+		} else if err != nil || identity != c.identity {
+			t.Fatalf("Expected identity %q, got %q and error %v", c.identity, identity, err)
+		}
+	}
+
+	authenticator.allowedIdentities = []string{"relay-a.example"}
+	req := httptest.NewRequest(http.MethodPost, DefaultGatewayEndpoint, nil)
+	req.TLS = other
+	if _, err := authenticator.Authenticate(req); err != ErrRelayUnauthenticated {
+		t.Fatalf("Expected a relay outside the allowed identities to be rejected, got %v", err)
+	}
+}
+
+func TestGatewayHandlerRejectsNonRelayTraffic(t *testing.T) {
+	ca := createTestCA(t)
+	target := createMockEchoGatewayServer(t)
+	target.relayAuthenticator = ClientCertificateRelayAuthenticator{
+		allowedIdentities: []string{"relay-a.example"},
+	}
+	handler := http.HandlerFunc(target.gatewayHandler)
+
+	// A direct request is rejected before it is processed
+	req := httptest.NewRequest(http.MethodGet, DefaultEchoEndpoint, nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected %d, got %d", http.StatusForbidden, rr.Code)
+	}
+	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultRelayUnauthenticated)
+
+	// A request from an allowed relay is processed and tagged with the relay identity
+	req = httptest.NewRequest(http.MethodGet, DefaultEchoEndpoint, nil)
+	req.TLS = ca.issueRelayConnectionState(t, "relay-a", []string{"relay-a.example"}, nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected the relayed request to reach method validation, got %d", rr.Code)
+	}
+	metrics := mustGetMetricsFactory(t, target).metrics[1]
+	if metrics.tags[metricsTagRelay] != "relay-a.example" || !metrics.resultLabels[metricsResultInvalidMethod] {
+		t.Fatalf("Expected the request to be tagged with its relay, got tags %v and results %v", metrics.tags, metrics.resultLabels)
+	}
+}
+
+func signRelayRequest(req *http.Request, keyID string, key []byte, timestamp int64, body []byte) {
+	signature := relaySignature(key, req.Method, req.URL.Path, timestamp, body)
+	req.Header.Set(relayAuthorizationHeader, fmt.Sprintf(`%s keyid="%s", ts="%d", sig="%s"`,
+		relayAuthorizationScheme, keyID, timestamp, base64.StdEncoding.EncodeToString(signature)))
+}
+
+func TestHMACRelayAuthenticator(t *testing.T) {
+	currentKey := bytes.Repeat([]byte{1}, 32)
+	previousKey := bytes.Repeat([]byte{2}, 32)
+	authenticator := NewHMACRelayAuthenticator(map[string][]byte{
+		"relay-2": currentKey,
+		"relay-1": previousKey,
+	}, time.Minute)
+	clock := &fakeClock{now: time.Now()}
+	authenticator.now = clock.Now
+	body := []byte("encapsulated request")
+
+	newRequest := func() *http.Request {
+		return httptest.NewRequest(http.MethodPost, DefaultGatewayEndpoint, bytes.NewReader(body))
+	}
+
+	// Both the current and the previous key are accepted, and the body can be read again
+	for keyID, key := range map[string][]byte{"relay-2": currentKey, "relay-1": previousKey} {
+		req := newRequest()
+		signRelayRequest(req, keyID, key, clock.now.Unix(), body)
+		identity, err := authenticator.Authenticate(req)
+		if err != nil || identity != keyID {
+			t.Fatalf("Expected identity %s, got %q and error %v", keyID, identity, err)
+		}
+		if remaining, _ := io.ReadAll(req.Body); !bytes.Equal(remaining, body) {
+			t.Fatalf("Expected the body to be readable after authentication, got %q", remaining)
+		}
+	}
+
+	cases := map[string]func(req *http.Request){
+		"missing header": func(req *http.Request) {},
+		"unknown key": func(req *http.Request) {
+			signRelayRequest(req, "relay-3", currentKey, clock.now.Unix(), body)
+		},
+		"wrong key": func(req *http.Request) {
+			signRelayRequest(req, "relay-2", previousKey, clock.now.Unix(), body)
+		},
+		"stale timestamp": func(req *http.Request) {
+			signRelayRequest(req, "relay-2", currentKey, clock.now.Add(-2*time.Minute).Unix(), body)
+		},
+		"future timestamp": func(req *http.Request) {
+			signRelayRequest(req, "relay-2", currentKey, clock.now.Add(2*time.Minute).Unix(), body)
+		},
+		"tampered body": func(req *http.Request) {
+			signRelayRequest(req, "relay-2", currentKey, clock.now.Unix(), []byte("another request"))
+		},
+		"other path": func(req *http.Request) {
+			other := httptest.NewRequest(http.MethodPost, DefaultEchoEndpoint, nil)
+			signRelayRequest(other, "relay-2", currentKey, clock.now.Unix(), body)
+			req.Header.Set(relayAuthorizationHeader, other.Header.Get(relayAuthorizationHeader))
+		},
+	}
+	for name, prepare := range cases {
+		req := newRequest()
+		prepare(req)
+		if _, err := authenticator.Authenticate(req); !errors.Is(err, ErrRelayUnauthenticated) {
+			t.Fatalf("%s: expected %v, got %v", name, ErrRelayUnauthenticated, err)
+		}
+	}
+}
+
+func TestHMACRelayAuthenticatorOversizedBody(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	authenticator := AnyRelayAuthenticator{
+		NewHMACRelayAuthenticator(map[string][]byte{"cdn-relay": key}, time.Minute),
+	}
+	body := make([]byte, maxRequestBodySize+1)
+	req := httptest.NewRequest(http.MethodPost, DefaultGatewayEndpoint, bytes.NewReader(body))
+	signRelayRequest(req, "cdn-relay", key, time.Now().Unix(), body)
+
+	_, err := authenticator.Authenticate(req)
+	var maxBytesError *http.MaxBytesError
+	if !errors.Is(err, ErrRelayUnauthenticated) || !errors.As(err, &maxBytesError) {
+		t.Fatalf("Expected an oversized body to be rejected, got %v", err)
+	}
+}
+
+func TestAnyRelayAuthenticator(t *testing.T) {
+	ca := createTestCA(t)
+	key := bytes.Repeat([]byte{1}, 32)
+	authenticator := AnyRelayAuthenticator{
+		ClientCertificateRelayAuthenticator{},
+		NewHMACRelayAuthenticator(map[string][]byte{"cdn-relay": key}, time.Minute),
+	}
+
+	req := httptest.NewRequest(http.MethodPost, DefaultGatewayEndpoint, nil)
+	req.TLS = ca.issueRelayConnectionState(t, "relay-a", []string{"relay-a.example"}, nil)
+	if identity, err := authenticator.Authenticate(req); err != nil || identity != "relay-a.example" {
+		t.Fatalf("Expected the certificate relay to be accepted, got %q and error %v", identity, err)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, DefaultGatewayEndpoint, nil)
+	signRelayRequest(req, "cdn-relay", key, time.Now().Unix(), nil)
+	if identity, err := authenticator.Authenticate(req); err != nil || identity != "cdn-relay" {
+		t.Fatalf("Expected the HMAC relay to be accepted, got %q and error %v", identity, err)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, DefaultGatewayEndpoint, nil)
+	if _, err := authenticator.Authenticate(req); !errors.Is(err, ErrRelayUnauthenticated) {
+		t.Fatalf("Expected %v, got %v", ErrRelayUnauthenticated, err)
+	}
+}
@@ -0,0 +1,261 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gateway
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Metrics constants
+	metricsResultTargetRequestRetry       = "request_retry"
+	metricsResultRetryBudgetExhausted     = "retry_budget_exhausted"
+	metricsResultRetryAfterBeyondMaxDelay = "retry_after_exceeded"
+
+	// Upper bound on the number of origins tracked by a retry budget. Clients control
+	// the target authority, so the set of origins must not be allowed to grow unbounded.
+	maxTrackedOrigins = 1024
+
+	// Number of retry tokens each origin starts with, and the most it can accumulate.
+	retryBudgetBurst = 10
+)
+
+// RetryPolicy describes how target requests that failed with a transient error are retried.
+// Only idempotent requests whose body can be replayed are retried, and retries to each
+// origin are limited by a budget proportional to the number of requests sent to it.
+type RetryPolicy struct {
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	budget      *retryBudget
+}
+
+// NewRetryPolicy creates a RetryPolicy that makes at most maxAttempts attempts per request,
+// waiting a jittered, exponentially growing delay between baseDelay and maxDelay between
+// attempts. budgetRatio is the fraction of requests to an origin that may be retried.
+func NewRetryPolicy(maxAttempts int, baseDelay, maxDelay time.Duration, budgetRatio float64) *RetryPolicy {
+	return &RetryPolicy{
+		maxAttempts: maxAttempts,
+		baseDelay:   baseDelay,
+		maxDelay:    maxDelay,
+		budget: &retryBudget{
+			ratio:  budgetRatio,
+			tokens: make(map[string]float64),
+		},
+	}
+}
+
+// retryBudget is a per-origin token bucket. Every request deposits a fraction of a token
+// and every retry withdraws a whole one, so that retries cannot multiply the load on an
+// origin that is already failing.
+type retryBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	tokens map[string]float64
+}
+
+func (b *retryBudget) deposit(origin string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	tokens, ok := b.tokens[origin]
+	if !ok {
+		if len(b.tokens) >= maxTrackedOrigins {
+			for evicted := range b.tokens {
+				delete(b.tokens, evicted)
+				break
+			}
+		}
+		tokens = retryBudgetBurst
+	}
+	tokens += b.ratio
+	if tokens > retryBudgetBurst {
+		tokens = retryBudgetBurst
+	}
+	b.tokens[origin] = tokens
+}
+
+func (b *retryBudget) withdraw(origin string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.tokens[origin] < 1 {
+		return false
+	}
+	b.tokens[origin]--
+	return true
+}
+
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	default:
+		return false
+	}
+}
+
+func isReplayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+func isRetryableStatus(status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// isRetryableError reports whether err is likely to be transient. Failures that will
+// deterministically recur, such as unknown hosts or invalid certificates, are not retried.
+func isRetryableError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return false
+	}
+
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certificateErr x509.CertificateInvalidError
+	if errors.As(err, &unknownAuthorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &certificateErr) {
+		return false
+	}
+
+	return true
+}
+
+// retryAfter parses the Retry-After header of resp, which is either a number of
+// seconds or an HTTP date. It returns false if the header is absent or malformed.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
+
+// backoff returns a delay chosen uniformly at random between zero and the exponential
+// backoff ceiling for the given retry, so that concurrent retries do not synchronise.
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	ceiling := p.maxDelay
+	if shift := retry - 1; shift < 32 {
+		if delay := p.baseDelay << uint(shift); delay > 0 && delay < ceiling {
+			ceiling = delay
+		}
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// discardResponse drains a small amount of the response body so that the underlying
+// connection can be reused, and then closes it.
+func discardResponse(resp *http.Response) {
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	resp.Body.Close()
+}
+
+// Do sends req using client, retrying transient failures according to the policy. Each
+// retry fires a metrics result carrying the attempt number. A nil policy never retries.
+func (p *RetryPolicy) Do(client *http.Client, req *http.Request, metrics Metrics) (*http.Response, error) {
+	if p == nil || p.maxAttempts <= 1 || !isIdempotentMethod(req.Method) || !isReplayable(req) {
+		return client.Do(req)
+	}
+
+	origin := req.Host
+	p.budget.deposit(origin)
+
+	attemptReq := req
+	for attempt := 1; ; attempt++ {
+		resp, err := client.Do(attemptReq)
+
+		var delay time.Duration
+		if err != nil {
+			if !isRetryableError(err) {
+				return nil, err
+			}
+			delay = p.backoff(attempt)
+		} else {
+			if !isRetryableStatus(resp.StatusCode) {
+				return resp, nil
+			}
+			delay = p.backoff(attempt)
+			if after, ok := retryAfter(resp); ok {
+				if after > p.maxDelay {
+					metrics.Fire(metricsResultRetryAfterBeyondMaxDelay)
+					return resp, nil
+				}
+				if after > delay {
+					delay = after
+				}
+			}
+		}
+
+		if attempt >= p.maxAttempts {
+			return resp, err
+		}
+		if !p.budget.withdraw(origin) {
+			metrics.Fire(metricsResultRetryBudgetExhausted)
+			return resp, err
+		}
+
+		nextReq := req.Clone(req.Context())
+		if req.GetBody != nil {
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return resp, err
+			}
+			nextReq.Body = body
+		}
+
+		if resp != nil {
+			discardResponse(resp)
+		}
+		if sleepErr := sleepContext(req.Context(), delay); sleepErr != nil {
+			return nil, sleepErr
+		}
+
+		metrics.Fire(fmt.Sprintf("%s_%d", metricsResultTargetRequestRetry, attempt))
+		attemptReq = nextReq
+	}
+}
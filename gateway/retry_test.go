@@ -0,0 +1,157 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gateway
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// createFlakyTarget returns a target that fails the first `failures` requests with the given
+// status, and succeeds afterwards, along with a counter of the requests it received.
+func createFlakyTarget(t *testing.T, failures int32, status int, retryAfter string) (*httptest.Server, *int32) {
+	var count int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		if atomic.AddInt32(&count, 1) <= failures {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(status)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+	return server, &count
+}
+
+func createRetryingHandler(server *httptest.Server, maxAttempts int) FilteredHttpRequestHandler {
+	return FilteredHttpRequestHandler{
+		client:      server.Client(),
+		retryPolicy: NewRetryPolicy(maxAttempts, time.Millisecond, 10*time.Millisecond, 0.1),
+	}
+}
+
+func TestRetryIdempotentRequest(t *testing.T) {
+	server, count := createFlakyTarget(t, 2, http.StatusServiceUnavailable, "")
+	handler := createRetryingHandler(server, 3)
+
+	req, err := http.NewRequest(http.MethodPut, server.URL, bytes.NewReader([]byte("payload")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := &MockMetrics{resultLabels: map[string]bool{}}
+	resp, err := handler.Handle(req, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if got := atomic.LoadInt32(count); got != 3 {
+		t.Fatalf("Expected 3 attempts, got %d", got)
+	}
+	for _, label := range []string{"request_retry_1", "request_retry_2", metricsResultSuccess} {
+		if !metrics.resultLabels[label] {
+			t.Fatalf("Expected metrics result %s to be fired", label)
+		}
+	}
+	if _, ok := metrics.phases[metricsPhaseTargetFetch]; !ok {
+		t.Fatalf("Expected phase %s to be recorded", metricsPhaseTargetFetch)
+	}
+}
+
+func TestRetrySkipsNonIdempotentRequest(t *testing.T) {
+	server, count := createFlakyTarget(t, 1, http.StatusBadGateway, "")
+	handler := createRetryingHandler(server, 3)
+
+	req, err := http.NewRequest(http.MethodPost, server.URL, bytes.NewReader([]byte("payload")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := handler.Handle(req, &MockMetrics{resultLabels: map[string]bool{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("Expected status %d, got %d", http.StatusBadGateway, resp.StatusCode)
+	}
+	if got := atomic.LoadInt32(count); got != 1 {
+		t.Fatalf("Expected 1 attempt, got %d", got)
+	}
+}
+
+func TestRetrySkipsUnreplayableBody(t *testing.T) {
+	server, count := createFlakyTarget(t, 1, http.StatusBadGateway, "")
+	handler := createRetryingHandler(server, 3)
+
+	req, err := http.NewRequest(http.MethodPut, server.URL, io.NopCloser(bytes.NewReader([]byte("payload"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := handler.Handle(req, &MockMetrics{resultLabels: map[string]bool{}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(count); got != 1 {
+		t.Fatalf("Expected 1 attempt, got %d", got)
+	}
+}
+
+func TestRetryHonoursRetryAfter(t *testing.T) {
+	server, count := createFlakyTarget(t, 1, http.StatusServiceUnavailable, "3600")
+	handler := createRetryingHandler(server, 3)
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := &MockMetrics{resultLabels: map[string]bool{}}
+	resp, err := handler.Handle(req, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status %d, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	if got := atomic.LoadInt32(count); got != 1 {
+		t.Fatalf("Expected 1 attempt, got %d", got)
+	}
+	if !metrics.resultLabels[metricsResultRetryAfterBeyondMaxDelay] {
+		t.Fatalf("Expected metrics result %s to be fired", metricsResultRetryAfterBeyondMaxDelay)
+	}
+}
+
+func TestRetryBudgetExhausted(t *testing.T) {
+	server, _ := createFlakyTarget(t, 1<<30, http.StatusServiceUnavailable, "")
+	handler := createRetryingHandler(server, 2)
+
+	exhausted := false
+	for i := 0; i < 2*retryBudgetBurst && !exhausted; i++ {
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		metrics := &MockMetrics{resultLabels: map[string]bool{}}
+		resp, err := handler.Handle(req, metrics)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		exhausted = metrics.resultLabels[metricsResultRetryBudgetExhausted]
+	}
+	if !exhausted {
+		t.Fatal("Expected the retry budget to be exhausted")
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/chris-wood/ohttp-go"
+)
+
+const (
+	// URL of the canary request encapsulated by the self-test. It is echoed, never sent.
+	selfTestCanaryURL = "https://self-test.invalid/canary"
+
+	// Time allowed for every check of a self-test run
+	selfTestTimeout = 10 * time.Second
+)
+
+// SelfTestCheck is the result of one check of a self-test run.
+type SelfTestCheck struct {
+	Name      string  `json:"name"`
+	OK        bool    `json:"ok"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+// SelfTestReport is the result of a self-test run. The gateway is ready if every check passed.
+type SelfTestReport struct {
+	Ready     bool            `json:"ready"`
+	CheckedAt time.Time       `json:"checked_at"`
+	Checks    []SelfTestCheck `json:"checks"`
+}
+
+// SelfTest checks that a gateway can serve requests end to end. For every key configuration, it
+// encapsulates a canary binary HTTP request, passes it through the encapsulation handler with the
+// echo application handler, and verifies the decapsulated response. It also probes target
+// origins that the gateway depends on.
+type SelfTest struct {
+	gateway      ohttp.Gateway
+	keyIDs       []uint8
+	client       *http.Client
+	probeOrigins []string
+	logger       *slog.Logger
+	report       atomic.Value // SelfTestReport
+}
+
+// SelfTest creates a self-test of the gateway that also probes the given target origins with its
+// upstream client. A probe fails if the origin cannot be reached or answers with a server error.
+// The self-test reports the gateway as not ready until it first runs.
+func (h *Handler) SelfTest(probeOrigins []string) *SelfTest {
+	t := &SelfTest{
+		gateway:      h.gateway,
+		keyIDs:       h.keyIDs,
+		client:       h.upstreamClient,
+		probeOrigins: probeOrigins,
+		logger:       h.logger,
+	}
+	t.report.Store(SelfTestReport{})
+	return t
+}
+
+// Report returns the result of the latest run.
+func (t *SelfTest) Report() SelfTestReport {
+	return t.report.Load().(SelfTestReport)
+}
+
+// Run runs every check and stores the result as the latest report.
+func (t *SelfTest) Run(ctx context.Context) SelfTestReport {
+	ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+
+	report := SelfTestReport{
+		Ready:     true,
+		CheckedAt: time.Now(),
+	}
+	check := func(name string, f func() error) {
+		startedAt := time.Now()
+		err := f()
+		result := SelfTestCheck{
+			Name:      name,
+			OK:        err == nil,
+			LatencyMs: float64(time.Since(startedAt).Microseconds()) / 1000,
+		}
+		if err != nil {
+			result.Error = err.Error()
+			report.Ready = false
+		}
+		report.Checks = append(report.Checks, result)
+	}
+	for _, keyID := range t.keyIDs {
+		keyID := keyID
+		check(fmt.Sprintf("key_config_%d", keyID), func() error {
+			return t.checkKeyConfig(keyID)
+		})
+	}
+	for _, origin := range t.probeOrigins {
+		origin := origin
+		check("origin_"+origin, func() error {
+			return t.probeOrigin(ctx, origin)
+		})
+	}
+
+	t.report.Store(report)
+	return report
+}
+
+// Watch runs the self-test immediately and then every interval until stop is closed, logging
+// whenever the gateway becomes ready or stops being ready.
+func (t *SelfTest) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	ready := true
+	for {
+		report := t.Run(context.Background())
+		if report.Ready != ready {
+			ready = report.Ready
+			if ready {
+				t.logger.Info("Self-test passed, gateway is ready")
+			} else {
+				for _, check := range report.Checks {
+					if !check.OK {
+						t.logger.Warn("Self-test check failed", "check", check.Name, "error", check.Error)
+					}
+				}
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkKeyConfig round trips a canary request through the echo handler with the key
+// configuration keyID.
+func (t *SelfTest) checkKeyConfig(keyID uint8) error {
+	client, err := t.gateway.Client(keyID)
+	if err != nil {
+		return err
+	}
+	canaryRequest, err := http.NewRequest(http.MethodGet, selfTestCanaryURL, nil)
+	if err != nil {
+		return err
+	}
+	binaryRequest := ohttp.BinaryRequest(*canaryRequest)
+	canary, err := binaryRequest.Marshal()
+	if err != nil {
+		return err
+	}
+
+	encapsulatedReq, requestContext, err := client.EncapsulateRequest(canary)
+	if err != nil {
+		return fmt.Errorf("encapsulating canary request failed: %w", err)
+	}
+	encapsulatedReq, err = ohttp.UnmarshalEncapsulatedRequest(encapsulatedReq.Marshal())
+	if err != nil {
+		return fmt.Errorf("parsing canary request failed: %w", err)
+	}
+
+	handler := DefaultEncapsulationHandler{
+		gateway:    t.gateway,
+		appHandler: EchoAppHandler{},
+	}
+	outerRequest, err := http.NewRequest(http.MethodPost, DefaultEchoEndpoint, nil)
+	if err != nil {
+		return err
+	}
+	encapsulatedResp, err := handler.Handle(outerRequest, encapsulatedReq, noopMetrics{})
+	if err != nil {
+		return fmt.Errorf("handling canary request failed: %w", err)
+	}
+
+	encapsulatedResp, err = ohttp.UnmarshalEncapsulatedResponse(encapsulatedResp.Marshal())
+	if err != nil {
+		return fmt.Errorf("parsing canary response failed: %w", err)
+	}
+	response, err := requestContext.DecapsulateResponse(encapsulatedResp)
+	if err != nil {
+		return fmt.Errorf("decapsulating canary response failed: %w", err)
+	}
+	if !bytes.Equal(response, canary) {
+		return errors.New("canary response does not match the request")
+	}
+	return nil
+}
+
+// probeOrigin checks that a target origin answers requests from the gateway.
+func (t *SelfTest) probeOrigin(ctx context.Context, origin string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, "https://"+origin+"/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("origin answered with status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/chris-wood/ohttp-go"
+	"github.com/cloudflare/circl/hpke"
+)
+
+func TestSelfTest(t *testing.T) {
+	config, err := ohttp.NewConfig(CURRENT_KEY_ID, hpke.KEM_X25519_KYBER768_DRAFT00, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyConfig, err := ohttp.NewConfig(LEGACY_KEY_ID, hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	healthyOrigin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer healthyOrigin.Close()
+	failingOrigin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failingOrigin.Close()
+
+	handler, err := New(WithKeys(config, legacyConfig), WithUpstreamClient(healthyOrigin.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin := func(server *httptest.Server) string {
+		return strings.TrimPrefix(server.URL, "https://")
+	}
+
+	selfTest := handler.SelfTest([]string{origin(healthyOrigin)})
+	if selfTest.Report().Ready {
+		t.Fatal("Expected the gateway not to be ready before the self-test runs")
+	}
+	report := selfTest.Run(context.Background())
+	if !report.Ready || len(report.Checks) != 3 {
+		t.Fatalf("Expected all checks to pass, got %+v", report)
+	}
+	for i, name := range []string{"key_config_1", "key_config_0", "origin_" + origin(healthyOrigin)} {
+		if report.Checks[i].Name != name || !report.Checks[i].OK {
+			t.Fatalf("Expected check %s to pass, got %+v", name, report.Checks[i])
+		}
+	}
+	if !selfTest.Report().Ready {
+		t.Fatal("Expected the latest report to be stored")
+	}
+
+	selfTest = handler.SelfTest([]string{origin(failingOrigin)})
+	report = selfTest.Run(context.Background())
+	if report.Ready || report.Checks[2].OK || report.Checks[2].Error == "" {
+		t.Fatalf("Expected the failing origin to fail the self-test, got %+v", report)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"github.com/chris-wood/ohttp-go"
+	"github.com/cloudflare/app-gateway-go/gateway"
+	"github.com/cloudflare/circl/hpke"
+)
+
+// KEMs that may be used for the primary key configuration, by configuration name. The legacy key
+// configuration always uses X25519.
+var keyConfigKEMs = map[string]hpke.KEM{
+	gateway.KEMName(hpke.KEM_X25519_KYBER768_DRAFT00): hpke.KEM_X25519_KYBER768_DRAFT00,
+	gateway.KEMName(hpke.KEM_X25519_HKDF_SHA256):      hpke.KEM_X25519_HKDF_SHA256,
+}
+
+var defaultKeyConfigKEM = gateway.KEMName(hpke.KEM_X25519_KYBER768_DRAFT00)
+
+func keyConfigKEMNames() []string {
+	names := make([]string, 0, len(keyConfigKEMs))
+	for name := range keyConfigKEMs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// legacyKeyID returns the key ID of the legacy configuration that old clients use for obtaining
+// configuration material. This will eventually be removed once all clients have been updated to
+// support the primary configuration ID.
+func legacyKeyID(configID uint8) uint8 {
+	return uint8((configID - 128) % 255)
+}
+
+// deriveKeyConfigs derives the primary and legacy key configurations of the gateway from seed.
+func deriveKeyConfigs(configID uint8, kemID hpke.KEM, seed []byte) (ohttp.PrivateConfig, ohttp.PrivateConfig, error) {
+	config, err := ohttp.NewConfigFromSeed(configID, kemID, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM, seed)
+	if err != nil {
+		return ohttp.PrivateConfig{}, ohttp.PrivateConfig{}, fmt.Errorf("failed to create gateway configuration from seed: %w", err)
+	}
+
+	// The legacy configuration is derived from a different seed so that its keys are independent
+	legacySeed := append([]byte{}, seed...)
+	legacySeed[len(legacySeed)-1] ^= 0xFF
+	legacyConfig, err := ohttp.NewConfigFromSeed(legacyKeyID(configID), hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM, legacySeed)
+	if err != nil {
+		return ohttp.PrivateConfig{}, ohttp.PrivateConfig{}, fmt.Errorf("failed to create legacy gateway configuration from seed: %w", err)
+	}
+	return config, legacyConfig, nil
+}
+
+// keyConfigs derives the key configurations described by the configuration. It fails if no
+// seed is configured, since the keys would then be random.
+func (c keysConfig) keyConfigs() (ohttp.PrivateConfig, ohttp.PrivateConfig, error) {
+	if c.Seed == "" {
+		return ohttp.PrivateConfig{}, ohttp.PrivateConfig{}, fmt.Errorf("no key seed configured (%s or keys.seed)", secretSeedEnvironmentVariable)
+	}
+	seed, err := hex.DecodeString(c.Seed)
+	if err != nil {
+		return ohttp.PrivateConfig{}, ohttp.PrivateConfig{}, err
+	}
+	return deriveKeyConfigs(uint8(c.ConfigID), keyConfigKEMs[c.KEM], seed)
+}
+
+// keyConfigFingerprint identifies a public key configuration by the SHA-256 digest of its
+// encoding, so that it can be compared with the configuration a client obtained.
+func keyConfigFingerprint(config ohttp.PublicConfig) string {
+	digest := sha256.Sum256(config.Marshal())
+	return hex.EncodeToString(digest[:])
+}
+
+// unmarshalKeyConfigs decodes either a list of key configurations as served with the
+// "application/ohttp-keys" content type, or a single key configuration as served on the
+// legacy configuration endpoint.
+func unmarshalKeyConfigs(data []byte) ([]ohttp.PublicConfig, error) {
+	var configs []ohttp.PublicConfig
+	for rest := data; len(rest) > 0; {
+		if len(rest) < 2 || len(rest) < 2+int(binary.BigEndian.Uint16(rest)) {
+			configs = nil
+			break
+		}
+		length := 2 + int(binary.BigEndian.Uint16(rest))
+		config, err := ohttp.UnmarshalPublicConfig(rest[2:length])
+		if err != nil {
+			configs = nil
+			break
+		}
+		configs = append(configs, config)
+		rest = rest[length:]
+	}
+	if len(configs) > 0 {
+		return configs, nil
+	}
+
+	config, err := ohttp.UnmarshalPublicConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("not a key configuration or list of key configurations: %w", err)
+	}
+	return []ohttp.PublicConfig{config}, nil
+}
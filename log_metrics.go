@@ -0,0 +1,58 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/cloudflare/app-gateway-go/gateway"
+)
+
+// LogMetrics logs every result, phase and message size of an event, for local development.
+type LogMetrics struct {
+	logger    *slog.Logger
+	eventName string
+	startedAt time.Time
+	tags      []any
+}
+
+func (m *LogMetrics) log(msg string, args ...any) {
+	args = append([]any{"event_name", m.eventName}, args...)
+	m.logger.Info(msg, append(args, m.tags...)...)
+}
+
+func (m *LogMetrics) Fire(result string) {
+	m.log("Metrics result", "result", result, "latency", time.Since(m.startedAt))
+}
+
+func (m *LogMetrics) ResponseStatus(prefix string, status int) {
+	m.Fire(fmt.Sprintf("%s_response_status_%d", prefix, status))
+}
+
+func (m *LogMetrics) Tag(name, value string) {
+	m.tags = append(m.tags, name, value)
+}
+
+func (m *LogMetrics) Phase(name string, duration time.Duration) {
+	m.log("Metrics phase", "phase", name, "duration", duration)
+}
+
+func (m *LogMetrics) MessageSize(name string, size int) {
+	m.log("Metrics message size", "message", name, "size", size)
+}
+
+// LogMetricsFactory creates LogMetrics writing to logger.
+type LogMetricsFactory struct {
+	logger *slog.Logger
+}
+
+func (f LogMetricsFactory) Create(eventName string) gateway.Metrics {
+	return &LogMetrics{
+		logger:    f.logger,
+		eventName: eventName,
+		startedAt: time.Now(),
+	}
+}
@@ -0,0 +1,30 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLogMetrics(t *testing.T) {
+	var output bytes.Buffer
+	factory := LogMetricsFactory{logger: slog.New(slog.NewTextHandler(&output, nil))}
+
+	metrics := factory.Create("gateway_request")
+	metrics.Tag("relay", "relay.example")
+	metrics.MessageSize("request", 1024)
+	metrics.Fire("success")
+
+	for _, expected := range []string{
+		`msg="Metrics message size" event_name=gateway_request message=request size=1024 relay=relay.example`,
+		`msg="Metrics result" event_name=gateway_request result=success latency=`,
+	} {
+		if !strings.Contains(output.String(), expected) {
+			t.Fatalf("Expected %q in:\n%s", expected, output.String())
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/cloudflare/app-gateway-go/gateway"
+)
+
+// Minimum levels of logged entries, by name
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// newLogger creates the logger of the gateway, writing to w. Private data is redacted from its
+// entries unless unredacted logs are enabled, in which case every entry is marked as unsafe.
+func newLogger(w io.Writer, cfg gatewayConfig) *slog.Logger {
+	level := logLevels[cfg.Log.Level]
+	if cfg.Debug.Verbose {
+		level = slog.LevelDebug
+	}
+	options := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	if cfg.Log.Format == logFormatJSON {
+		handler = slog.NewJSONHandler(w, options)
+	} else {
+		handler = slog.NewTextHandler(w, options)
+	}
+	logger := slog.New(gateway.NewRedactingHandler(handler, cfg.Debug.UnredactedLogs))
+	if cfg.Debug.UnredactedLogs {
+		logger = logger.With("unsafe_unredacted_logs", true)
+	}
+	return logger
+}
+
+// fatal logs an error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// Addresses of clients in the messages of net/http, such as "http: TLS handshake error from
+// 192.0.2.1:5678: EOF"
+var clientAddressPattern = regexp.MustCompile(`\[[0-9A-Fa-f:.%]+\]:\d+|\b\d{1,3}(\.\d{1,3}){3}:\d+`)
+
+// serverErrorWriter logs the messages of an http.Server with logger. The redacting handler only
+// redacts attributes, so client addresses are cut out of the messages and logged as a redacted
+// attribute instead.
+type serverErrorWriter struct {
+	logger *slog.Logger
+}
+
+func (w serverErrorWriter) Write(p []byte) (int, error) {
+	message := strings.TrimSuffix(string(p), "\n")
+	var args []any
+	if addresses := clientAddressPattern.FindAllString(message, -1); len(addresses) > 0 {
+		message = clientAddressPattern.ReplaceAllString(message, "<client>")
+		args = append(args, gateway.LogKeyClientIP, strings.Join(addresses, ","))
+	}
+	w.logger.Warn(message, args...)
+	return len(p), nil
+}
+
+// newServerErrorLog creates the error logger of an http.Server, logging to logger without the
+// addresses of clients in messages.
+func newServerErrorLog(logger *slog.Logger) *log.Logger {
+	return log.New(serverErrorWriter{logger: logger}, "", 0)
+}
@@ -0,0 +1,27 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestServerErrorLogRedactsClientAddresses(t *testing.T) {
+	var logs bytes.Buffer
+	errorLog := newServerErrorLog(newLogger(&logs, defaultGatewayConfig()))
+	errorLog.Printf("http: TLS handshake error from 192.0.2.1:5678: EOF")
+	errorLog.Printf("http2: server: error reading preface from client [2001:db8::1]:443: timeout")
+
+	output := logs.String()
+	for _, address := range []string{"192.0.2.1", "2001:db8::1"} {
+		if strings.Contains(output, address) {
+			t.Fatalf("Expected client address %s to be redacted in:\n%s", address, output)
+		}
+	}
+	if !strings.Contains(output, "TLS handshake error from <client>: EOF") {
+		t.Fatalf("Expected the rest of the message to be logged, got:\n%s", output)
+	}
+}
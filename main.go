@@ -6,17 +6,21 @@ package main
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
-	"strconv"
-	"strings"
+	"sync/atomic"
+	"time"
 
-	"github.com/chris-wood/ohttp-go"
-	"github.com/cloudflare/circl/hpke"
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/cloudflare/app-gateway-go/gateway"
 )
 
 const (
@@ -26,30 +30,108 @@ const (
 
 	// HTTP constants. Fill in your proxy and target here.
 	defaultPort                 = "8080"
-	defaultGatewayEndpoint      = "/gateway"
-	defaultConfigEndpoint       = "/ohttp-keys"
-	defaultLegacyConfigEndpoint = "/ohttp-configs"
-	defaultEchoEndpoint         = "/gateway-echo"
-	defaultMetadataEndpoint     = "/gateway-metadata"
+	defaultGatewayEndpoint      = gateway.DefaultGatewayEndpoint
+	defaultConfigEndpoint       = gateway.DefaultConfigEndpoint
+	defaultLegacyConfigEndpoint = gateway.DefaultLegacyConfigEndpoint
+	defaultEchoEndpoint         = gateway.DefaultEchoEndpoint
+	defaultMetadataEndpoint     = gateway.DefaultMetadataEndpoint
 	defaultHealthEndpoint       = "/health"
+	defaultCircuitsEndpoint     = "/admin/circuits"
+	defaultReadyEndpoint        = "/ready"
+	defaultMetricsEndpoint      = "/metrics"
+	pprofEndpoint               = "/debug/pprof/"
+
+	// Relay HMAC authentication defaults
+	defaultRelayHMACMaxSkewMs = 300000
+	minRelayHMACKeyLength     = 32
+
+	// Address of the listener for health, admin and debugging endpoints
+	defaultOpsAddress = "localhost:8081"
+
+	// How often the self-test reported by the readiness endpoint runs
+	defaultSelfTestIntervalMs = 30000
 
 	// service name to be reported as a label to monitoring subsystem
 	defaultMonitoringServiceName = "ohttp_gateway"
 
+	// Metrics backends, and the name of the metrics they report
+	metricsBackendStatsD     = "statsd"
+	metricsBackendPrometheus = "prometheus"
+	metricsBackendLog        = "log"
+	defaultMetricsBackend    = metricsBackendStatsD
+	metricsName              = "ohttp_gateway_duration"
+	phaseMetricsName         = "ohttp_gateway_phase_duration"
+	sizeMetricsName          = "ohttp_gateway_message_size"
+
+	// Log formats
+	logFormatText    = "text"
+	logFormatJSON    = "json"
+	defaultLogFormat = logFormatText
+	defaultLogLevel  = "info"
+
+	// Upstream retry defaults. A single attempt disables retries.
+	defaultUpstreamRetryMaxAttempts   = 1
+	defaultUpstreamRetryBaseDelayMs   = 50
+	defaultUpstreamRetryMaxDelayMs    = 1000
+	defaultUpstreamRetryBudgetPercent = 10
+
+	// Upstream timeout and circuit breaker defaults. A zero failure rate disables the breaker.
+	defaultUpstreamTimeoutMs                = 30000
+	defaultCircuitBreakerFailureRatePercent = 0
+	defaultCircuitBreakerWindow             = 20
+	defaultCircuitBreakerMinRequests        = 10
+	defaultCircuitBreakerCoolDownMs         = 30000
+	defaultCircuitBreakerHalfOpenProbes     = 1
+
+	// HTTP server timeouts and shutdown defaults
+	defaultServerReadHeaderTimeoutMs = 10000
+	defaultServerReadTimeoutMs       = 60000
+	defaultServerWriteTimeoutMs      = 120000
+	defaultServerIdleTimeoutMs       = 120000
+	defaultShutdownDrainPeriodMs     = 5000
+	defaultShutdownTimeoutMs         = 30000
+
+	// Default statsd client timeout and TLS settings
+	defaultStatsDTimeoutMs     = 100
+	defaultCertFile            = "cert.pem"
+	defaultTLSMinVersion       = "1.2"
+	defaultTLSReloadIntervalMs = 60000
+
+	// Content type of payloads forwarded to an opaque backend
+	defaultOpaqueForwardContentType = "application/octet-stream"
+
+	// Response cache defaults. A zero size disables the cache.
+	defaultResponseCacheMaxBytes      = 0
+	defaultResponseCacheMaxEntryBytes = 1 << 20
+
 	// Environment variables
+	portEnvVariable                          = "PORT"
 	gatewayEndpointEnvVariable               = "GATEWAY_ENDPOINT"
 	configEndpointEnvVariable                = "CONFIG_ENDPOINT"
 	legacyConfigEndpointEnvVariable          = "LEGACY_CONFIG_ENDPOINT"
 	echoEndpointEnvVariable                  = "ECHO_ENDPOINT"
 	metadataEndpointEnvVariable              = "METADATA_ENDPOINT"
 	healthEndpointEnvVariable                = "HEALTH_ENDPOINT"
+	circuitsEndpointEnvVariable              = "CIRCUITS_ENDPOINT"
+	readyEndpointEnvVariable                 = "READY_ENDPOINT"
+	metricsEndpointEnvVariable               = "METRICS_ENDPOINT"
+	metricsBackendEnvVariable                = "METRICS_BACKEND"
 	configurationIdEnvironmentVariable       = "CONFIGURATION_ID"
 	secretSeedEnvironmentVariable            = "SEED_SECRET_KEY"
+	keyConfigKEMEnvVariable                  = "KEY_CONFIG_KEM"
 	targetOriginAllowList                    = "ALLOWED_TARGET_ORIGINS"
 	customRequestEncodingType                = "CUSTOM_REQUEST_TYPE"
 	customResponseEncodingType               = "CUSTOM_RESPONSE_TYPE"
 	certificateEnvironmentVariable           = "CERT"
 	keyEnvironmentVariable                   = "KEY"
+	tlsCertificatesEnvVariable               = "TLS_CERTIFICATES"
+	tlsMinVersionEnvVariable                 = "TLS_MIN_VERSION"
+	tlsCipherSuitesEnvVariable               = "TLS_CIPHER_SUITES"
+	tlsReloadIntervalEnvVariable             = "TLS_RELOAD_INTERVAL_MS"
+	relayCAFilesEnvVariable                  = "RELAY_CA_FILES"
+	relayAllowedIdentitiesEnvVariable        = "RELAY_ALLOWED_IDENTITIES"
+	relayHMACKeysEnvVariable                 = "RELAY_HMAC_KEYS"
+	relayHMACMaxSkewEnvVariable              = "RELAY_HMAC_MAX_SKEW_MS"
 	statsdHostVariable                       = "MONITORING_STATSD_HOST"
 	statsdPortVariable                       = "MONITORING_STATSD_PORT"
 	statsdTimeoutVariable                    = "MONITORING_STATSD_TIMEOUT_MS"
@@ -57,13 +139,56 @@ const (
 	gatewayDebugEnvironmentVariable          = "GATEWAY_DEBUG"
 	gatewayVerboseEnvironmentVariable        = "VERBOSE"
 	logSecretsEnvironmentVariable            = "LOG_SECRETS"
+	unredactedLogsEnvVariable                = "LOG_UNREDACTED"
+	logLevelEnvVariable                      = "LOG_LEVEL"
+	logFormatEnvVariable                     = "LOG_FORMAT"
+	upstreamRetryMaxAttemptsEnvVariable      = "UPSTREAM_RETRY_MAX_ATTEMPTS"
+	upstreamRetryBaseDelayEnvVariable        = "UPSTREAM_RETRY_BASE_DELAY_MS"
+	upstreamRetryMaxDelayEnvVariable         = "UPSTREAM_RETRY_MAX_DELAY_MS"
+	upstreamRetryBudgetEnvVariable           = "UPSTREAM_RETRY_BUDGET_PERCENT"
+	upstreamTimeoutEnvVariable               = "UPSTREAM_TIMEOUT_MS"
+	circuitBreakerFailureRateEnvVariable     = "CIRCUIT_BREAKER_FAILURE_RATE_PERCENT"
+	circuitBreakerWindowEnvVariable          = "CIRCUIT_BREAKER_WINDOW"
+	circuitBreakerMinRequestsEnvVariable     = "CIRCUIT_BREAKER_MIN_REQUESTS"
+	circuitBreakerCoolDownEnvVariable        = "CIRCUIT_BREAKER_COOLDOWN_MS"
+	circuitBreakerHalfOpenProbesEnvVariable  = "CIRCUIT_BREAKER_HALF_OPEN_PROBES"
+	egressProxyEnvVariable                   = "EGRESS_PROXY_URL"
+	egressProxyBypassEnvVariable             = "EGRESS_PROXY_BYPASS"
+	egressProxyUsernameEnvVariable           = "EGRESS_PROXY_USERNAME"
+	egressProxyPasswordEnvVariable           = "EGRESS_PROXY_PASSWORD"
+	responseCacheMaxBytesEnvVariable         = "RESPONSE_CACHE_MAX_BYTES"
+	responseCacheMaxEntryBytesEnvVariable    = "RESPONSE_CACHE_MAX_ENTRY_BYTES"
+	opaqueForwardURLEnvVariable              = "OPAQUE_FORWARD_URL"
+	opaqueForwardContentTypeEnvVariable      = "OPAQUE_FORWARD_CONTENT_TYPE"
+	serverReadHeaderTimeoutEnvVariable       = "SERVER_READ_HEADER_TIMEOUT_MS"
+	serverReadTimeoutEnvVariable             = "SERVER_READ_TIMEOUT_MS"
+	serverWriteTimeoutEnvVariable            = "SERVER_WRITE_TIMEOUT_MS"
+	serverIdleTimeoutEnvVariable             = "SERVER_IDLE_TIMEOUT_MS"
+	shutdownDrainPeriodEnvVariable           = "SHUTDOWN_DRAIN_PERIOD_MS"
+	shutdownTimeoutEnvVariable               = "SHUTDOWN_TIMEOUT_MS"
+	opsAddressEnvVariable                    = "OPS_ADDRESS"
+	publicIndexEnvVariable                   = "PUBLIC_INDEX_PAGE"
+	selfTestIntervalEnvVariable              = "SELF_TEST_INTERVAL_MS"
+	selfTestProbeOriginsEnvVariable          = "SELF_TEST_PROBE_ORIGINS"
+	devModeEnvVariable                       = "DEV_MODE"
+	captureFileEnvVariable                   = "CAPTURE_FILE"
+	captureRedactEnvVariable                 = "CAPTURE_REDACT"
 )
 
+// Headers left out of captures by default, since they hold credentials of clients
+var defaultCaptureRedact = []string{"Authorization", "Cookie", "Proxy-Authorization", "Set-Cookie"}
+
 type gatewayServer struct {
-	requestLabel  string
-	responseLabel string
-	endpoints     map[string]string
-	target        *gatewayResource
+	requestLabel   string
+	responseLabel  string
+	endpoints      map[string]string
+	gateway        http.Handler
+	circuitBreaker *gateway.CircuitBreaker
+	selfTest       *gateway.SelfTest
+	metrics        http.Handler
+	draining       *atomic.Bool
+	publicIndex    bool
+	opsAddress     string
 }
 
 func (s gatewayServer) formatConfiguration(w io.Writer) {
@@ -76,6 +201,14 @@ func (s gatewayServer) formatConfiguration(w io.Writer) {
 	fmt.Fprintf(w, "   Response content type: %s\n", s.responseLabel)
 	fmt.Fprintf(w, "Echo endpoint: %s\n", s.endpoints["Echo"])
 	fmt.Fprintf(w, "Metadata endpoint: %s\n", s.endpoints["Metadata"])
+	fmt.Fprintf(w, "Ops listener: %s\n", s.opsAddress)
+	fmt.Fprintf(w, "   Health endpoint: %s\n", s.endpoints["Health"])
+	fmt.Fprintf(w, "   Circuits endpoint: %s\n", s.endpoints["Circuits"])
+	fmt.Fprintf(w, "   Readiness endpoint: %s\n", s.endpoints["Ready"])
+	if s.metrics != nil {
+		fmt.Fprintf(w, "   Metrics endpoint: %s\n", s.endpoints["Metrics"])
+	}
+	fmt.Fprintf(w, "   Profiling endpoint: %s\n", pprofEndpoint)
 	fmt.Fprint(w, "----------------\n")
 }
 
@@ -84,231 +217,332 @@ func (s gatewayServer) indexHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s gatewayServer) healthCheckHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("%s Handling %s\n", r.Method, r.URL.Path)
+	slog.Debug("Handling request", "method", r.Method, "path", r.URL.Path)
+	if s.draining.Load() {
+		// Ask load balancers to stop sending new requests while in-flight ones complete
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
 	fmt.Fprint(w, "ok")
 }
 
-func getUintEnv(key string, defaultVal uint64) uint64 {
-	val := os.Getenv(key)
-	if val == "" {
-		return defaultVal
-	}
-
-	ret, err := strconv.ParseUint(val, 10, 64)
-	if err != nil {
-		return defaultVal
+// readyHandler reports the latest self-test of the gateway. Unlike the health endpoint, which
+// only reports whether the process is up and not draining, it fails whenever the gateway cannot
+// serve requests end to end.
+func (s gatewayServer) readyHandler(w http.ResponseWriter, r *http.Request) {
+	report := s.selfTest.Report()
+	status := http.StatusOK
+	if !report.Ready || s.draining.Load() {
+		status = http.StatusServiceUnavailable
 	}
-	return ret
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
 }
 
-func getBoolEnv(key string, defaultVal bool) bool {
-	val := os.Getenv(key)
-	if val == "" {
-		return defaultVal
+func (s gatewayServer) circuitsHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling request", "method", r.Method, "path", r.URL.Path)
+	snapshot := map[string]gateway.CircuitSnapshot{}
+	if s.circuitBreaker != nil {
+		snapshot = s.circuitBreaker.Snapshot()
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
 
-	ret, err := strconv.ParseBool(val)
-	if err != nil {
-		return defaultVal
+func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command.run(os.Args[2:], os.Stdout); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
 	}
-	return ret
+	serve(os.Args[1:])
 }
 
-func getStringEnv(key, defaultVal string) string {
-	val := os.Getenv(key)
-	if val == "" {
-		return defaultVal
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	configFile := flags.String("config", "", "path to a JSON configuration file; environment variables override its values")
+	checkConfig := flags.Bool("check-config", false, "validate the configuration, print it with secrets redacted, and exit")
+	flags.Usage = usage(flags, "serve [flags]", "Run the gateway. "+commandList)
+	flags.Parse(args)
+
+	cfg, err := loadConfig(*configFile)
+	if *checkConfig {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(cfg.redacted())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Fprintln(os.Stderr, "Configuration OK")
+		return
+	}
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
 	}
-	return val
-}
 
-func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = defaultPort
+	// Route the standard logger, which dependencies use, through the redacting logger too. Only
+	// attributes are redacted, not messages, so the servers log their errors with a logger that
+	// removes client addresses from them.
+	slog.SetDefault(newLogger(os.Stderr, cfg))
+	if cfg.Debug.UnredactedLogs {
+		slog.Warn("UNSAFE: logs include secrets and private data of clients. Never enable " + unredactedLogsEnvVariable + " in production.")
 	}
 
-	logSecrets := getBoolEnv(logSecretsEnvironmentVariable, false)
+	port := cfg.Port
 
 	var seed []byte
-	if seedHex := os.Getenv(secretSeedEnvironmentVariable); seedHex != "" {
-		if logSecrets {
-			log.Printf("Using Secret Key Seed: [%v]", seedHex)
-		} else {
-			log.Print("Using Secret Key Seed provided in environment variable")
-		}
-		var err error
-		seed, err = hex.DecodeString(seedHex)
-		if err != nil {
-			panic(err)
-		}
+	if cfg.Keys.Seed != "" {
+		slog.Info("Using secret key seed provided in configuration", gateway.LogKeySecret, cfg.Keys.Seed)
+		seed, _ = hex.DecodeString(cfg.Keys.Seed)
 	} else {
 		seed = make([]byte, defaultSeedLength)
 		rand.Read(seed)
 	}
 
-	var allowedOrigins map[string]bool
-	var originAllowList string
-	if originAllowList = os.Getenv(targetOriginAllowList); originAllowList != "" {
-		origins := strings.Split(originAllowList, ",")
-		allowedOrigins = make(map[string]bool)
-		for _, origin := range origins {
-			allowedOrigins[origin] = true
-		}
-	}
-
-	var certFile string
-	if certFile = os.Getenv(certificateEnvironmentVariable); certFile == "" {
-		certFile = "cert.pem"
+	config, legacyConfig, err := deriveKeyConfigs(uint8(cfg.Keys.ConfigID), keyConfigKEMs[cfg.Keys.KEM], seed)
+	if err != nil {
+		fatal("Deriving key configurations failed", "error", err)
 	}
 
-	var keyFile string
-	enableTLSServe := true
-	if keyFile = os.Getenv(keyEnvironmentVariable); keyFile == "" {
-		keyFile = "key.pem"
-		enableTLSServe = false
+	// Configure retries of failed target requests
+	var retryPolicy *gateway.RetryPolicy
+	if retry := cfg.Upstream.Retry; retry.MaxAttempts > 1 {
+		retryPolicy = gateway.NewRetryPolicy(
+			int(retry.MaxAttempts),
+			milliseconds(retry.BaseDelayMs),
+			milliseconds(retry.MaxDelayMs),
+			float64(retry.BudgetPercent)/100,
+		)
 	}
 
-	debugResponse := getBoolEnv(gatewayDebugEnvironmentVariable, false)
-	verbose := getBoolEnv(gatewayVerboseEnvironmentVariable, false)
-
-	monitoringServiceName := getStringEnv(monitoringServiceNameEnvironmentVariable, defaultMonitoringServiceName)
-
-	configID := uint8(getUintEnv(configurationIdEnvironmentVariable, 0))
-	config, err := ohttp.NewConfigFromSeed(configID, hpke.KEM_X25519_KYBER768_DRAFT00, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM, seed)
-	if err != nil {
-		log.Fatalf("Failed to create gateway configuration from seed: %s", err)
+	// Configure the per-target circuit breaker
+	var circuitBreaker *gateway.CircuitBreaker
+	if breaker := cfg.Upstream.CircuitBreaker; breaker.FailureRatePercent > 0 {
+		circuitBreaker = gateway.NewCircuitBreaker(
+			int(breaker.Window),
+			int(breaker.MinRequests),
+			float64(breaker.FailureRatePercent)/100,
+			milliseconds(breaker.CoolDownMs),
+			int(breaker.HalfOpenProbes),
+		)
 	}
 
-	// From the primary configuration ID, create a key ID for the legacy configuration that old
-	// clients will use for obtaining configuration material. This will eventually be removed once all
-	// clients have been updated to support the primary configuration ID.
-	legacyConfigID := uint8((configID - 128) % 255)
-	seed[len(seed)-1] ^= 0xFF
-	legacyConfig, err := ohttp.NewConfigFromSeed(legacyConfigID, hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM, seed)
-	if err != nil {
-		log.Fatalf("Failed to create legacy gateway configuration from seed: %s", err)
+	// Create the client for target requests, optionally sending them through an egress proxy
+	upstreamClient := &http.Client{
+		Transport: gateway.DirectTransport(),
+		Timeout:   milliseconds(cfg.Upstream.TimeoutMs),
 	}
-
-	// Create the default HTTP handler
-	httpHandler := FilteredHttpRequestHandler{
-		client:             &http.Client{},
-		allowedOrigins:     allowedOrigins,
-		logForbiddenErrors: verbose,
+	if proxy := cfg.Upstream.Proxy; proxy.URL != "" {
+		egressProxy, err := gateway.NewEgressProxy(proxy.URL, proxy.Bypass)
+		if err != nil {
+			fatal("Failed to configure egress proxy", "error", err)
+		}
+		if proxy.Username != "" {
+			egressProxy = egressProxy.WithCredentials(proxy.Username, proxy.Password)
+		}
+		slog.Info("Sending target requests through egress proxy", "proxy", egressProxy.String())
+		upstreamClient.Transport = egressProxy.Transport()
 	}
 
-	// Create the default gateway and its request handler chain
-	var gateway ohttp.Gateway
-	var targetHandler EncapsulationHandler
-	requestLabel := os.Getenv(customRequestEncodingType)
-	responseLabel := os.Getenv(customResponseEncodingType)
-	if requestLabel == "" || responseLabel == "" || requestLabel == responseLabel {
-		gateway = ohttp.NewDefaultGateway([]ohttp.PrivateConfig{config, legacyConfig})
-		requestLabel = "message/bhttp request"
-		responseLabel = "message/bhttp response"
-		targetHandler = DefaultEncapsulationHandler{
-			gateway: gateway,
-			appHandler: BinaryHTTPAppHandler{
-				httpHandler: httpHandler,
-			},
-		}
-	} else if requestLabel == "message/protohttp request" && responseLabel == "message/protohttp response" {
-		gateway = ohttp.NewCustomGateway([]ohttp.PrivateConfig{config, legacyConfig}, requestLabel, responseLabel)
-		targetHandler = DefaultEncapsulationHandler{
-			gateway: gateway,
-			appHandler: ProtoHTTPAppHandler{
-				httpHandler: httpHandler,
-			},
+	// Configure metrics
+	var metricsFactory gateway.MetricsFactory
+	var metricsHandler http.Handler
+	var client statsd.ClientInterface = &statsd.NoOpClient{}
+	var metricsFactories []gateway.MetricsFactory
+	for _, backend := range cfg.Metrics.Backends {
+		switch backend {
+		case metricsBackendPrometheus:
+			prometheusFactory := NewPrometheusMetricsFactory(cfg.Metrics.ServiceName, metricsName, phaseMetricsName, sizeMetricsName)
+			metricsFactories = append(metricsFactories, prometheusFactory)
+			metricsHandler = prometheusFactory
+		case metricsBackendLog:
+			metricsFactories = append(metricsFactories, LogMetricsFactory{logger: slog.Default()})
+		default:
+			client, err = createStatsDClient(cfg.Metrics.StatsDHost, cfg.Metrics.StatsDPort, int(cfg.Metrics.StatsDTimeoutMs))
+			if err != nil {
+				fatal("Failed to create statsd client", "error", err)
+			}
+			metricsFactories = append(metricsFactories, &StatsDMetricsFactory{
+				serviceName:      cfg.Metrics.ServiceName,
+				metricsName:      metricsName,
+				phaseMetricsName: phaseMetricsName,
+				sizeMetricsName:  sizeMetricsName,
+				client:           client,
+			})
 		}
+	}
+	if len(metricsFactories) == 1 {
+		metricsFactory = metricsFactories[0]
 	} else {
-		panic("Unsupported application content handler")
+		// Report to every backend, for example while migrating from one to another
+		metricsFactory = gateway.NewMultiMetricsFactory(slog.Default(), metricsFactories...)
 	}
 
-	// Create the echo handler chain
-	echoHandler := DefaultEncapsulationHandler{
-		gateway:    gateway,
-		appHandler: EchoAppHandler{},
+	opts := []gateway.Option{
+		gateway.WithKeys(config, legacyConfig),
+		gateway.WithEndpoints(gateway.Endpoints{
+			Gateway:      cfg.Endpoints.Gateway,
+			Echo:         cfg.Endpoints.Echo,
+			Metadata:     cfg.Endpoints.Metadata,
+			Config:       cfg.Endpoints.Config,
+			LegacyConfig: cfg.Endpoints.LegacyConfig,
+		}),
+		gateway.WithUpstreamClient(upstreamClient),
+		gateway.WithAllowedOrigins(cfg.Policy.AllowedTargetOrigins),
+		gateway.WithRetryPolicy(retryPolicy),
+		gateway.WithCircuitBreaker(circuitBreaker),
+		gateway.WithMetrics(metricsFactory),
+		gateway.WithRelayAuthenticator(cfg.Relay.relayAuthenticator()),
+		gateway.WithDebugResponses(cfg.Debug.DebugResponses),
+		gateway.WithLogger(slog.Default()),
 	}
 
-	// Create the metadata handler chain
-	metadataHandler := MetadataEncapsulationHandler{
-		gateway: gateway,
+	// Capture decapsulated traffic for replay, which configuration only allows in development
+	var captureFile *os.File
+	if cfg.Debug.CaptureFile != "" {
+		captureFile, err = os.OpenFile(cfg.Debug.CaptureFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			fatal("Failed to open capture file", "error", err)
+		}
+		slog.Warn("UNSAFE: capturing decapsulated requests and responses of clients. Never enable "+captureFileEnvVariable+" in production.", "file", cfg.Debug.CaptureFile)
+		opts = append(opts, gateway.WithCapture(gateway.NewCapture(captureFile, cfg.Debug.CaptureRedact)))
 	}
 
-	// Configure metrics
-	metricsHost := os.Getenv(statsdHostVariable)
-	metricsPort := os.Getenv(statsdPortVariable)
-	metricsTimeout, err := strconv.ParseInt(os.Getenv(statsdTimeoutVariable), 10, 64)
-	if err != nil {
-		log.Printf("Failed parsing metrics timeout: %s", err)
-		metricsTimeout = 100
+	// Optionally answer cacheable requests from a shared response cache
+	if cache := cfg.Upstream.Cache; cache.MaxBytes > 0 {
+		opts = append(opts, gateway.WithResponseCache(gateway.NewResponseCache(int64(cache.MaxBytes), int64(cache.MaxEntryBytes))))
 	}
-	client, err := createStatsDClient(metricsHost, metricsPort, int(metricsTimeout))
-	if err != nil {
-		log.Fatalf("Failed to create statsd client: %s", err)
+
+	// Select the handler of the application content
+	requestLabel := cfg.Content.RequestType
+	responseLabel := cfg.Content.ResponseType
+	if !cfg.customContent() {
+		requestLabel = "message/bhttp request"
+		responseLabel = "message/bhttp response"
+	} else {
+		opts = append(opts, gateway.WithContentTypes(cfg.Content.RequestType, cfg.Content.ResponseType))
+		if !cfg.protoHTTPContent() {
+			// Payloads of any other custom type are forwarded as-is to a single backend
+			opts = append(opts, gateway.WithAppHandler(gateway.NewOpaqueForwardingAppHandler(
+				upstreamClient,
+				cfg.Content.OpaqueForwardURL,
+				cfg.Content.OpaqueForwardContentType,
+			)))
+		}
 	}
-	defer client.Close()
 
-	metricsFactory := &StatsDMetricsFactory{
-		serviceName: monitoringServiceName,
-		metricsName: "ohttp_gateway_duration",
-		client:      client,
+	gatewayHandler, err := gateway.New(opts...)
+	if err != nil {
+		fatal("Creating the gateway failed", "error", err)
 	}
 
-	// Load endpoint configuration defaults
-	gatewayEndpoint := getStringEnv(gatewayEndpointEnvVariable, defaultGatewayEndpoint)
-	configEndpoint := getStringEnv(configEndpointEnvVariable, defaultConfigEndpoint)
-	legacyConfigEndpoint := getStringEnv(legacyConfigEndpointEnvVariable, defaultLegacyConfigEndpoint)
-	echoEndpoint := getStringEnv(echoEndpointEnvVariable, defaultEchoEndpoint)
-	metadataEndpoint := getStringEnv(metadataEndpointEnvVariable, defaultMetadataEndpoint)
-	healthEndpoint := getStringEnv(healthEndpointEnvVariable, defaultHealthEndpoint)
-
-	// Install configuration endpoints
-	handlers := make(map[string]EncapsulationHandler)
-	handlers[gatewayEndpoint] = targetHandler    // Content-specific handler
-	handlers[echoEndpoint] = echoHandler         // Content-agnostic handler
-	handlers[metadataEndpoint] = metadataHandler // Metadata handler
-	target := &gatewayResource{
-		verbose:               verbose,
-		legacyKeyID:           legacyConfigID,
-		gateway:               gateway,
-		encapsulationHandlers: handlers,
-		debugResponse:         debugResponse,
-		metricsFactory:        metricsFactory,
+	// Relays may authenticate with a client certificate issued by a relay CA
+	var relayCAs *x509.CertPool
+	if len(cfg.Relay.CAFiles) > 0 {
+		relayCAs, err = loadCertPool(cfg.Relay.CAFiles)
+		if err != nil {
+			fatal("Failed to load relay CAs", "error", err)
+		}
 	}
 
 	endpoints := make(map[string]string)
-	endpoints["Target"] = gatewayEndpoint
-	endpoints["Health"] = healthEndpoint
-	endpoints["Config"] = configEndpoint
-	endpoints["LegacyConfig"] = legacyConfigEndpoint
-	endpoints["Echo"] = echoEndpoint
-	endpoints["Metadata"] = metadataEndpoint
+	endpoints["Target"] = cfg.Endpoints.Gateway
+	endpoints["Health"] = cfg.Endpoints.Health
+	endpoints["Config"] = cfg.Endpoints.Config
+	endpoints["LegacyConfig"] = cfg.Endpoints.LegacyConfig
+	endpoints["Echo"] = cfg.Endpoints.Echo
+	endpoints["Metadata"] = cfg.Endpoints.Metadata
+	endpoints["Circuits"] = cfg.Endpoints.Circuits
+	endpoints["Ready"] = cfg.Endpoints.Ready
+	endpoints["Metrics"] = cfg.Endpoints.Metrics
 
 	server := gatewayServer{
-		requestLabel:  requestLabel,
-		responseLabel: responseLabel,
-		endpoints:     endpoints,
-		target:        target,
+		requestLabel:   requestLabel,
+		responseLabel:  responseLabel,
+		endpoints:      endpoints,
+		gateway:        gatewayHandler,
+		circuitBreaker: circuitBreaker,
+		selfTest:       gatewayHandler.SelfTest(cfg.Server.SelfTestProbeOrigins),
+		metrics:        metricsHandler,
+		draining:       new(atomic.Bool),
+		publicIndex:    cfg.Server.PublicIndex,
+		opsAddress:     cfg.Server.OpsAddress,
 	}
 
-	http.HandleFunc(gatewayEndpoint, server.target.gatewayHandler)
-	http.HandleFunc(echoEndpoint, server.target.gatewayHandler)
-	http.HandleFunc(metadataEndpoint, server.target.gatewayHandler)
-	http.HandleFunc(healthEndpoint, server.healthCheckHandler)
-	http.HandleFunc(legacyConfigEndpoint, target.legacyConfigHandler)
-	http.HandleFunc(configEndpoint, target.configHandler)
-	http.HandleFunc("/", server.indexHandler)
-
 	var b bytes.Buffer
 	server.formatConfiguration(io.Writer(&b))
-	log.Println(b.String())
+	slog.Info("Starting gateway", "configuration", b.String())
+
+	httpServer := &http.Server{
+		Addr:              fmt.Sprintf(":%s", port),
+		Handler:           server.publicHandler(),
+		ReadHeaderTimeout: milliseconds(cfg.Server.ReadHeaderTimeoutMs),
+		ReadTimeout:       milliseconds(cfg.Server.ReadTimeoutMs),
+		WriteTimeout:      milliseconds(cfg.Server.WriteTimeoutMs),
+		IdleTimeout:       milliseconds(cfg.Server.IdleTimeoutMs),
+		ErrorLog:          newServerErrorLog(slog.Default()),
+	}
+
+	// Ops endpoints are served without TLS on their own, typically internal, address. The write
+	// timeout is left unset so that CPU profiles can take longer than gateway requests.
+	opsServer := &http.Server{
+		Addr:              cfg.Server.OpsAddress,
+		Handler:           server.opsHandler(),
+		ReadHeaderTimeout: milliseconds(cfg.Server.ReadHeaderTimeoutMs),
+		IdleTimeout:       milliseconds(cfg.Server.IdleTimeoutMs),
+		ErrorLog:          newServerErrorLog(slog.Default()),
+	}
 
-	if enableTLSServe {
-		log.Printf("Listening on port %v with cert %v and key %v\n", port, certFile, keyFile)
-		log.Fatal(http.ListenAndServeTLS(fmt.Sprintf(":%s", port), certFile, keyFile, nil))
+	// Serve TLS with certificates that are reloaded when they are rotated
+	stopReloading := make(chan struct{})
+	if pairs := cfg.TLS.certificatePairs(); len(pairs) > 0 {
+		reloader, err := NewCertificateReloader(pairs)
+		if err != nil {
+			fatal("Loading TLS certificates failed", "error", err)
+		}
+		httpServer.TLSConfig, err = reloader.TLSConfig(cfg.TLS.MinVersion, cfg.TLS.CipherSuites)
+		if err != nil {
+			fatal("Configuring TLS failed", "error", err)
+		}
+		if relayCAs != nil {
+			// Client certificates are optional during the handshake so that key configurations
+			// remain available to everyone, but gateway requests without one are rejected.
+			httpServer.TLSConfig.ClientCAs = relayCAs
+			httpServer.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		go reloader.Watch(milliseconds(cfg.TLS.ReloadIntervalMs), stopReloading)
+		slog.Info("Listening with TLS", "port", port, "certificates", fmt.Sprint(pairs))
 	} else {
-		log.Printf("Listening on port %v without enabling TLS\n", port)
-		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), nil))
+		slog.Info("Listening without TLS", "port", port)
 	}
+	slog.Info("Serving ops endpoints", "address", cfg.Server.OpsAddress)
+
+	// Run the self-test reported by the readiness endpoint
+	stopSelfTest := make(chan struct{})
+	go server.selfTest.Watch(milliseconds(cfg.Server.SelfTestIntervalMs), stopSelfTest)
+
+	err = server.serve(httpServer, opsServer, milliseconds(cfg.Server.DrainPeriodMs), milliseconds(cfg.Server.ShutdownTimeoutMs))
+	close(stopReloading)
+	close(stopSelfTest)
+
+	// Flush any buffered metrics before exiting
+	if closeErr := client.Close(); closeErr != nil {
+		slog.Warn("Failed to close statsd client", "error", closeErr)
+	}
+	if captureFile != nil {
+		captureFile.Close()
+	}
+	if err != nil {
+		fatal("Serving failed", "error", err)
+	}
+}
+
+func milliseconds(ms uint64) time.Duration {
+	return time.Duration(ms) * time.Millisecond
 }
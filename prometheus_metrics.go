@@ -0,0 +1,225 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/app-gateway-go/gateway"
+)
+
+// Content type of the Prometheus text exposition format
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Upper bounds, in seconds, of the latency histogram buckets. These are the Prometheus defaults.
+var prometheusLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Upper bounds, in bytes, of the message size histogram buckets. Sizes are reported by the gateway
+// as the upper bound of their bucket, so finer buckets would not add information.
+var prometheusSizeBuckets = func() []float64 {
+	buckets := make([]float64, len(gateway.MessageSizeBuckets))
+	for i, bound := range gateway.MessageSizeBuckets {
+		buckets[i] = float64(bound)
+	}
+	return buckets
+}()
+
+type prometheusLabel struct {
+	name  string
+	value string
+}
+
+// prometheusSeries is a histogram of the observations with one set of labels.
+type prometheusSeries struct {
+	labels       []prometheusLabel
+	count        uint64
+	bucketCounts []uint64
+	sum          float64
+}
+
+type PrometheusMetrics struct {
+	factory   *PrometheusMetricsFactory
+	eventName string
+	startedAt time.Time
+	tags      []prometheusLabel
+}
+
+func (m *PrometheusMetrics) Fire(result string) {
+	labels := []prometheusLabel{
+		{"event_name", m.eventName},
+		{"result", result},
+		{"service", m.factory.serviceName},
+	}
+	m.factory.observe(m.factory.results, prometheusLatencyBuckets, append(labels, m.tags...), time.Since(m.startedAt).Seconds())
+}
+
+func (m *PrometheusMetrics) Phase(name string, duration time.Duration) {
+	labels := []prometheusLabel{
+		{"event_name", m.eventName},
+		{"phase", name},
+		{"service", m.factory.serviceName},
+	}
+	m.factory.observe(m.factory.phases, prometheusLatencyBuckets, append(labels, m.tags...), duration.Seconds())
+}
+
+func (m *PrometheusMetrics) MessageSize(name string, size int) {
+	labels := []prometheusLabel{
+		{"event_name", m.eventName},
+		{"message", name},
+		{"service", m.factory.serviceName},
+	}
+	m.factory.observe(m.factory.sizes, prometheusSizeBuckets, append(labels, m.tags...), float64(size))
+}
+
+func (m *PrometheusMetrics) Tag(name, value string) {
+	m.tags = append(m.tags, prometheusLabel{name, value})
+}
+
+func (m *PrometheusMetrics) ResponseStatus(prefix string, status int) {
+	m.Fire(fmt.Sprintf("%s_response_status_%d", prefix, status))
+}
+
+// PrometheusMetricsFactory keeps a counter of results and a histogram of the latency of events,
+// by event name and result, a histogram of the latency of their phases, by event name and phase,
+// and a histogram of the size of their messages, by event name and message. It serves them in the
+// Prometheus text exposition format.
+type PrometheusMetricsFactory struct {
+	serviceName      string
+	metricsName      string
+	phaseMetricsName string
+	sizeMetricsName  string
+
+	mu      sync.Mutex
+	results map[string]*prometheusSeries
+	phases  map[string]*prometheusSeries
+	sizes   map[string]*prometheusSeries
+}
+
+// NewPrometheusMetricsFactory creates a PrometheusMetricsFactory exposing metrics of results
+// named after metricsName, of phases named after phaseMetricsName and of message sizes named
+// after sizeMetricsName, labelled with serviceName.
+func NewPrometheusMetricsFactory(serviceName, metricsName, phaseMetricsName, sizeMetricsName string) *PrometheusMetricsFactory {
+	return &PrometheusMetricsFactory{
+		serviceName:      serviceName,
+		metricsName:      metricsName,
+		phaseMetricsName: phaseMetricsName,
+		sizeMetricsName:  sizeMetricsName,
+		results:          make(map[string]*prometheusSeries),
+		phases:           make(map[string]*prometheusSeries),
+		sizes:            make(map[string]*prometheusSeries),
+	}
+}
+
+func (f *PrometheusMetricsFactory) Create(eventName string) gateway.Metrics {
+	return &PrometheusMetrics{
+		factory:   f,
+		eventName: eventName,
+		startedAt: time.Now(),
+	}
+}
+
+// observe records a value in the series of family with the given labels, whose histogram has the
+// given bucket bounds.
+func (f *PrometheusMetricsFactory) observe(family map[string]*prometheusSeries, buckets []float64, labels []prometheusLabel, value float64) {
+	key := formatPrometheusLabels(labels)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	series, ok := family[key]
+	if !ok {
+		series = &prometheusSeries{
+			labels:       labels,
+			bucketCounts: make([]uint64, len(buckets)),
+		}
+		family[key] = series
+	}
+	series.count++
+	series.sum += value
+	for i, bound := range buckets {
+		if value <= bound {
+			series.bucketCounts[i]++
+		}
+	}
+}
+
+// escapePrometheusLabelValue escapes a label value as required by the text exposition format.
+func escapePrometheusLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatPrometheusLabels(labels []prometheusLabel) string {
+	formatted := make([]string, len(labels))
+	for i, label := range labels {
+		formatted[i] = fmt.Sprintf(`%s="%s"`, label.name, escapePrometheusLabelValue(label.value))
+	}
+	return strings.Join(formatted, ",")
+}
+
+func formatPrometheusFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// snapshotPrometheusSeries copies the series of family, and returns their keys in order so that
+// the output is stable. It must be called with the factory mutex held.
+func snapshotPrometheusSeries(family map[string]*prometheusSeries) ([]string, map[string]prometheusSeries) {
+	keys := make([]string, 0, len(family))
+	series := make(map[string]prometheusSeries, len(family))
+	for key, s := range family {
+		keys = append(keys, key)
+		series[key] = prometheusSeries{
+			labels:       s.labels,
+			count:        s.count,
+			bucketCounts: append([]uint64(nil), s.bucketCounts...),
+			sum:          s.sum,
+		}
+	}
+	sort.Strings(keys)
+	return keys, series
+}
+
+func writePrometheusHistogram(out io.Writer, name, help string, buckets []float64, keys []string, series map[string]prometheusSeries) {
+	fmt.Fprintf(out, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(out, "# TYPE %s histogram\n", name)
+	for _, key := range keys {
+		s := series[key]
+		for i, bound := range buckets {
+			fmt.Fprintf(out, "%s_bucket{%s,le=\"%s\"} %d\n", name, key, formatPrometheusFloat(bound), s.bucketCounts[i])
+		}
+		fmt.Fprintf(out, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, key, s.count)
+		fmt.Fprintf(out, "%s_sum{%s} %s\n", name, key, formatPrometheusFloat(s.sum))
+		fmt.Fprintf(out, "%s_count{%s} %d\n", name, key, s.count)
+	}
+}
+
+// ServeHTTP writes all metrics in the Prometheus text exposition format.
+func (f *PrometheusMetricsFactory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	resultKeys, results := snapshotPrometheusSeries(f.results)
+	phaseKeys, phases := snapshotPrometheusSeries(f.phases)
+	sizeKeys, sizes := snapshotPrometheusSeries(f.sizes)
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", prometheusContentType)
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	counter := f.metricsName + "_results_total"
+	fmt.Fprintf(out, "# HELP %s Number of results of gateway events.\n", counter)
+	fmt.Fprintf(out, "# TYPE %s counter\n", counter)
+	for _, key := range resultKeys {
+		fmt.Fprintf(out, "%s{%s} %d\n", counter, key, results[key].count)
+	}
+
+	writePrometheusHistogram(out, f.metricsName+"_seconds", "Time from the start of a gateway event to its result.", prometheusLatencyBuckets, resultKeys, results)
+	writePrometheusHistogram(out, f.phaseMetricsName+"_seconds", "Time taken by a phase of a gateway event.", prometheusLatencyBuckets, phaseKeys, phases)
+	writePrometheusHistogram(out, f.sizeMetricsName+"_bytes", "Size of a message of a gateway event, rounded up to its bucket.", prometheusSizeBuckets, sizeKeys, sizes)
+}
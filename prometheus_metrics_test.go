@@ -0,0 +1,102 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/app-gateway-go/gateway"
+)
+
+func TestPrometheusMetricsFactory(t *testing.T) {
+	factory := NewPrometheusMetricsFactory("ohttp_gateway", "ohttp_gateway_duration", "ohttp_gateway_phase_duration", "ohttp_gateway_message_size")
+
+	for i := 0; i < 2; i++ {
+		metrics := factory.Create("gateway_request")
+		metrics.Tag("relay", `relay "a"`)
+		metrics.Phase("target_fetch", 100*time.Millisecond)
+		metrics.MessageSize("request", 1024)
+		metrics.Fire("success")
+	}
+	metrics := factory.Create("configs_request")
+	metrics.(*PrometheusMetrics).startedAt = time.Now().Add(-time.Second)
+	metrics.ResponseStatus("GET", http.StatusOK)
+
+	rr := httptest.NewRecorder()
+	factory.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, defaultMetricsEndpoint, nil))
+	if contentType := rr.Header().Get("Content-Type"); contentType != prometheusContentType {
+		t.Fatalf("Unexpected content type %q", contentType)
+	}
+
+	output := rr.Body.String()
+	configsLabels := `event_name="configs_request",result="GET_response_status_200",service="ohttp_gateway"`
+	gatewayLabels := `event_name="gateway_request",result="success",service="ohttp_gateway",relay="relay \"a\""`
+	sizeLabels := `event_name="gateway_request",message="request",service="ohttp_gateway",relay="relay \"a\""`
+	phaseLabels := `event_name="gateway_request",phase="target_fetch",service="ohttp_gateway",relay="relay \"a\""`
+	for _, expected := range []string{
+		"# TYPE ohttp_gateway_duration_results_total counter\n",
+		"ohttp_gateway_duration_results_total{" + configsLabels + "} 1\n",
+		"ohttp_gateway_duration_results_total{" + gatewayLabels + "} 2\n",
+		"# TYPE ohttp_gateway_duration_seconds histogram\n",
+		"ohttp_gateway_duration_seconds_bucket{" + configsLabels + `,le="0.5"} 0` + "\n",
+		"ohttp_gateway_duration_seconds_bucket{" + configsLabels + `,le="2.5"} 1` + "\n",
+		"ohttp_gateway_duration_seconds_bucket{" + configsLabels + `,le="+Inf"} 1` + "\n",
+		"ohttp_gateway_duration_seconds_bucket{" + gatewayLabels + `,le="0.005"} 2` + "\n",
+		"ohttp_gateway_duration_seconds_count{" + gatewayLabels + "} 2\n",
+		"# TYPE ohttp_gateway_phase_duration_seconds histogram\n",
+		"ohttp_gateway_phase_duration_seconds_bucket{" + phaseLabels + `,le="0.05"} 0` + "\n",
+		"ohttp_gateway_phase_duration_seconds_bucket{" + phaseLabels + `,le="0.1"} 2` + "\n",
+		"ohttp_gateway_phase_duration_seconds_sum{" + phaseLabels + "} 0.2\n",
+		"# TYPE ohttp_gateway_message_size_bytes histogram\n",
+		"ohttp_gateway_message_size_bytes_bucket{" + sizeLabels + `,le="256"} 0` + "\n",
+		"ohttp_gateway_message_size_bytes_bucket{" + sizeLabels + `,le="1024"} 2` + "\n",
+		"ohttp_gateway_message_size_bytes_sum{" + sizeLabels + "} 2048\n",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Fatalf("Expected %q in metrics output:\n%s", expected, output)
+		}
+	}
+	if strings.Index(output, configsLabels) > strings.Index(output, gatewayLabels) {
+		t.Fatalf("Expected series to be ordered by labels:\n%s", output)
+	}
+}
+
+func TestPrometheusMetricsRequestMethods(t *testing.T) {
+	config, legacyConfig, err := deriveKeyConfigs(1, keyConfigKEMs[defaultKeyConfigKEM], make([]byte, defaultSeedLength))
+	if err != nil {
+		t.Fatal(err)
+	}
+	factory := NewPrometheusMetricsFactory("ohttp_gateway", "ohttp_gateway_duration", "ohttp_gateway_phase_duration", "ohttp_gateway_message_size")
+	handler, err := gateway.New(gateway.WithKeys(config, legacyConfig), gateway.WithMetrics(factory))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seriesCount := func() int {
+		factory.mu.Lock()
+		defer factory.mu.Unlock()
+		return len(factory.results)
+	}
+	send := func(method, path string) {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, path, nil))
+	}
+	send("PUT", defaultGatewayEndpoint)
+	send("PUT", defaultConfigEndpoint)
+	expected := seriesCount()
+
+	// Methods are chosen by clients, so they must not create new series
+	for i := 0; i < 100; i++ {
+		method := fmt.Sprintf("METHOD%d", i)
+		send(method, defaultGatewayEndpoint)
+		send(method, defaultConfigEndpoint)
+	}
+	if count := seriesCount(); count != expected {
+		t.Fatalf("Expected %d series after requests with arbitrary methods, got %d", expected, count)
+	}
+}
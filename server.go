@@ -0,0 +1,109 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// publicHandler routes the OHTTP endpoints and key configurations, which are the only endpoints
+// exposed to clients. The index page is only served if enabled.
+func (s gatewayServer) publicHandler() http.Handler {
+	mux := http.NewServeMux()
+	for _, name := range []string{"Target", "Echo", "Metadata", "LegacyConfig", "Config"} {
+		mux.Handle(s.endpoints[name], s.gateway)
+	}
+	if s.publicIndex {
+		mux.HandleFunc("/", s.indexHandler)
+	} else {
+		mux.HandleFunc("/", http.NotFound)
+	}
+	return mux
+}
+
+// opsHandler routes the endpoints for operating the gateway: health, admin and profiling
+// endpoints and the index page.
+func (s gatewayServer) opsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(s.endpoints["Health"], s.healthCheckHandler)
+	mux.HandleFunc(s.endpoints["Circuits"], s.circuitsHandler)
+	mux.HandleFunc(s.endpoints["Ready"], s.readyHandler)
+	if s.metrics != nil {
+		mux.Handle(s.endpoints["Metrics"], s.metrics)
+	}
+	mux.HandleFunc(pprofEndpoint, pprof.Index)
+	mux.HandleFunc(pprofEndpoint+"cmdline", pprof.Cmdline)
+	mux.HandleFunc(pprofEndpoint+"profile", pprof.Profile)
+	mux.HandleFunc(pprofEndpoint+"symbol", pprof.Symbol)
+	mux.HandleFunc(pprofEndpoint+"trace", pprof.Trace)
+	mux.HandleFunc("/", s.indexHandler)
+	return mux
+}
+
+// serve runs the public and ops servers until either fails or the process receives SIGTERM or
+// SIGINT. TLS is served on the public server if it has a TLS configuration. On a
+// signal, the health endpoint starts reporting the gateway as unhealthy, new requests keep being
+// accepted for drainPeriod so that load balancers notice, and the servers are then shut down,
+// waiting up to shutdownTimeout for in-flight requests. The ops server is shut down last so that
+// health checks keep being answered while the public server drains.
+func (s gatewayServer) serve(publicServer, opsServer *http.Server, drainPeriod, shutdownTimeout time.Duration) error {
+	serveErr := make(chan error, 2)
+	go func() {
+		var err error
+		if publicServer.TLSConfig != nil {
+			// Certificates are provided by the TLS configuration
+			err = publicServer.ListenAndServeTLS("", "")
+		} else {
+			err = publicServer.ListenAndServe()
+		}
+		serveErr <- fmt.Errorf("public listener: %w", err)
+	}()
+	go func() {
+		serveErr <- fmt.Errorf("ops listener: %w", opsServer.ListenAndServe())
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-serveErr:
+		publicServer.Close()
+		opsServer.Close()
+		return err
+	case sig := <-signals:
+		slog.Info("Draining before shutting down", "signal", sig.String(), "drain_period", drainPeriod)
+	}
+
+	s.draining.Store(true)
+	select {
+	case <-time.After(drainPeriod):
+	case sig := <-signals:
+		slog.Info("Shutting down while draining", "signal", sig.String())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, server := range []*http.Server{publicServer, opsServer} {
+		if err := server.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+	}
+	slog.Info("Server shut down")
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cloudflare/app-gateway-go/gateway"
+)
+
+func TestHealthCheckHandlerDraining(t *testing.T) {
+	server := gatewayServer{
+		draining: new(atomic.Bool),
+	}
+	handler := http.HandlerFunc(server.healthCheckHandler)
+
+	request, err := http.NewRequest(http.MethodGet, defaultHealthEndpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusOK, status))
+	}
+
+	server.draining.Store(true)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	if status := rr.Code; status != http.StatusServiceUnavailable {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusServiceUnavailable, status))
+	}
+}
+
+func TestPublicAndOpsHandlers(t *testing.T) {
+	config, legacyConfig, err := deriveKeyConfigs(1, keyConfigKEMs[defaultKeyConfigKEM], make([]byte, defaultSeedLength))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gatewayHandler, err := gateway.New(gateway.WithKeys(config, legacyConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := gatewayServer{
+		endpoints: map[string]string{
+			"Target":       defaultGatewayEndpoint,
+			"Config":       defaultConfigEndpoint,
+			"LegacyConfig": defaultLegacyConfigEndpoint,
+			"Echo":         defaultEchoEndpoint,
+			"Metadata":     defaultMetadataEndpoint,
+			"Health":       defaultHealthEndpoint,
+			"Circuits":     defaultCircuitsEndpoint,
+			"Ready":        defaultReadyEndpoint,
+			"Metrics":      defaultMetricsEndpoint,
+		},
+		selfTest: gatewayHandler.SelfTest(nil),
+		gateway:  gatewayHandler,
+		draining: new(atomic.Bool),
+	}
+
+	expectStatus := func(handler http.Handler, path string, expected int) {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		if rr.Code != expected {
+			t.Fatalf("Expected %s to yield %d, got %d", path, expected, rr.Code)
+		}
+	}
+
+	public := server.publicHandler()
+	expectStatus(public, defaultConfigEndpoint, http.StatusOK)
+	expectStatus(public, "/", http.StatusNotFound)
+	expectStatus(public, defaultHealthEndpoint, http.StatusNotFound)
+	expectStatus(public, defaultCircuitsEndpoint, http.StatusNotFound)
+	expectStatus(public, pprofEndpoint, http.StatusNotFound)
+	expectStatus(public, defaultReadyEndpoint, http.StatusNotFound)
+
+	ops := server.opsHandler()
+	expectStatus(ops, "/", http.StatusOK)
+	expectStatus(ops, defaultHealthEndpoint, http.StatusOK)
+	expectStatus(ops, defaultCircuitsEndpoint, http.StatusOK)
+	expectStatus(ops, pprofEndpoint, http.StatusOK)
+	expectStatus(ops, defaultReadyEndpoint, http.StatusServiceUnavailable)
+	server.selfTest.Run(context.Background())
+	expectStatus(ops, defaultReadyEndpoint, http.StatusOK)
+	expectStatus(ops, defaultHealthEndpoint, http.StatusOK)
+
+	server.metrics = NewPrometheusMetricsFactory(defaultMonitoringServiceName, metricsName, phaseMetricsName, sizeMetricsName)
+	expectStatus(server.opsHandler(), defaultMetricsEndpoint, http.StatusOK)
+
+	server.publicIndex = true
+	expectStatus(server.publicHandler(), "/", http.StatusOK)
+}
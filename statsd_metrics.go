@@ -2,26 +2,55 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"time"
 
 	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/cloudflare/app-gateway-go/gateway"
 )
 
 type StatsDMetrics struct {
-	serviceName string
-	metricsName string
-	eventName   string
-	startedAt   time.Time
-	client      statsd.ClientInterface
+	serviceName      string
+	metricsName      string
+	phaseMetricsName string
+	sizeMetricsName  string
+	eventName        string
+	startedAt        time.Time
+	client           statsd.ClientInterface
+	tags             []string
 }
 
 func (s *StatsDMetrics) Fire(result string) {
 	tags := []string{fmt.Sprintf("event_name:%s", s.eventName), fmt.Sprintf("result:%s", result), fmt.Sprintf("service:%s", s.serviceName)}
+	tags = append(tags, s.tags...)
 
 	err := s.client.TimeInMilliseconds(s.metricsName, float64(time.Since(s.startedAt).Milliseconds()), tags, 1)
 	if err != nil {
-		log.Printf("Cannot send metrics to statsd: %s", err)
+		slog.Warn("Cannot send metrics to statsd", "error", err)
+	}
+}
+
+func (s *StatsDMetrics) Tag(name, value string) {
+	s.tags = append(s.tags, fmt.Sprintf("%s:%s", name, value))
+}
+
+func (s *StatsDMetrics) Phase(name string, duration time.Duration) {
+	tags := []string{fmt.Sprintf("event_name:%s", s.eventName), fmt.Sprintf("phase:%s", name), fmt.Sprintf("service:%s", s.serviceName)}
+	tags = append(tags, s.tags...)
+
+	err := s.client.TimeInMilliseconds(s.phaseMetricsName, float64(duration.Microseconds())/1000, tags, 1)
+	if err != nil {
+		slog.Warn("Cannot send metrics to statsd", "error", err)
+	}
+}
+
+func (s *StatsDMetrics) MessageSize(name string, size int) {
+	tags := []string{fmt.Sprintf("event_name:%s", s.eventName), fmt.Sprintf("message:%s", name), fmt.Sprintf("service:%s", s.serviceName)}
+	tags = append(tags, s.tags...)
+
+	err := s.client.Histogram(s.sizeMetricsName, float64(size), tags, 1)
+	if err != nil {
+		slog.Warn("Cannot send metrics to statsd", "error", err)
 	}
 }
 
@@ -38,17 +67,21 @@ func createStatsDClient(host, port string, timeout int) (statsd.ClientInterface,
 }
 
 type StatsDMetricsFactory struct {
-	serviceName string
-	metricsName string
-	client      statsd.ClientInterface
+	serviceName      string
+	metricsName      string
+	phaseMetricsName string
+	sizeMetricsName  string
+	client           statsd.ClientInterface
 }
 
-func (f StatsDMetricsFactory) Create(eventName string) Metrics {
+func (f StatsDMetricsFactory) Create(eventName string) gateway.Metrics {
 	return &StatsDMetrics{
-		serviceName: f.serviceName,
-		metricsName: f.metricsName,
-		eventName:   eventName,
-		startedAt:   time.Now(),
-		client:      f.client,
+		serviceName:      f.serviceName,
+		metricsName:      f.metricsName,
+		phaseMetricsName: f.phaseMetricsName,
+		sizeMetricsName:  f.sizeMetricsName,
+		eventName:        eventName,
+		startedAt:        time.Now(),
+		client:           f.client,
 	}
 }
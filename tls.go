@@ -0,0 +1,220 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// TLS protocol versions that may be configured as the minimum version, by configuration name.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func tlsVersionNames() []string {
+	names := make([]string, 0, len(tlsVersions))
+	for name := range tlsVersions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// tlsCipherSuite returns the ID of the cipher suite with the given name, which must be one that
+// Go considers secure. Cipher suites only apply to TLS 1.2, since those of TLS 1.3 are fixed.
+func tlsCipherSuite(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+// CertificatePair names the certificate (chain) and private key files of a TLS certificate.
+type CertificatePair struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+func (p CertificatePair) String() string {
+	return p.CertFile + ":" + p.KeyFile
+}
+
+// CertificateReloader serves TLS certificates loaded from files, and reloads them when the files
+// change or the process receives SIGHUP. All certificates are replaced atomically. If reloading
+// fails, the error is logged and the previously loaded certificates keep being served.
+type CertificateReloader struct {
+	pairs []CertificatePair
+
+	// Serialises reloads. The loaded certificates are read without locking.
+	mu           sync.Mutex
+	certificates atomic.Value // []*tls.Certificate
+	modTimes     map[string]time.Time
+}
+
+// NewCertificateReloader loads the given certificate pairs. When selecting a certificate, the
+// first pair that is valid for the server name requested by the client is used, falling back
+// to the first pair.
+func NewCertificateReloader(pairs []CertificatePair) (*CertificateReloader, error) {
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("no TLS certificates configured")
+	}
+	r := &CertificateReloader{
+		pairs: pairs,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads all certificate pairs again. The loaded certificates are only replaced if every
+// pair loads successfully.
+func (r *CertificateReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTimes := r.currentModTimes()
+	certificates := make([]*tls.Certificate, len(r.pairs))
+	for i, pair := range r.pairs {
+		certificate, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS certificate %s: %w", pair, err)
+		}
+		certificates[i] = &certificate
+	}
+
+	r.certificates.Store(certificates)
+	r.modTimes = modTimes
+	return nil
+}
+
+func (r *CertificateReloader) currentModTimes() map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, pair := range r.pairs {
+		for _, file := range []string{pair.CertFile, pair.KeyFile} {
+			if info, err := os.Stat(file); err == nil {
+				modTimes[file] = info.ModTime()
+			}
+		}
+	}
+	return modTimes
+}
+
+// changed reports whether any of the certificate files changed since they were last loaded.
+func (r *CertificateReloader) changed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTimes := r.currentModTimes()
+	if len(modTimes) != len(r.modTimes) {
+		return true
+	}
+	for file, modTime := range modTimes {
+		if !modTime.Equal(r.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *CertificateReloader) reloadAndLog(reason string) {
+	if err := r.Reload(); err != nil {
+		slog.Warn("Keeping previous TLS certificates", "error", err)
+		return
+	}
+	slog.Info("Reloaded TLS certificates", "reason", reason)
+}
+
+// Watch reloads the certificates whenever the process receives SIGHUP and, if pollInterval is
+// positive, whenever the files change, until stop is closed.
+func (r *CertificateReloader) Watch(pollInterval time.Duration, stop <-chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	var poll <-chan time.Time
+	if pollInterval > 0 {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-signals:
+			r.reloadAndLog("SIGHUP")
+		case <-poll:
+			if r.changed() {
+				r.reloadAndLog("files changed")
+			}
+		}
+	}
+}
+
+// GetCertificate selects the certificate for a TLS handshake. It is suitable for use as
+// tls.Config.GetCertificate.
+func (r *CertificateReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certificates := r.certificates.Load().([]*tls.Certificate)
+	if len(certificates) > 1 {
+		for _, certificate := range certificates {
+			if hello.SupportsCertificate(certificate) == nil {
+				return certificate, nil
+			}
+		}
+	}
+	return certificates[0], nil
+}
+
+// TLSConfig returns a TLS configuration serving the reloadable certificates with the given
+// minimum version and, for TLS 1.2, cipher suites (by name). An empty list of cipher suites
+// uses Go's defaults.
+func (r *CertificateReloader) TLSConfig(minVersion string, cipherSuites []string) (*tls.Config, error) {
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TLS version %q, expected one of %s", minVersion, strings.Join(tlsVersionNames(), ", "))
+	}
+	config := &tls.Config{
+		MinVersion:     version,
+		GetCertificate: r.GetCertificate,
+	}
+	for _, name := range cipherSuites {
+		id, ok := tlsCipherSuite(name)
+		if !ok {
+			return nil, fmt.Errorf("unsupported TLS cipher suite %q", name)
+		}
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+	return config, nil
+}
+
+// loadCertPool loads the PEM-encoded CA certificates in files into a certificate pool.
+func loadCertPool(files []string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", file)
+		}
+	}
+	return pool, nil
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate for the given names and its key to
+// files in dir.
+func writeTestCertificate(t *testing.T, dir, name string, serial int64, dnsNames ...string) CertificatePair {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pair := CertificatePair{
+		CertFile: filepath.Join(dir, name+".pem"),
+		KeyFile:  filepath.Join(dir, name+"-key.pem"),
+	}
+	if err := os.WriteFile(pair.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pair.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+func expectServedCertificate(t *testing.T, reloader *CertificateReloader, serverName string, serial int64) {
+	t.Helper()
+	certificate, err := reloader.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:        serverName,
+		SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedVersions: []uint16{tls.VersionTLS13},
+		SupportedCurves:   []tls.CurveID{tls.CurveP256},
+		CipherSuites:      []uint16{tls.TLS_AES_128_GCM_SHA256},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.SerialNumber.Int64() != serial {
+		t.Fatalf("Expected certificate %d for %q, got %d", serial, serverName, leaf.SerialNumber.Int64())
+	}
+}
+
+func TestCertificateReloaderSNI(t *testing.T) {
+	dir := t.TempDir()
+	primary := writeTestCertificate(t, dir, "primary", 1, "gateway.example")
+	secondary := writeTestCertificate(t, dir, "secondary", 2, "*.relay.example")
+
+	reloader, err := NewCertificateReloader([]CertificatePair{primary, secondary})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectServedCertificate(t, reloader, "gateway.example", 1)
+	expectServedCertificate(t, reloader, "a.relay.example", 2)
+	expectServedCertificate(t, reloader, "unknown.example", 1)
+	expectServedCertificate(t, reloader, "", 1)
+}
+
+func TestCertificateReloaderReload(t *testing.T) {
+	dir := t.TempDir()
+	pair := writeTestCertificate(t, dir, "gateway", 1, "gateway.example")
+	reloader, err := NewCertificateReloader([]CertificatePair{pair})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloader.changed() {
+		t.Fatal("Expected no changes right after loading")
+	}
+
+	// Rotate the certificate, making sure the modification time moves on
+	writeTestCertificate(t, dir, "gateway", 2, "gateway.example")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(pair.CertFile, later, later)
+	if !reloader.changed() {
+		t.Fatal("Expected the rotated certificate to be detected")
+	}
+	reloader.reloadAndLog("test")
+	expectServedCertificate(t, reloader, "gateway.example", 2)
+	if reloader.changed() {
+		t.Fatal("Expected no changes after reloading")
+	}
+
+	// A broken certificate is reported and the previous one keeps being served
+	if err := os.WriteFile(pair.CertFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloader.Reload(); err == nil {
+		t.Fatal("Expected reloading a broken certificate to fail")
+	}
+	expectServedCertificate(t, reloader, "gateway.example", 2)
+}
+
+func TestCertificateReloaderTLSConfig(t *testing.T) {
+	pair := writeTestCertificate(t, t.TempDir(), "gateway", 1, "gateway.example")
+	reloader, err := NewCertificateReloader([]CertificatePair{pair})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := reloader.TLSConfig("1.3", []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MinVersion != tls.VersionTLS13 || len(config.CipherSuites) != 1 || config.CipherSuites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Fatalf("Unexpected TLS configuration %+v", config)
+	}
+	if _, err := reloader.TLSConfig("1.0", nil); err == nil {
+		t.Fatal("Expected TLS 1.0 to be rejected")
+	}
+	if _, err := reloader.TLSConfig("1.2", []string{"TLS_RSA_WITH_RC4_128_SHA"}); err == nil {
+		t.Fatal("Expected an insecure cipher suite to be rejected")
+	}
+}